@@ -0,0 +1,109 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// WriteBatch accumulates writes to a tree, and applies them all at once
+// when Flush is called. Writes to the same stem are coalesced, so that the
+// commitments of its leaf are updated once for all of them, instead of once
+// per write. Only insertions are batched, deletions must be applied to the
+// tree directly. A WriteBatch must not be used concurrently.
+type WriteBatch struct {
+	root  *InternalNode
+	stems map[string][][]byte // pending values, indexed by stem
+}
+
+// NewWriteBatch creates an empty batch of writes to root.
+func NewWriteBatch(root *InternalNode) *WriteBatch {
+	return &WriteBatch{
+		root:  root,
+		stems: make(map[string][][]byte),
+	}
+}
+
+// Insert records a write of value at key. It is only applied to the tree
+// when Flush is called, and overrides any previous write to the same key.
+func (b *WriteBatch) Insert(key, value []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	if len(value) == 0 {
+		return fmt.Errorf("empty value for key %x", key)
+	}
+	if len(value) > LeafValueSize {
+		return fmt.Errorf("invalid value length %d for key %x, expected at most %d", len(value), key, LeafValueSize)
+	}
+	values, ok := b.stems[string(KeyToStem(key))]
+	if !ok {
+		values = make([][]byte, NodeWidth)
+		b.stems[string(KeyToStem(key))] = values
+	}
+	values[key[StemSize]] = bytes.Clone(value)
+	return nil
+}
+
+// Get returns the value at key, taking the pending writes into account.
+func (b *WriteBatch) Get(key []byte, resolver NodeResolverFn) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	if values, ok := b.stems[string(KeyToStem(key))]; ok && values[key[StemSize]] != nil {
+		return values[key[StemSize]], nil
+	}
+	return b.root.Get(key, resolver)
+}
+
+// Len returns the number of stems with pending writes.
+func (b *WriteBatch) Len() int {
+	return len(b.stems)
+}
+
+// Flush applies the pending writes to the tree, one stem at a time, and
+// empties the batch. The tree still has to be committed afterwards. If an
+// error occurs, the writes to the stems that come before the failing one,
+// in increasing order, have been applied and are removed from the batch.
+func (b *WriteBatch) Flush(resolver NodeResolverFn) error {
+	stems := make([][]byte, 0, len(b.stems))
+	for stem := range b.stems {
+		stems = append(stems, []byte(stem))
+	}
+	sort.Slice(stems, func(i, j int) bool {
+		return bytes.Compare(stems[i], stems[j]) < 0
+	})
+
+	for _, stem := range stems {
+		if err := b.root.InsertValuesAtStem(stem, b.stems[string(stem)], resolver); err != nil {
+			return fmt.Errorf("writing values at stem %x: %w", stem, err)
+		}
+		delete(b.stems, string(stem))
+	}
+	return nil
+}
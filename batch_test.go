@@ -0,0 +1,182 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// batchKeys returns numStems random stems, each of them with numSuffixes
+// keys.
+func batchKeys(t *testing.T, numStems, numSuffixes int) [][]byte {
+	keys := make([][]byte, 0, numStems*numSuffixes)
+	for i, stemKey := range randomKeys(t, numStems) {
+		for j := 0; j < numSuffixes; j++ {
+			key, err := JoinKey(KeyToStem(stemKey), byte(i+j*41))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestWriteBatch(t *testing.T) {
+	t.Parallel()
+
+	existing := randomKeys(t, 100)
+	keys := append(batchKeys(t, 50, 5), existing[:20]...)
+	expected, root := New().(*InternalNode), New().(*InternalNode)
+	for _, tree := range []*InternalNode{expected, root} {
+		for _, key := range existing {
+			if err := tree.Insert(key, testValue, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree.Commit()
+	}
+
+	batch := NewWriteBatch(root)
+	for _, key := range keys {
+		if err := expected.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		expected.Commit()
+
+		// Write another value first, the last write wins.
+		if err := batch.Insert(key, testValue); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batch.Len() != 70 {
+		t.Fatalf("invalid number of pending stems, got %d, expected 70", batch.Len())
+	}
+	for _, key := range [][]byte{keys[0], existing[50]} {
+		value, err := batch.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := expected.Get(key, nil)
+		if !bytes.Equal(value, want) {
+			t.Fatalf("invalid value read through the batch, got %x, expected %x", value, want)
+		}
+	}
+	if root.IsDirty() {
+		t.Fatal("the tree was written to before the batch was flushed")
+	}
+
+	if err := batch.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Len() != 0 {
+		t.Fatal("the batch isn't empty after being flushed")
+	}
+	if !root.Commit().Equal(expected.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", root.Commitment().Bytes(), expected.Commitment().Bytes())
+	}
+
+	if err := batch.Insert(keys[0][:10], testValue); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+	if err := batch.Insert(keys[0], nil); err == nil {
+		t.Fatal("expected an error for an empty value")
+	}
+	if err := batch.Insert(keys[0], make([]byte, LeafValueSize+1)); err == nil {
+		t.Fatal("expected an error for a value that is too long")
+	}
+
+	// The batch keeps its own copy of the values.
+	value := bytes.Clone(testValue)
+	if err := batch.Insert(keys[0], value); err != nil {
+		t.Fatal(err)
+	}
+	value[0]++
+	if got, err := batch.Get(keys[0], nil); err != nil || !bytes.Equal(got, testValue) {
+		t.Fatalf("pending write was modified by the caller, got %x, expected %x", got, testValue)
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	existing := make([][]byte, 10_000)
+	for i := range existing {
+		existing[i] = make([]byte, KeySize)
+		if _, err := rand.Read(existing[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	keys := make([][]byte, 0, 5*1_000)
+	for _, stemKey := range existing[:1_000] {
+		for j := 0; j < 5; j++ {
+			key, _ := JoinKey(KeyToStem(stemKey), byte(j*50))
+			keys = append(keys, key)
+		}
+	}
+	newTree := func(b *testing.B) *InternalNode {
+		b.StopTimer()
+		defer b.StartTimer()
+		root := New().(*InternalNode)
+		for _, key := range existing {
+			if err := root.Insert(key, testValue, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		root.Commit()
+		return root
+	}
+
+	b.Run("Insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root := newTree(b)
+			for _, key := range keys {
+				if err := root.Insert(key, key, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			root.Commit()
+		}
+	})
+	b.Run("WriteBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root := newTree(b)
+			batch := NewWriteBatch(root)
+			for _, key := range keys {
+				if err := batch.Insert(key, key); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := batch.Flush(nil); err != nil {
+				b.Fatal(err)
+			}
+			root.Commit()
+		}
+	})
+}
@@ -26,6 +26,7 @@
 package verkle
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/crate-crypto/go-ipa/ipa"
@@ -90,3 +91,25 @@ func (conf *IPAConfig) CommitToPoly(poly []Fr, _ int) *Point {
 	ret := conf.conf.Commit(poly)
 	return &ret
 }
+
+// CommitToPolynomial returns the commitment to a polynomial given in
+// evaluation form over the domain [0, NodeWidth). Missing coefficients
+// are considered to be zero.
+func CommitToPolynomial(coeffs []Fr) (*Point, error) {
+	if len(coeffs) > NodeWidth {
+		return nil, fmt.Errorf("polynomial has %d coefficients, at most %d are supported", len(coeffs), NodeWidth)
+	}
+	var poly [NodeWidth]Fr
+	copy(poly[:], coeffs)
+	return GetConfig().CommitToPoly(poly[:], NodeWidth-len(coeffs)), nil
+}
+
+// EvaluatePolynomialAt returns the evaluation at z of a polynomial given
+// in evaluation form over the domain [0, NodeWidth), i.e. using the
+// lagrange basis. Missing coefficients are considered to be zero.
+func EvaluatePolynomialAt(coeffs []Fr, z byte) Fr {
+	if int(z) >= len(coeffs) {
+		return FrZero
+	}
+	return coeffs[z]
+}
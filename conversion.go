@@ -86,6 +86,124 @@ func BatchNewLeafNode(nodesValues []BatchNewLeafNodeData) ([]LeafNode, error) {
 	return ret, nil
 }
 
+// BuildParallelFromSorted builds a tree out of a list of stems, sorted in
+// strictly increasing order, and the values to insert at each of them. Stems
+// are split by top-level child, each of the resulting subtrees is built by
+// one of workers goroutines, and they are then merged with MergeTrees. If
+// workers isn't positive, runtime.NumCPU() goroutines are used. The returned
+// tree is committed.
+func BuildParallelFromSorted(stems [][]byte, valueSets [][][]byte, workers int) (VerkleNode, error) {
+	if len(stems) != len(valueSets) {
+		return nil, fmt.Errorf("number of stems (%d) and value sets (%d) differ", len(stems), len(valueSets))
+	}
+	for i := range stems {
+		if len(stems[i]) != StemSize {
+			return nil, fmt.Errorf("invalid stem length %d for stem %x", len(stems[i]), stems[i])
+		}
+		if i > 0 && bytes.Compare(stems[i-1], stems[i]) >= 0 {
+			return nil, fmt.Errorf("stems aren't sorted: %x comes before %x", stems[i-1], stems[i])
+		}
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var subroots []*InternalNode
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(workers)
+	for start := 0; start < len(stems); {
+		end := start + 1
+		for end < len(stems) && stems[end][0] == stems[start][0] {
+			end++
+		}
+
+		subroot := New().(*InternalNode)
+		subroots = append(subroots, subroot)
+		group.Go(func(stems [][]byte, valueSets [][][]byte) func() error {
+			return func() error {
+				for i := range stems {
+					if err := subroot.InsertValuesAtStem(stems[i], valueSets[i], nil); err != nil {
+						return fmt.Errorf("inserting values at stem %x: %w", stems[i], err)
+					}
+				}
+				return nil
+			}
+		}(stems[start:end], valueSets[start:end]))
+		start = end
+	}
+	if err := group.Wait(); err != nil {
+		return nil, fmt.Errorf("building subtrees: %w", err)
+	}
+
+	root := MergeTrees(subroots)
+	root.Commit()
+	return root, nil
+}
+
+// KeyValue is a key and the value stored at it.
+type KeyValue struct {
+	Key, Value []byte
+}
+
+// GroupKeyValuesByStem groups sorted keys, and the values at the same index,
+// by stem, in the format expected by BatchNewLeafNode. Keys must be 32 bytes
+// long, and sorted in strictly increasing order.
+func GroupKeyValuesByStem(keys, values [][]byte) ([]BatchNewLeafNodeData, error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("number of keys (%d) and values (%d) differ", len(keys), len(values))
+	}
+
+	var nodesValues []BatchNewLeafNodeData
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("invalid key length %d for key %x, expected %d", len(key), key, KeySize)
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return nil, fmt.Errorf("keys aren't sorted: %x comes before %x", keys[i-1], key)
+		}
+
+		stem := KeyToStem(key)
+		if len(nodesValues) == 0 || !bytes.Equal(nodesValues[len(nodesValues)-1].Stem, stem) {
+			nodesValues = append(nodesValues, BatchNewLeafNodeData{
+				Stem:   stem,
+				Values: make(map[byte][]byte),
+			})
+		}
+		nodesValues[len(nodesValues)-1].Values[key[StemSize]] = values[i]
+	}
+	return nodesValues, nil
+}
+
+// BuildTreeFromSortedKVs builds a tree out of a list of key/value pairs,
+// sorted by key in strictly increasing order. Contiguous pairs sharing a stem
+// are grouped into a single leaf, the leaves are created with
+// BatchNewLeafNode and then inserted with InsertMigratedLeaves. The returned
+// tree isn't committed.
+func BuildTreeFromSortedKVs(kvs []KeyValue) (*InternalNode, error) {
+	keys := make([][]byte, len(kvs))
+	values := make([][]byte, len(kvs))
+	for i, kv := range kvs {
+		keys[i], values[i] = kv.Key, kv.Value
+	}
+	nodesValues, err := GroupKeyValuesByStem(keys, values)
+	if err != nil {
+		return nil, err
+	}
+
+	root := New().(*InternalNode)
+	if len(nodesValues) == 0 {
+		return root, nil
+	}
+	leaves, err := BatchNewLeafNode(nodesValues)
+	if err != nil {
+		return nil, err
+	}
+	if err := root.InsertMigratedLeaves(leaves, nil); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
 // firstDiffByteIdx will return the first index in which the two stems differ.
 // Both stems *must* be different.
 func firstDiffByteIdx(stem1 []byte, stem2 []byte) int {
@@ -97,6 +215,11 @@ func firstDiffByteIdx(stem1 []byte, stem2 []byte) int {
 	panic("stems are equal")
 }
 
+// InsertMigratedLeaves inserts prebuilt leaves in the tree. The values of a
+// leaf are only written where the tree has none, since the values already in
+// the tree are more recent than the migrated ones. It can also be used on a
+// tree rebuilt from a proof, as long as the leaves are inserted at stems that
+// the proof covers.
 func (n *InternalNode) InsertMigratedLeaves(leaves []LeafNode, resolver NodeResolverFn) error {
 	sort.Slice(leaves, func(i, j int) bool {
 		return bytes.Compare(leaves[i].stem, leaves[j].stem) < 0
@@ -176,12 +299,20 @@ func (n *InternalNode) insertMigratedLeavesSubtree(leaves []LeafNode, resolver N
 		}
 
 		switch node := parent.children[ln.stem[parent.depth]].(type) {
+		case UnknownNode:
+			// This happens when inserting into a tree rebuilt from a
+			// proof, at a stem that the proof doesn't cover.
+			return fmt.Errorf("inserting leaf %x: node at path %x isn't part of the proof the tree was rebuilt from: %w", ln.stem, ln.stem[:parent.depth+1], errMissingNodeInStateless)
 		case Empty:
 			parent.cowChild(ln.stem[parent.depth])
 			parent.children[ln.stem[parent.depth]] = &ln
 			ln.setDepth(parent.depth + 1)
 		case *LeafNode:
 			if bytes.Equal(node.stem, ln.stem) {
+				// The values of a proof of absence stub are unknown.
+				if node.isPOAStub {
+					return errIsPOAStub
+				}
 				// In `ln` we have migrated key/values which should be copied to the leaf
 				// only if there isn't a value there. If there's a value, we skip it since
 				// our migrated value is stale.
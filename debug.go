@@ -25,6 +25,11 @@
 
 package verkle
 
+import (
+	"bytes"
+	"fmt"
+)
+
 // A few proxy types that export their fields, so that the core type
 // does not. The conversion from one type to the other is done by calling
 // toExportable on an InternalNode.
@@ -44,3 +49,68 @@ type (
 		C2 [32]byte `json:"c2"`
 	}
 )
+
+// KeyMismatch describes how two trees differ along the path to a key.
+type KeyMismatch struct {
+	Key    []byte
+	ValueA []byte
+	ValueB []byte
+
+	// Depth is the depth of the deepest node on the path to the key
+	// whose commitment differs between the two trees.
+	Depth int
+}
+
+// WitnessDiff compares two trees along the paths to a set of keys, and
+// reports the keys whose values differ, or for which the nodes at the end
+// of their paths differ. Keys whose paths only share some differing
+// internal nodes with another key are not reported, as these nodes differ
+// as soon as anything below them does. Both trees are committed first.
+func WitnessDiff(treeA, treeB VerkleNode, keys [][]byte, resolver NodeResolverFn) ([]KeyMismatch, error) {
+	treeA.Commit()
+	treeB.Commit()
+
+	var mismatches []KeyMismatch
+	for _, key := range keys {
+		valueA, err := treeA.Get(key, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %x from tree A: %w", key, err)
+		}
+		valueB, err := treeB.Get(key, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %x from tree B: %w", key, err)
+		}
+
+		// Walk both trees in lockstep, while the nodes on the
+		// path to the key differ. If the nodes at the end of the
+		// path still differ, the key's witnesses differ.
+		var (
+			depth    = -1
+			diverged bool
+			a, b     = treeA, treeB
+		)
+		for d := 0; ; d++ {
+			if a.Commitment().Equal(b.Commitment()) {
+				break
+			}
+			depth = d
+			internalA, okA := a.(*InternalNode)
+			internalB, okB := b.(*InternalNode)
+			if !okA || !okB {
+				diverged = true
+				break
+			}
+			if a, err = internalA.resolveChild(key[:d], key[d], resolver); err != nil {
+				return nil, err
+			}
+			if b, err = internalB.resolveChild(key[:d], key[d], resolver); err != nil {
+				return nil, err
+			}
+		}
+
+		if diverged || !bytes.Equal(valueA, valueB) {
+			mismatches = append(mismatches, KeyMismatch{Key: key, ValueA: valueA, ValueB: valueB, Depth: depth})
+		}
+	}
+	return mismatches, nil
+}
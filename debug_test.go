@@ -26,6 +26,7 @@
 package verkle
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -54,3 +55,37 @@ func TestJSON(t *testing.T) {
 	}
 	t.Log(string(output))
 }
+
+func TestWitnessDiff(t *testing.T) {
+	t.Parallel()
+
+	treeA, treeB := New(), New()
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := treeA.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+		value := testValue
+		if bytes.Equal(key, forkOneKeyTest) {
+			value = fourtyKeyTest
+		}
+		if err := treeB.Insert(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mismatches, err := WitnessDiff(treeA, treeB, [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, fourtyKeyTest, ffx32KeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("invalid number of mismatches, got %d, expected 1", len(mismatches))
+	}
+	mismatch := mismatches[0]
+	if !bytes.Equal(mismatch.Key, forkOneKeyTest) || !bytes.Equal(mismatch.ValueA, testValue) || !bytes.Equal(mismatch.ValueB, fourtyKeyTest) {
+		t.Fatalf("invalid mismatch %x: %x != %x", mismatch.Key, mismatch.ValueA, mismatch.ValueB)
+	}
+	// The leaf of forkOneKeyTest is a child of the internal node at 00.
+	if mismatch.Depth != 2 {
+		t.Fatalf("invalid divergence depth, got %d, expected 2", mismatch.Depth)
+	}
+}
@@ -38,6 +38,12 @@ var (
 	errUnknownNodeType        = errors.New("unknown node type detected")
 	errMissingNodeInStateless = errors.New("trying to access a node that is missing from the stateless view")
 	errIsPOAStub              = errors.New("trying to read/write a proof of absence leaf node")
+	errInvalidLeafMarker      = errors.New("suffix commitment does not match the leaf marker encoding of its values")
+	errNoKeys                 = errors.New("no key provided for proof")
+	errNotInSnapshot          = errors.New("node isn't part of the snapshot")
+	errUnexpectedProofValue   = errors.New("proven value differs from the expected one")
+	errStaleCommitment        = errors.New("cached commitment differs from the recomputed one")
+	errCommitmentNotComputed  = errors.New("commitment hasn't been computed")
 )
 
 const (
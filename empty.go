@@ -39,6 +39,14 @@ func (Empty) Delete([]byte, NodeResolverFn) (bool, error) {
 	return false, errors.New("cant delete an empty node")
 }
 
+func (Empty) InsertValuesAtStem(Stem, [][]byte, NodeResolverFn) error {
+	return errDirectInsertIntoEmptyNode
+}
+
+func (Empty) DeleteAtStem([]byte, NodeResolverFn) (bool, error) {
+	return false, errDeleteMissing
+}
+
 func (Empty) Get([]byte, NodeResolverFn) ([]byte, error) {
 	return nil, nil
 }
@@ -73,6 +81,10 @@ func (Empty) setDepth(_ byte) {
 	panic("should not be try to set the depth of an Empty node")
 }
 
+func (Empty) Size() int {
+	return 0
+}
+
 func (Empty) Hash() *Fr {
 	return &FrZero
 }
@@ -39,6 +39,12 @@ func TestEmptyFuncs(t *testing.T) {
 	if err == nil {
 		t.Fatal("got nil error when deleting from empty")
 	}
+	if err := e.InsertValuesAtStem(KeyToStem(zeroKeyTest), make([][]byte, NodeWidth), nil); err == nil {
+		t.Fatal("got nil error when inserting values into empty")
+	}
+	if _, err := e.DeleteAtStem(zeroKeyTest, nil); err != errDeleteMissing {
+		t.Fatalf("got %v, want %v", err, errDeleteMissing)
+	}
 	v, err := e.Get(zeroKeyTest, nil)
 	if err != nil {
 		t.Fatal("got non-nil error when getting from empty")
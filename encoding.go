@@ -28,8 +28,10 @@ package verkle
 import (
 	"errors"
 	"fmt"
+	"runtime"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -61,6 +63,15 @@ const (
 	leafValueIndexSize     = 1
 	singleSlotLeafSize     = nodeTypeSize + StemSize + 2*banderwagon.UncompressedSize + leafValueIndexSize + leafSlotSize
 	eoaLeafSize            = nodeTypeSize + StemSize + 2*banderwagon.UncompressedSize + leafBasicDataSize
+
+	// maxSerializedNodeSize is the size of the largest serialized node,
+	// i.e. a leaf holding all of its values.
+	maxSerializedNodeSize = leafChildrenOffset + NodeWidth*LeafValueSize
+
+	// Leaf nodes with collapsed zero values offsets.
+	leafZeroCollapsedZerolistOffset   = leafBitlistOffset + bitlistSize
+	leafZeroCollapsedCommitmentOffset = leafZeroCollapsedZerolistOffset + bitlistSize
+	leafZeroCollapsedChildrenOffset   = leafZeroCollapsedCommitmentOffset + 3*banderwagon.UncompressedSize
 )
 
 func bit(bitlist []byte, nr int) bool {
@@ -78,6 +89,7 @@ var errSerializedPayloadTooShort = errors.New("verkle payload is too short")
 // - Leaf nodes:       <nodeType><stem><bitlist><comm><c1comm><c2comm><children...>
 // - EoA nodes:        <nodeType><stem><comm><c1comm><balance><nonce>
 // - single slot node: <nodeType><stem><comm><cncomm><leaf index><slot>
+// - Zero-collapsed:   <nodeType><stem><bitlist><zerolist><comm><c1comm><c2comm><non-zero children...>
 func ParseNode(serializedNode []byte, depth byte) (VerkleNode, error) {
 	// Check that the length of the serialized node is at least the smallest possible serialized node.
 	if len(serializedNode) < nodeTypeSize+banderwagon.UncompressedSize {
@@ -93,11 +105,46 @@ func ParseNode(serializedNode []byte, depth byte) (VerkleNode, error) {
 		return parseEoAccountNode(serializedNode, depth)
 	case singleSlotType:
 		return parseSingleSlotNode(serializedNode, depth)
+	case leafZeroCollapsedType:
+		return parseZeroCollapsedLeafNode(serializedNode, depth)
 	default:
 		return nil, ErrInvalidNodeEncoding
 	}
 }
 
+// BatchParseNodes parses several nodes, the i-th of them being found at
+// depth depths[i], like calling ParseNode for each of them would. Commitments
+// are serialized uncompressed, so decoding them is cheap and there is nothing
+// to gain from batching their field operations: the nodes are instead split
+// among runtime.NumCPU() goroutines.
+func BatchParseNodes(serialized [][]byte, depths []byte) ([]VerkleNode, error) {
+	if len(serialized) != len(depths) {
+		return nil, fmt.Errorf("number of nodes (%d) and depths (%d) differ", len(serialized), len(depths))
+	}
+
+	nodes := make([]VerkleNode, len(serialized))
+	numBatches := runtime.NumCPU()
+	batchSize := (len(serialized) + numBatches - 1) / numBatches
+	var group errgroup.Group
+	for start := 0; start < len(serialized); start += batchSize {
+		end := min(start+batchSize, len(serialized))
+		group.Go(func() error {
+			for i := start; i < end; i++ {
+				node, err := ParseNode(serialized[i], depths[i])
+				if err != nil {
+					return fmt.Errorf("parsing node #%d: %w", i, err)
+				}
+				nodes[i] = node
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
 func parseLeafNode(serialized []byte, depth byte) (VerkleNode, error) {
 	bitlist := serialized[leafBitlistOffset : leafBitlistOffset+bitlistSize]
 	var values [NodeWidth][]byte
@@ -134,6 +181,48 @@ func parseLeafNode(serialized []byte, depth byte) (VerkleNode, error) {
 	return ln, nil
 }
 
+func parseZeroCollapsedLeafNode(serialized []byte, depth byte) (VerkleNode, error) {
+	if len(serialized) < leafZeroCollapsedChildrenOffset {
+		return nil, errSerializedPayloadTooShort
+	}
+	var (
+		bitlist  = serialized[leafBitlistOffset:leafZeroCollapsedZerolistOffset]
+		zerolist = serialized[leafZeroCollapsedZerolistOffset:leafZeroCollapsedCommitmentOffset]
+		values   [NodeWidth][]byte
+		offset   = leafZeroCollapsedChildrenOffset
+	)
+	for i := 0; i < NodeWidth; i++ {
+		if !bit(bitlist, i) {
+			if bit(zerolist, i) {
+				return nil, ErrInvalidNodeEncoding
+			}
+			continue
+		}
+		if bit(zerolist, i) {
+			values[i] = make([]byte, LeafValueSize)
+			continue
+		}
+		if offset+LeafValueSize > len(serialized) {
+			return nil, fmt.Errorf("verkle payload is too short, need at least %d and only have %d, payload = %x (%w)", offset+LeafValueSize, len(serialized), serialized, errSerializedPayloadTooShort)
+		}
+		values[i] = serialized[offset : offset+LeafValueSize]
+		offset += LeafValueSize
+	}
+	ln := NewLeafNodeWithNoComms(serialized[leafStemOffset:leafStemOffset+StemSize], values[:])
+	ln.setDepth(depth)
+
+	comms := make([]*Point, 3)
+	for i := range comms {
+		start := leafZeroCollapsedCommitmentOffset + i*banderwagon.UncompressedSize
+		comms[i] = new(Point)
+		if err := comms[i].SetBytesUncompressed(serialized[start:start+banderwagon.UncompressedSize], true); err != nil {
+			return nil, fmt.Errorf("setting commitment: %w", err)
+		}
+	}
+	ln.commitment, ln.c1, ln.c2 = comms[0], comms[1], comms[2]
+	return ln, nil
+}
+
 func parseEoAccountNode(serialized []byte, depth byte) (VerkleNode, error) {
 	var values [NodeWidth][]byte
 	offset := leafStemOffset + StemSize + 2*banderwagon.UncompressedSize
@@ -2,6 +2,7 @@ package verkle
 
 import (
 	"bytes"
+	"crypto/rand"
 	"testing"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
@@ -190,3 +191,163 @@ func TestParseNodeSingleSlot(t *testing.T) {
 		t.Fatalf("invalid commitment, got %x, expected %x", lnd.commitment, ln.commitment)
 	}
 }
+
+func TestParseNodeZeroCollapsed(t *testing.T) {
+	values := make([][]byte, NodeWidth)
+	for i := 0; i < 64; i++ {
+		values[i] = make([]byte, LeafValueSize)
+	}
+	values[5] = testValue
+	values[200] = EmptyCodeHash
+	ln, err := NewLeafNode(ffx32KeyTest[:31], values)
+	if err != nil {
+		t.Fatalf("error creating leaf node: %v", err)
+	}
+
+	serialized, err := ln.Serialize()
+	if err != nil {
+		t.Fatalf("error serializing leaf node: %v", err)
+	}
+	collapsed, err := ln.SerializeCollapsingZeros()
+	if err != nil {
+		t.Fatalf("error serializing leaf node: %v", err)
+	}
+	if collapsed[0] != leafZeroCollapsedType {
+		t.Fatalf("invalid encoding type, got %d, expected %d", collapsed[0], leafZeroCollapsedType)
+	}
+	if len(collapsed) >= len(serialized) {
+		t.Fatalf("collapsed encoding isn't smaller: %d >= %d", len(collapsed), len(serialized))
+	}
+
+	deserialized, err := ParseNode(collapsed, 5)
+	if err != nil {
+		t.Fatalf("error deserializing leaf node: %v", err)
+	}
+	lnd, ok := deserialized.(*LeafNode)
+	if !ok {
+		t.Fatalf("expected leaf node, got %T", deserialized)
+	}
+	if lnd.depth != 5 {
+		t.Fatalf("invalid depth, got %d, expected %d", lnd.depth, 5)
+	}
+	if !bytes.Equal(lnd.stem, ffx32KeyTest[:31]) {
+		t.Fatalf("invalid stem, got %x, expected %x", lnd.stem, ffx32KeyTest[:31])
+	}
+	for i := range values {
+		if !bytes.Equal(lnd.values[i], values[i]) || (lnd.values[i] == nil) != (values[i] == nil) {
+			t.Fatalf("value %d, got %x, expected %x", i, lnd.values[i], values[i])
+		}
+	}
+	if !lnd.commitment.Equal(ln.commitment) {
+		t.Fatalf("invalid commitment, got %x, expected %x", lnd.commitment, ln.commitment)
+	}
+
+	// The parsed values commit to the same point as the original ones.
+	recomputed, err := NewLeafNode(lnd.stem, lnd.values)
+	if err != nil {
+		t.Fatalf("error creating leaf node: %v", err)
+	}
+	if !recomputed.commitment.Equal(ln.commitment) {
+		t.Fatalf("invalid recomputed commitment, got %x, expected %x", recomputed.commitment, ln.commitment)
+	}
+
+	// Zero values aren't equivalent to absent ones.
+	absent := make([][]byte, NodeWidth)
+	absent[5] = testValue
+	absent[200] = EmptyCodeHash
+	lna, err := NewLeafNode(ffx32KeyTest[:31], absent)
+	if err != nil {
+		t.Fatalf("error creating leaf node: %v", err)
+	}
+	if lna.commitment.Equal(ln.commitment) {
+		t.Fatal("zero values and absent values have the same commitment")
+	}
+}
+
+func TestBatchParseNodes(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range randomKeys(t, 500) {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := make([][]byte, len(nodes))
+	depths := make([]byte, len(nodes))
+	for i, node := range nodes {
+		serialized[i] = node.SerializedBytes
+		depths[i] = byte(len(node.Path))
+	}
+
+	parsed, err := BatchParseNodes(serialized, depths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(nodes) {
+		t.Fatalf("invalid number of nodes, got %d, expected %d", len(parsed), len(nodes))
+	}
+	for i := range serialized {
+		expected, err := ParseNode(serialized[i], depths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !NodesEqual(parsed[i], expected) || !parsed[i].Commitment().Equal(expected.Commitment()) {
+			t.Fatalf("node #%d differs from the one returned by ParseNode", i)
+		}
+	}
+
+	serialized[len(serialized)/2] = []byte{0xff}
+	if _, err := BatchParseNodes(serialized, depths); err == nil {
+		t.Fatal("expected an error for an invalid node")
+	}
+	if _, err := BatchParseNodes(serialized, depths[1:]); err == nil {
+		t.Fatal("expected an error for a missing depth")
+	}
+}
+
+func BenchmarkBatchParseNodes(b *testing.B) {
+	root := New().(*InternalNode)
+	for i := 0; i < 10_000; i++ {
+		key := make([]byte, KeySize)
+		if _, err := rand.Read(key); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(key, key, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	nodes, err := root.BatchSerialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+	serialized := make([][]byte, len(nodes))
+	depths := make([]byte, len(nodes))
+	for i, node := range nodes {
+		serialized[i] = node.SerializedBytes
+		depths[i] = byte(len(node.Path))
+	}
+
+	b.Run("ParseNode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range serialized {
+				if _, err := ParseNode(serialized[j], depths[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("BatchParseNodes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := BatchParseNodes(serialized, depths); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
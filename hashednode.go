@@ -40,6 +40,14 @@ func (HashedNode) Delete([]byte, NodeResolverFn) (bool, error) {
 	return false, errors.New("cant delete a hashed node in-place")
 }
 
+func (HashedNode) InsertValuesAtStem(Stem, [][]byte, NodeResolverFn) error {
+	return errInsertIntoHash
+}
+
+func (HashedNode) DeleteAtStem([]byte, NodeResolverFn) (bool, error) {
+	return false, errDeleteHash
+}
+
 func (HashedNode) Get([]byte, NodeResolverFn) ([]byte, error) {
 	return nil, errors.New("can not read from a hash node")
 }
@@ -71,13 +79,22 @@ func (HashedNode) Copy() VerkleNode {
 }
 
 func (HashedNode) toDot(parent, path string) string {
-	return fmt.Sprintf("hash%s [label=\"unresolved\"]\n%s -> hash%s\n", path, parent, path)
+	ret := fmt.Sprintf("hash%s [label=\"unresolved\"]\n", path)
+	if len(parent) > 0 {
+		ret = fmt.Sprintf("%s%s -> hash%s\n", ret, parent, path)
+	}
+	return ret
 }
 
 func (HashedNode) setDepth(_ byte) {
 	// do nothing
 }
 
+// Size returns the size of the commitment that the node stands for.
+func (HashedNode) Size() int {
+	return 32
+}
+
 func (HashedNode) Hash() *Fr {
 	panic("can not hash a hashed node")
 }
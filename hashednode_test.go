@@ -39,6 +39,12 @@ func TestHashedNodeFuncs(t *testing.T) {
 	if err == nil {
 		t.Fatal("got nil error when deleting from a hashed node")
 	}
+	if err := e.InsertValuesAtStem(KeyToStem(zeroKeyTest), make([][]byte, NodeWidth), nil); err != errInsertIntoHash {
+		t.Fatal("got nil error when inserting values into a hashed node")
+	}
+	if _, err := e.DeleteAtStem(zeroKeyTest, nil); err != errDeleteHash {
+		t.Fatal("got nil error when deleting a stem from a hashed node")
+	}
 	v, err := e.Get(zeroKeyTest, nil)
 	if err == nil {
 		t.Fatal("got nil error when getting from a hashed node")
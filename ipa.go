@@ -27,7 +27,11 @@ package verkle
 
 import (
 	"errors"
+	"math/big"
 
+	"github.com/crate-crypto/go-ipa/bandersnatch"
+	"github.com/crate-crypto/go-ipa/bandersnatch/fp"
+	"github.com/crate-crypto/go-ipa/bandersnatch/fr"
 	"github.com/crate-crypto/go-ipa/banderwagon"
 )
 
@@ -66,3 +70,130 @@ func HashPointToBytes(point *Point) [32]byte {
 	point.MapToScalarField(&hashedPoint)
 	return hashedPoint.BytesLE()
 }
+
+// SumPoints returns the sum of the points in ps, or the identity if ps is
+// empty.
+func SumPoints(ps []*Point) *Point {
+	var sum Point
+	sum.SetIdentity()
+	for _, p := range ps {
+		sum.Add(&sum, p)
+	}
+	return &sum
+}
+
+// PointsToFrs maps each point of ps to the scalar field, like
+// MapToScalarField does, sharing a single field inversion among all of them.
+func PointsToFrs(ps []*Point) []*Fr {
+	frs := make([]*Fr, len(ps))
+	for i := range frs {
+		frs[i] = new(Fr)
+	}
+	// This can only fail if both slices have a different length.
+	_ = banderwagon.BatchMapToScalarField(frs, ps)
+	return frs
+}
+
+// CompressPoints returns the compressed serialization of each point of ps,
+// sharing a single field inversion among all of them.
+func CompressPoints(ps []*Point) [][32]byte {
+	return banderwagon.ElementsToBytes(ps...)
+}
+
+// PointsFromHash returns the points whose hash, as computed by
+// MapToScalarField, is h. The hash of a point is x/y, computed in the base
+// field and then reduced to the scalar field, so there are usually several
+// points for a given hash. Each of them is found by solving the curve
+// equation for every base field element that reduces to h.
+func PointsFromHash(h *Fr) []*Point {
+	var (
+		hb, fpModulus big.Int
+		points        []*Point
+		one           = fp.One()
+		minusOne      = fp.MinusOne()
+	)
+	h.ToBigIntRegular(&hb)
+	minusOne.BigInt(&fpModulus)
+	fpModulus.Add(&fpModulus, big.NewInt(1))
+	for u := new(big.Int).Set(&hb); u.Cmp(&fpModulus) < 0; u.Add(u, fr.Modulus()) {
+		var ufp fp.Element
+		ufp.SetBigInt(u)
+
+		// Substituting x = u*y in ax² + y² = 1 + dx²y², gives the
+		// following quadratic equation in Y = y²:
+		//       du²Y² - (au² + 1)Y + 1 = 0
+		var u2, qa, qb, disc, tmp fp.Element
+		u2.Square(&ufp)
+		qa.Mul(&u2, &bandersnatch.CurveParams.D)
+		qb.Mul(&u2, &bandersnatch.CurveParams.A)
+		qb.Add(&qb, &one)
+		qb.Neg(&qb)
+
+		var ys []fp.Element
+		if qa.IsZero() {
+			var y2 fp.Element
+			y2.Neg(&qb)
+			y2.Inverse(&y2)
+			ys = append(ys, y2)
+		} else {
+			disc.Square(&qb)
+			tmp.Double(&qa)
+			tmp.Double(&tmp)
+			disc.Sub(&disc, &tmp)
+			if disc.Sqrt(&disc) == nil {
+				continue
+			}
+			var den fp.Element
+			den.Double(&qa)
+			den.Inverse(&den)
+			for _, sign := range []bool{false, true} {
+				var y2 fp.Element
+				y2.Set(&disc)
+				if sign {
+					y2.Neg(&y2)
+				}
+				y2.Sub(&y2, &qb)
+				y2.Mul(&y2, &den)
+				ys = append(ys, y2)
+			}
+		}
+
+		for _, y2 := range ys {
+			var y, x fp.Element
+			if y.Sqrt(&y2) == nil {
+				continue
+			}
+			x.Mul(&ufp, &y)
+			// The serialized form of a point only tells x, and
+			// the sign of y is picked when deserializing: try
+			// both x and -x and only keep the right point.
+			for _, sign := range []bool{false, true} {
+				var cx fp.Element
+				cx.Set(&x)
+				if sign {
+					cx.Neg(&cx)
+				}
+				var p Point
+				if p.SetBytes(cx.Marshal()) != nil {
+					continue
+				}
+				var ph Fr
+				p.MapToScalarField(&ph)
+				if !ph.Equal(h) || containsPoint(points, &p) {
+					continue
+				}
+				points = append(points, &p)
+			}
+		}
+	}
+	return points
+}
+
+func containsPoint(points []*Point, p *Point) bool {
+	for _, point := range points {
+		if point.Equal(p) {
+			return true
+		}
+	}
+	return false
+}
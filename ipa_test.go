@@ -22,3 +22,44 @@ func TestFromBytes(t *testing.T) {
 	}
 
 }
+
+func TestPointHelpers(t *testing.T) {
+	t.Parallel()
+
+	var points []*Point
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		var fr Fr
+		FromBytes(&fr, key)
+		points = append(points, GetConfig().CommitToPoly([]Fr{fr}, 0))
+	}
+
+	expected := new(Point).SetIdentity()
+	for _, p := range points {
+		expected.Add(expected, p)
+	}
+	if !SumPoints(points).Equal(expected) {
+		t.Fatal("invalid sum of points")
+	}
+	if !SumPoints(nil).Equal(new(Point).SetIdentity()) {
+		t.Fatal("the sum of no point should be the identity")
+	}
+
+	frs := PointsToFrs(points)
+	compressed := CompressPoints(points)
+	if len(frs) != len(points) || len(compressed) != len(points) {
+		t.Fatalf("invalid number of results: %d frs, %d serialized points", len(frs), len(compressed))
+	}
+	for i, p := range points {
+		var fr Fr
+		p.MapToScalarField(&fr)
+		if !frs[i].Equal(&fr) {
+			t.Fatalf("invalid scalar for point #%d", i)
+		}
+		if compressed[i] != p.Bytes() {
+			t.Fatalf("invalid serialization for point #%d", i)
+		}
+	}
+	if len(PointsToFrs(nil)) != 0 || len(CompressPoints(nil)) != 0 {
+		t.Fatal("expected no result for no point")
+	}
+}
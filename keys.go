@@ -0,0 +1,212 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Storage layout constants, as defined in EIP-6800.
+const (
+	basicDataLeafKey    = 0
+	codeHashLeafKey     = 1
+	headerStorageOffset = 64
+	codeOffset          = 128
+)
+
+// mainStorageOffset is the offset of the main storage, i.e. 256^31.
+var mainStorageOffset = new(big.Int).Lsh(big.NewInt(1), 8*StemSize)
+
+// maxSlot is the largest storage slot, i.e. 2^256 - 1.
+var maxSlot = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// AccountProofKeys returns the keys of the basic data, see EncodeBasicData,
+// and of the code hash of each account, sorted and deduplicated so that they
+// can be passed to MakeVerkleMultiProof. Both keys of an account share the
+// stem of its header, so each account is proven by a single leaf. It panics
+// if an address isn't 20 or 32 bytes long.
+func AccountProofKeys(addresses [][]byte) [][]byte {
+	keys := make([][]byte, 0, 2*len(addresses))
+	for _, address := range addresses {
+		addr32, err := addressTo32(address)
+		if err != nil {
+			panic(err)
+		}
+		stem := treeKeyStem(addr32[:], big.NewInt(0))
+		for _, suffix := range []byte{basicDataLeafKey, codeHashLeafKey} {
+			key := make([]byte, KeySize)
+			copy(key, stem)
+			key[StemSize] = suffix
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Sort(keylist(keys))
+	ret := keys[:0]
+	for _, key := range keys {
+		if len(ret) == 0 || !bytes.Equal(key, ret[len(ret)-1]) {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+// addressTo32 returns the 32-byte version of a 20-byte address, that is
+// used by the key derivation. 32-byte addresses are returned as is.
+func addressTo32(address []byte) ([32]byte, error) {
+	var addr32 [32]byte
+	switch len(address) {
+	case 20:
+		copy(addr32[12:], address)
+	case 32:
+		copy(addr32[:], address)
+	default:
+		return addr32, fmt.Errorf("invalid address length %d", len(address))
+	}
+	return addr32, nil
+}
+
+// StorageKeyRange returns the tree keys of the storage slots of an account,
+// in the range [startSlot, endSlot). The first slots live in the account
+// header, and the others in the main storage, following the EIP-6800 layout.
+// The address can be either 20 or 32 bytes long.
+func StorageKeyRange(address []byte, startSlot, endSlot *big.Int) ([][]byte, error) {
+	addr32, err := addressTo32(address)
+	if err != nil {
+		return nil, err
+	}
+	if startSlot.Sign() < 0 || endSlot.Cmp(startSlot) < 0 || endSlot.Cmp(new(big.Int).Add(maxSlot, big.NewInt(1))) > 0 {
+		return nil, fmt.Errorf("invalid storage slot range [%d, %d)", startSlot, endSlot)
+	}
+	if !new(big.Int).Sub(endSlot, startSlot).IsInt64() {
+		return nil, errors.New("storage slot range is too large")
+	}
+
+	var (
+		keys      = make([][]byte, 0, new(big.Int).Sub(endSlot, startSlot).Int64())
+		pos       = new(big.Int)
+		treeIndex = new(big.Int)
+		subIndex  = new(big.Int)
+		stem      []byte
+		stemIndex *big.Int
+	)
+	for slot := new(big.Int).Set(startSlot); slot.Cmp(endSlot) < 0; slot.Add(slot, big.NewInt(1)) {
+		if slot.Cmp(big.NewInt(codeOffset-headerStorageOffset)) < 0 {
+			pos.Add(slot, big.NewInt(headerStorageOffset))
+		} else {
+			pos.Add(slot, mainStorageOffset)
+		}
+		treeIndex.DivMod(pos, big.NewInt(NodeWidth), subIndex)
+
+		// Consecutive slots share the same stem most of the
+		// time, only compute it when the tree index changes.
+		if stemIndex == nil || stemIndex.Cmp(treeIndex) != 0 {
+			stem = treeKeyStem(addr32[:], treeIndex)
+			stemIndex = new(big.Int).Set(treeIndex)
+		}
+		key := make([]byte, KeySize)
+		copy(key, stem)
+		key[StemSize] = byte(subIndex.Uint64())
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// treeKeyStem computes the stem that the EIP-6800 key derivation assigns
+// to a tree index of an account: the hash of the commitment to the address
+// and tree index, split in 16-byte little-endian chunks.
+func treeKeyStem(address []byte, treeIndex *big.Int) []byte {
+	var index [32]byte
+	treeIndex.FillBytes(index[:])
+	for i, j := 0, len(index)-1; i < j; i, j = i+1, j-1 {
+		index[i], index[j] = index[j], index[i]
+	}
+
+	var poly [NodeWidth]Fr
+	poly[0].SetUint64(2 + 256*64)
+	for i, chunk := range [][]byte{address[:16], address[16:], index[:16], index[16:]} {
+		if err := FromLEBytes(&poly[i+1], chunk); err != nil {
+			panic(err) // chunks are 16 bytes long
+		}
+	}
+	comm := GetConfig().CommitToPoly(poly[:], NodeWidth-5)
+	hash := HashPointToBytes(comm)
+	return hash[:StemSize]
+}
+
+// Offsets of the fields packed in the basic data leaf of an account, as
+// defined in EIP-6800. All fields are big-endian, and the bytes between
+// the version and the code size are reserved.
+const (
+	basicDataVersionOffset  = 0
+	basicDataCodeSizeOffset = 5
+	basicDataNonceOffset    = 8
+	basicDataBalanceOffset  = 16
+
+	basicDataCodeSizeBytes = basicDataNonceOffset - basicDataCodeSizeOffset
+	basicDataBalanceBytes  = leafBasicDataSize - basicDataBalanceOffset
+)
+
+// EncodeBasicData packs the version, code size, nonce and balance of an
+// account into the 32-byte basic data leaf value. The code size must fit in
+// 3 bytes, and the balance in 16 bytes.
+func EncodeBasicData(version byte, codeSize uint32, nonce uint64, balance *big.Int) ([]byte, error) {
+	if codeSize >= 1<<(8*basicDataCodeSizeBytes) {
+		return nil, fmt.Errorf("code size %d doesn't fit in %d bytes", codeSize, basicDataCodeSizeBytes)
+	}
+	if balance.Sign() < 0 || balance.BitLen() > 8*basicDataBalanceBytes {
+		return nil, fmt.Errorf("balance %d doesn't fit in %d bytes", balance, basicDataBalanceBytes)
+	}
+
+	data := make([]byte, leafBasicDataSize)
+	data[basicDataVersionOffset] = version
+	for i := 0; i < basicDataCodeSizeBytes; i++ {
+		data[basicDataNonceOffset-1-i] = byte(codeSize >> (8 * i))
+	}
+	binary.BigEndian.PutUint64(data[basicDataNonceOffset:], nonce)
+	balance.FillBytes(data[basicDataBalanceOffset:])
+	return data, nil
+}
+
+// DecodeBasicData unpacks the version, code size, nonce and balance of an
+// account from its 32-byte basic data leaf value.
+func DecodeBasicData(data []byte) (version byte, codeSize uint32, nonce uint64, balance *big.Int, err error) {
+	if len(data) != leafBasicDataSize {
+		return 0, 0, 0, nil, fmt.Errorf("invalid basic data length %d, expected %d", len(data), leafBasicDataSize)
+	}
+	version = data[basicDataVersionOffset]
+	for _, b := range data[basicDataCodeSizeOffset:basicDataNonceOffset] {
+		codeSize = codeSize<<8 | uint32(b)
+	}
+	nonce = binary.BigEndian.Uint64(data[basicDataNonceOffset:])
+	balance = new(big.Int).SetBytes(data[basicDataBalanceOffset:])
+	return version, codeSize, nonce, balance, nil
+}
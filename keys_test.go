@@ -0,0 +1,221 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestStorageKeyRange(t *testing.T) {
+	t.Parallel()
+
+	address := bytes.Repeat([]byte{0xaa}, 20)
+
+	// Slots 62-65 straddle the header/main storage boundary.
+	keys, err := StorageKeyRange(address, big.NewInt(62), big.NewInt(66))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("invalid number of keys, got %d, expected 4", len(keys))
+	}
+	for i, suffix := range []byte{126, 127, 64, 65} {
+		if keys[i][StemSize] != suffix {
+			t.Fatalf("invalid suffix for key #%d, got %d, expected %d", i, keys[i][StemSize], suffix)
+		}
+	}
+	if !bytes.Equal(keys[0][:StemSize], keys[1][:StemSize]) || !bytes.Equal(keys[2][:StemSize], keys[3][:StemSize]) {
+		t.Fatal("adjacent slots on the same side of the boundary have different stems")
+	}
+	if bytes.Equal(keys[1][:StemSize], keys[2][:StemSize]) {
+		t.Fatal("header and main storage slots share a stem")
+	}
+
+	// The header slots live in the stem of tree index 0, and the
+	// first main storage slots in that of tree index 256^30.
+	if !bytes.Equal(keys[0][:StemSize], treeKeyStem(append(make([]byte, 12), address...), big.NewInt(0))) {
+		t.Fatal("header storage slot isn't in the account header stem")
+	}
+	if !bytes.Equal(keys[2][:StemSize], treeKeyStem(append(make([]byte, 12), address...), new(big.Int).Lsh(big.NewInt(1), 8*30))) {
+		t.Fatal("main storage slot isn't in the expected stem")
+	}
+
+	// Main storage slots 255 and 256 fall in different stems, 256
+	// and 257 in the same one.
+	keys, err = StorageKeyRange(address, big.NewInt(255), big.NewInt(258))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(keys[0][:StemSize], keys[1][:StemSize]) || !bytes.Equal(keys[1][:StemSize], keys[2][:StemSize]) {
+		t.Fatal("invalid stems around a main storage stem boundary")
+	}
+
+	// A 32-byte address gives the same keys as its 20-byte version.
+	keys32, err := StorageKeyRange(append(make([]byte, 12), address...), big.NewInt(255), big.NewInt(258))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if !bytes.Equal(keys[i], keys32[i]) {
+			t.Fatalf("key #%d differs with a 32-byte address: %x != %x", i, keys32[i], keys[i])
+		}
+	}
+
+	if _, err := StorageKeyRange(address, big.NewInt(2), big.NewInt(1)); err == nil {
+		t.Fatal("expected an error with an empty range")
+	}
+	if _, err := StorageKeyRange(address[:19], big.NewInt(0), big.NewInt(1)); err == nil {
+		t.Fatal("expected an error with an invalid address")
+	}
+}
+
+func TestTreeKeyStemPedersenHash(t *testing.T) {
+	t.Parallel()
+
+	// Compute the stem following the EIP-6800 definition of the
+	// pedersen hash: the input is split into 16-byte little-endian
+	// integers, prefixed with 2 + 256 * len(input).
+	address := bytes.Repeat([]byte{0x12}, 32)
+	treeIndex := big.NewInt(0x3456)
+	input := make([]byte, 64)
+	copy(input, address)
+	index := treeIndex.FillBytes(make([]byte, 32))
+	for i := range index {
+		input[32+i] = index[len(index)-1-i]
+	}
+	ints := make([]Fr, NodeWidth)
+	ints[0].SetUint64(2 + 256*uint64(len(input)))
+	for i := 0; i < len(input)/16; i++ {
+		if err := FromLEBytes(&ints[i+1], input[16*i:16*(i+1)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm, err := CommitToPolynomial(ints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HashPointToBytes(comm)
+
+	if stem := treeKeyStem(address, treeIndex); !bytes.Equal(stem, expected[:StemSize]) {
+		t.Fatalf("invalid stem, got %x, expected %x", stem, expected[:StemSize])
+	}
+}
+
+func TestAccountProofKeys(t *testing.T) {
+	t.Parallel()
+
+	addrA, addrB := bytes.Repeat([]byte{0xaa}, 20), bytes.Repeat([]byte{0xbb}, 20)
+	keys := AccountProofKeys([][]byte{addrB, addrA, addrB})
+	if len(keys) != 4 {
+		t.Fatalf("invalid number of keys, got %d, expected 4", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("keys aren't sorted: %x >= %x", keys[i-1], keys[i])
+		}
+	}
+
+	keys = AccountProofKeys([][]byte{addrA})
+	stem := treeKeyStem(append(make([]byte, 12), addrA...), big.NewInt(0))
+	for i, suffix := range []byte{basicDataLeafKey, codeHashLeafKey} {
+		if !bytes.Equal(keys[i][:StemSize], stem) {
+			t.Fatalf("key #%d isn't in the account header stem", i)
+		}
+		if keys[i][StemSize] != suffix {
+			t.Fatalf("invalid suffix for key #%d, got %d, expected %d", i, keys[i][StemSize], suffix)
+		}
+	}
+
+	// The proof covers the basic data and the code hash of an account.
+	basicData, err := EncodeBasicData(0, 42, 7, big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := New()
+	basicDataKey, _ := JoinKey(stem, 0)
+	codeHashKey, _ := JoinKey(stem, 1)
+	for _, kv := range []KeyValue{{basicDataKey, basicData}, {codeHashKey, EmptyCodeHash}} {
+		if err := root.Insert(kv.Key, kv.Value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(proof.PreValues[0], basicData) || !bytes.Equal(proof.PreValues[1], EmptyCodeHash) {
+		t.Fatalf("proof doesn't cover the account, got values %x", proof.PreValues)
+	}
+}
+
+func TestBasicDataCodec(t *testing.T) {
+	t.Parallel()
+
+	maxBalance := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+	for _, tc := range []struct {
+		version  byte
+		codeSize uint32
+		nonce    uint64
+		balance  *big.Int
+		encoded  string
+	}{
+		{0, 0, 0, big.NewInt(0), "0000000000000000000000000000000000000000000000000000000000000000"},
+		{1, 0x123456, 0x0102030405060708, big.NewInt(0xabcd), "01000000001234560102030405060708" + "0000000000000000000000000000abcd"},
+		{0xff, 1<<24 - 1, ^uint64(0), maxBalance, "ff00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffff"},
+	} {
+		data, err := EncodeBasicData(tc.version, tc.codeSize, tc.nonce, tc.balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(data) != tc.encoded {
+			t.Fatalf("invalid encoding, got %x, expected %s", data, tc.encoded)
+		}
+		version, codeSize, nonce, balance, err := DecodeBasicData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != tc.version || codeSize != tc.codeSize || nonce != tc.nonce || balance.Cmp(tc.balance) != 0 {
+			t.Fatalf("invalid decoding of %x: %d %d %d %d", data, version, codeSize, nonce, balance)
+		}
+	}
+
+	if _, err := EncodeBasicData(0, 1<<24, 0, big.NewInt(0)); err == nil {
+		t.Fatal("expected an error for a code size that doesn't fit in 3 bytes")
+	}
+	if _, err := EncodeBasicData(0, 0, 0, new(big.Int).Add(maxBalance, big.NewInt(1))); err == nil {
+		t.Fatal("expected an error for a balance that doesn't fit in 16 bytes")
+	}
+	if _, err := EncodeBasicData(0, 0, 0, big.NewInt(-1)); err == nil {
+		t.Fatal("expected an error for a negative balance")
+	}
+	if _, _, _, _, err := DecodeBasicData(make([]byte, 31)); err == nil {
+		t.Fatal("expected an error for a 31-byte basic data")
+	}
+}
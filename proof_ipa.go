@@ -27,17 +27,25 @@ package verkle
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"runtime"
 	"sort"
 	"unsafe"
 
 	ipa "github.com/crate-crypto/go-ipa"
+	"github.com/crate-crypto/go-ipa/banderwagon"
 	"github.com/crate-crypto/go-ipa/common"
+	"golang.org/x/sync/errgroup"
 )
 
 const IPA_PROOF_DEPTH = 8
 
+// defaultTranscriptLabel is the label of the transcript of the proofs found
+// in blocks.
+const defaultTranscriptLabel = "vt"
+
 type IPAProof struct {
 	CL              [IPA_PROOF_DEPTH][32]byte `json:"cl"`
 	CR              [IPA_PROOF_DEPTH][32]byte `json:"cr"`
@@ -105,6 +113,124 @@ func (vp *VerkleProof) Equal(other *VerkleProof) error {
 	return nil
 }
 
+// CanonicalBytes returns a deterministic encoding of the proof, that is
+// suitable for hashing. The fields are encoded in their declaration order,
+// and variable-length fields are prefixed with their big-endian uint32
+// element count:
+// * len(OtherStems) || OtherStems
+// * len(DepthExtensionPresent) || DepthExtensionPresent
+// * len(CommitmentsByPath) || CommitmentsByPath
+// * D || CL || CR || FinalEvaluation
+func (vp *VerkleProof) CanonicalBytes() []byte {
+	size := 3*4 + len(vp.OtherStems)*StemSize + len(vp.DepthExtensionPresent) + len(vp.CommitmentsByPath)*32 + 32 + (2*IPA_PROOF_DEPTH+1)*32
+	ret := make([]byte, 0, size)
+
+	ret = binary.BigEndian.AppendUint32(ret, uint32(len(vp.OtherStems)))
+	for _, stem := range vp.OtherStems {
+		ret = append(ret, stem[:]...)
+	}
+	ret = binary.BigEndian.AppendUint32(ret, uint32(len(vp.DepthExtensionPresent)))
+	ret = append(ret, vp.DepthExtensionPresent...)
+	ret = binary.BigEndian.AppendUint32(ret, uint32(len(vp.CommitmentsByPath)))
+	for _, c := range vp.CommitmentsByPath {
+		ret = append(ret, c[:]...)
+	}
+	ret = append(ret, vp.D[:]...)
+
+	var ipaProof IPAProof
+	if vp.IPAProof != nil {
+		ipaProof = *vp.IPAProof
+	}
+	for _, cl := range ipaProof.CL {
+		ret = append(ret, cl[:]...)
+	}
+	for _, cr := range ipaProof.CR {
+		ret = append(ret, cr[:]...)
+	}
+	return append(ret, ipaProof.FinalEvaluation[:]...)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, using the same encoding
+// as CanonicalBytes.
+func (vp *VerkleProof) MarshalBinary() ([]byte, error) {
+	return vp.CanonicalBytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It decodes a proof
+// encoded by MarshalBinary, and returns an error if the input is truncated or
+// has trailing bytes.
+func (vp *VerkleProof) UnmarshalBinary(data []byte) error {
+	r := proofReader{data: data}
+
+	count, err := r.count("other stems", StemSize)
+	if err != nil {
+		return err
+	}
+	otherStems := make([][StemSize]byte, count)
+	for i := range otherStems {
+		copy(otherStems[i][:], r.next(StemSize))
+	}
+
+	count, err = r.count("depth extension present", 1)
+	if err != nil {
+		return err
+	}
+	depthExtensionPresent := append([]byte{}, r.next(count)...)
+
+	count, err = r.count("commitments by path", 32)
+	if err != nil {
+		return err
+	}
+	commitmentsByPath := make([][32]byte, count)
+	for i := range commitmentsByPath {
+		copy(commitmentsByPath[i][:], r.next(32))
+	}
+
+	if len(r.data) != (2*IPA_PROOF_DEPTH+2)*32 {
+		return fmt.Errorf("invalid proof encoding: %d bytes left for D and the IPA proof, expected %d", len(r.data), (2*IPA_PROOF_DEPTH+2)*32)
+	}
+	var ipaProof IPAProof
+	copy(vp.D[:], r.next(32))
+	for i := range ipaProof.CL {
+		copy(ipaProof.CL[i][:], r.next(32))
+	}
+	for i := range ipaProof.CR {
+		copy(ipaProof.CR[i][:], r.next(32))
+	}
+	copy(ipaProof.FinalEvaluation[:], r.next(32))
+
+	vp.OtherStems = otherStems
+	vp.DepthExtensionPresent = depthExtensionPresent
+	vp.CommitmentsByPath = commitmentsByPath
+	vp.IPAProof = &ipaProof
+	return nil
+}
+
+// proofReader consumes the encoding of a VerkleProof.
+type proofReader struct {
+	data []byte
+}
+
+// count reads the element count of a variable-length field, and checks that
+// enough bytes are left for its elements of the given size.
+func (r *proofReader) count(field string, size int) (int, error) {
+	if len(r.data) < 4 {
+		return 0, fmt.Errorf("invalid proof encoding: missing the length of %s", field)
+	}
+	count := binary.BigEndian.Uint32(r.next(4))
+	if uint64(count)*uint64(size) > uint64(len(r.data)) {
+		return 0, fmt.Errorf("invalid proof encoding: %d %s don't fit in the %d bytes left", count, field, len(r.data))
+	}
+	return int(count), nil
+}
+
+// next consumes the next n bytes, which the caller has checked are present.
+func (r *proofReader) next(n int) []byte {
+	ret := r.data[:n]
+	r.data = r.data[n:]
+	return ret
+}
+
 type Proof struct {
 	Multipoint *ipa.MultiProof // multipoint argument
 	ExtStatus  []byte          // the extension status of each stem
@@ -113,8 +239,51 @@ type Proof struct {
 	Keys       [][]byte
 	PreValues  [][]byte
 	PostValues [][]byte
+
+	naiveCs int // number of commitments of the separate proofs of each key
+}
+
+// DeduplicationSavings returns the number of commitment bytes saved by
+// proving all the keys together, compared to proving each one of them
+// separately. It is only known for proofs made by MakeVerkleMultiProof,
+// and is 0 for deserialized proofs.
+func (p *Proof) DeduplicationSavings() int {
+	if p.naiveCs == 0 {
+		return 0
+	}
+	return (p.naiveCs - len(p.Cs)) * banderwagon.CompressedSize
+}
+
+// EstimatedSerializedSize returns the number of bytes taken by the fields
+// of the VerkleProof and StateDiff that SerializeProof would return, without
+// serializing the proof. The element counts that prefix the variable-length
+// fields in a wire encoding aren't included.
+func (p *Proof) EstimatedSerializedSize() int {
+	size := len(p.PoaStems)*StemSize + len(p.ExtStatus) + len(p.Cs)*banderwagon.CompressedSize
+	size += 32 + (2*IPA_PROOF_DEPTH+1)*32 // D and the IPA proof
+
+	var stem []byte
+	for i, key := range p.Keys {
+		if !bytes.Equal(stem, KeyToStem(key)) {
+			stem = KeyToStem(key)
+			size += StemSize
+		}
+		size++ // suffix
+		if len(p.PreValues[i]) > 0 {
+			size += LeafValueSize
+		}
+		if i < len(p.PostValues) && len(p.PostValues[i]) > 0 {
+			size += LeafValueSize
+		}
+	}
+	return size
 }
 
+// SuffixStateDiff is the state of a suffix before and after a block. A nil
+// NewValue means that the suffix was left untouched, while a suffix that was
+// cleared has a NewValue made of zeros. The latter is written to the tree
+// like any other value, so the post-state leaf keeps its leaf marker at that
+// suffix.
 type SuffixStateDiff struct {
 	Suffix       byte      `json:"suffix"`
 	CurrentValue *[32]byte `json:"currentValue"`
@@ -123,6 +292,10 @@ type SuffixStateDiff struct {
 
 type SuffixStateDiffs []SuffixStateDiff
 
+// StemStateDiff holds the diffs of the suffixes of a stem that are part of a
+// proof. Whether a suffix was only read, inserted, updated, or is absent and
+// left untouched follows from which of its values are set, see
+// SuffixStateDiff.
 type StemStateDiff struct {
 	Stem        [StemSize]byte   `json:"stem"`
 	SuffixDiffs SuffixStateDiffs `json:"suffixDiffs"`
@@ -184,6 +357,25 @@ func (sd StateDiff) Equal(other StateDiff) error {
 	return nil
 }
 
+// Stems returns the stems referenced in the state diff, in order.
+func (sd StateDiff) Stems() [][]byte {
+	stems := make([][]byte, len(sd))
+	for i := range sd {
+		stems[i] = make([]byte, StemSize)
+		copy(stems[i], sd[i].Stem[:])
+	}
+	return stems
+}
+
+// SuffixCount returns the total number of suffix entries in the state diff.
+func (sd StateDiff) SuffixCount() int {
+	var count int
+	for i := range sd {
+		count += len(sd[i].SuffixDiffs)
+	}
+	return count
+}
+
 func GetCommitmentsForMultiproof(root VerkleNode, keys [][]byte, resolver NodeResolverFn) (*ProofElements, []byte, []Stem, error) {
 	sort.Sort(keylist(keys))
 	return root.GetProofItems(keylist(keys), resolver)
@@ -196,10 +388,17 @@ func getProofElementsFromTree(preroot, postroot VerkleNode, keys [][]byte, resol
 	// go-ipa won't accept no key as an input, catch this corner case
 	// and return an empty result.
 	if len(keys) == 0 {
-		return nil, nil, nil, nil, errors.New("no key provided for proof")
+		return nil, nil, nil, nil, errNoKeys
 	}
 
-	pe, es, poas, err := GetCommitmentsForMultiproof(preroot, keys, resolver)
+	sort.Sort(keylist(keys))
+	return getProofElementsFromSortedKeys(preroot, postroot, keys, resolver)
+}
+
+// getProofElementsFromSortedKeys is getProofElementsFromTree, for a list of
+// keys that is already sorted.
+func getProofElementsFromSortedKeys(preroot, postroot VerkleNode, keys [][]byte, resolver NodeResolverFn) (*ProofElements, []byte, []Stem, [][]byte, error) {
+	pe, es, poas, err := preroot.GetProofItems(keylist(keys), resolver)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("error getting pre-state proof data: %w", err)
 	}
@@ -208,13 +407,18 @@ func getProofElementsFromTree(preroot, postroot VerkleNode, keys [][]byte, resol
 	// those of the pre-state tree, so that they can be proved together.
 	postvals := make([][]byte, len(keys))
 	if postroot != nil {
-		// keys were sorted already in the above GetcommitmentsForMultiproof.
 		// Set the post values, if they are untouched, leave them `nil`
 		for i := range keys {
 			val, err := postroot.Get(keys[i], resolver)
 			if err != nil {
 				return nil, nil, nil, nil, fmt.Errorf("error getting post-state value for key %x: %w", keys[i], err)
 			}
+			// A state diff can't tell a value that was removed
+			// from one that was left untouched: both have a nil
+			// new value. Slots are cleared by writing zeros.
+			if pe.Vals[i] != nil && val == nil {
+				return nil, nil, nil, nil, fmt.Errorf("value at key %x was deleted from the post-state tree, which a state diff can't represent: write a zero value instead", keys[i])
+			}
 			if !bytes.Equal(pe.Vals[i], val) {
 				postvals[i] = val
 			}
@@ -227,63 +431,560 @@ func getProofElementsFromTree(preroot, postroot VerkleNode, keys [][]byte, resol
 }
 
 func MakeVerkleMultiProof(preroot, postroot VerkleNode, keys [][]byte, resolver NodeResolverFn) (*Proof, []*Point, []byte, []*Fr, error) {
-	pe, es, poas, postvals, err := getProofElementsFromTree(preroot, postroot, keys, resolver)
+	return MakeVerkleMultiProofWithLabel(preroot, postroot, keys, resolver, defaultTranscriptLabel)
+}
+
+// MakeVerkleMultiProofWithLabel is MakeVerkleMultiProof with a custom label
+// for the transcript of the multiproof. Protocols that embed verkle proofs
+// can use it for domain separation: the proof only verifies with the same
+// label, see VerifyWithLabel.
+func MakeVerkleMultiProofWithLabel(preroot, postroot VerkleNode, keys [][]byte, resolver NodeResolverFn, label string) (*Proof, []*Point, []byte, []*Fr, error) {
+	if len(keys) == 0 {
+		return nil, nil, nil, nil, errNoKeys
+	}
+
+	sort.Sort(keylist(keys))
+	return makeVerkleMultiProof(preroot, postroot, keys, resolver, label)
+}
+
+// MakeVerkleMultiProofPresorted is MakeVerkleMultiProof for a list of keys
+// that is already sorted and deduplicated, which saves sorting large lists.
+// The order of the keys is checked, which only costs a pass over the list.
+func MakeVerkleMultiProofPresorted(preroot, postroot VerkleNode, sortedKeys [][]byte, resolver NodeResolverFn) (*Proof, []*Point, []byte, []*Fr, error) {
+	if len(sortedKeys) == 0 {
+		return nil, nil, nil, nil, errNoKeys
+	}
+	for i := 1; i < len(sortedKeys); i++ {
+		if bytes.Compare(sortedKeys[i-1], sortedKeys[i]) >= 0 {
+			return nil, nil, nil, nil, fmt.Errorf("keys are not sorted and deduplicated: %x >= %x", sortedKeys[i-1], sortedKeys[i])
+		}
+	}
+
+	return makeVerkleMultiProof(preroot, postroot, sortedKeys, resolver, defaultTranscriptLabel)
+}
+
+// MakeSuffixRangeProof proves the values of all the suffixes in the
+// inclusive range [startSuffix, endSuffix] of a stem, in a single
+// multiproof. Suffixes that have no value are proven absent.
+func MakeSuffixRangeProof(root VerkleNode, stem []byte, startSuffix, endSuffix byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	if startSuffix > endSuffix {
+		return nil, fmt.Errorf("invalid suffix range [%d, %d]", startSuffix, endSuffix)
+	}
+
+	keys := make([][]byte, 0, int(endSuffix)-int(startSuffix)+1)
+	for suffix := int(startSuffix); suffix <= int(endSuffix); suffix++ {
+		key := make([]byte, KeySize)
+		copy(key, stem)
+		key[StemSize] = byte(suffix)
+		keys = append(keys, key)
+	}
+
+	proof, _, _, _, err := makeVerkleMultiProof(root, nil, keys, resolver, defaultTranscriptLabel)
+	if err != nil {
+		return nil, fmt.Errorf("proving suffix range [%d, %d] of stem %x: %w", startSuffix, endSuffix, stem, err)
+	}
+	return proof, nil
+}
+
+// MakeEmptyLeafProof proves that the leaf of a stem is present in the tree,
+// but holds no value. The first suffix of each half of the leaf is proven
+// absent, which includes both C1 and C2 in the proof: a verifier can check
+// that they are the identity. Note that deleting the last value of a leaf
+// removes the leaf from the tree, so an empty leaf can only be the result
+// of inserting no value at its stem.
+func MakeEmptyLeafProof(root VerkleNode, stem []byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	rootNode, ok := root.(*InternalNode)
+	if !ok {
+		return nil, fmt.Errorf("root is not an internal node: %T", root)
+	}
+	values, err := rootNode.GetValuesAtStem(stem, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("getting values at stem %x: %w", stem, err)
+	}
+	if values == nil {
+		return nil, fmt.Errorf("no leaf at stem %x", stem)
+	}
+	for suffix, value := range values {
+		if value != nil {
+			return nil, fmt.Errorf("leaf at stem %x has a value at suffix %d", stem, suffix)
+		}
+	}
+
+	keys := make([][]byte, 2)
+	for i, suffix := range []byte{0, 128} {
+		keys[i] = make([]byte, KeySize)
+		copy(keys[i], stem)
+		keys[i][StemSize] = suffix
+	}
+	proof, _, _, _, err := makeVerkleMultiProof(root, nil, keys, resolver, defaultTranscriptLabel)
+	if err != nil {
+		return nil, fmt.Errorf("proving empty leaf at stem %x: %w", stem, err)
+	}
+	return proof, nil
+}
+
+// ProveAbsent proves that none of the keys holds a value, and returns an
+// error if one of them does. The suffix-level polynomials are only built for
+// the stems that are present in the tree, so proving the absence of keys
+// whose stem is missing only involves the internal nodes and the extension
+// level of the leaves found along the way.
+func ProveAbsent(root VerkleNode, keys [][]byte, resolver NodeResolverFn) (*Proof, error) {
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, resolver)
+	if err != nil {
+		return nil, err
+	}
+	// The values are collected while building the proof, so
+	// there's no need to walk the tree a second time.
+	for i, value := range proof.PreValues {
+		if value != nil {
+			return nil, fmt.Errorf("key %x isn't absent", proof.Keys[i])
+		}
+	}
+	return proof, nil
+}
+
+// GetWithProof returns the value stored at key, along with a serialized
+// proof of that value, or of its absence. The tree is committed first.
+func GetWithProof(root VerkleNode, key []byte, resolver NodeResolverFn) ([]byte, *VerkleProof, StateDiff, error) {
+	if len(key) != KeySize {
+		return nil, nil, nil, fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	root.Commit()
+
+	value, err := root.Get(key, resolver)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("getting value at key %x: %w", key, err)
+	}
+	proof, _, _, _, err := makeVerkleMultiProof(root, nil, [][]byte{key}, resolver, defaultTranscriptLabel)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("proving key %x: %w", key, err)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("serializing proof of key %x: %w", key, err)
+	}
+	return value, vp, statediff, nil
+}
+
+func makeVerkleMultiProof(preroot, postroot VerkleNode, keys [][]byte, resolver NodeResolverFn, label string) (*Proof, []*Point, []byte, []*Fr, error) {
+	pe, es, poas, postvals, err := getProofElementsFromSortedKeys(preroot, postroot, keys, resolver)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("get commitments for multiproof: %s", err)
 	}
 
 	cfg := GetConfig()
-	tr := common.NewTranscript("vt")
+	tr := common.NewTranscript(label)
 	mpArg, err := ipa.CreateMultiProof(tr, cfg.conf, pe.Cis, pe.Fis, pe.Zis)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("creating multiproof: %w", err)
 	}
 
+	proof := &Proof{
+		Multipoint: mpArg,
+		Cs:         sortedCommitmentsByPath(pe.ByPath),
+		ExtStatus:  es,
+		PoaStems:   poas,
+		Keys:       keys,
+		PreValues:  pe.Vals,
+		PostValues: postvals,
+		naiveCs:    pe.naiveCs,
+	}
+	return proof, pe.Cis, pe.Zis, pe.Yis, nil
+}
+
+// sortedCommitmentsByPath returns the commitments of a path-to-commitment
+// map, sorted by their path. The root commitment is left out.
+func sortedCommitmentsByPath(byPath map[string]*Point) []*Point {
 	// It's wheel-reinvention time again 🎉: reimplement a basic
 	// feature that should be part of the stdlib.
 	// "But golang is a high-productivity language!!!" 🤪
 	// len()-1, because the root is already present in the
 	// parent block, so we don't keep it in the proof.
-	paths := make([]string, 0, len(pe.ByPath)-1)
-	for path := range pe.ByPath {
+	paths := make([]string, 0, len(byPath)-1)
+	for path := range byPath {
 		if len(path) > 0 {
 			paths = append(paths, path)
 		}
 	}
 	sort.Strings(paths)
-	cis := make([]*Point, len(pe.ByPath)-1)
+	cis := make([]*Point, len(paths))
 	for i, path := range paths {
-		cis[i] = pe.ByPath[path]
+		cis[i] = byPath[path]
 	}
+	return cis
+}
 
-	proof := &Proof{
+// MakeStemCommitmentProof proves that a leaf node with the given stem is
+// present in the tree, as well as the value of its C1 and C2 commitments.
+// Only the internal nodes along the path and the extension-level elements
+// of the leaf (i.e. the leaf marker, the stem, C1 and C2) are opened, so
+// that no value is revealed. The returned proof has no key, and must be
+// verified with VerifyStemCommitmentProof.
+func MakeStemCommitmentProof(root VerkleNode, stem []byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem size %d", len(stem))
+	}
+	pe, node, err := getPathProofItems(root, stem, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("error getting path proof data: %w", err)
+	}
+	leaf, ok := node.(*LeafNode)
+	if !ok || leaf.isPOAStub || !equalPaths(leaf.stem, stem) {
+		return nil, fmt.Errorf("stem %x is not present in the tree", stem)
+	}
+	depth := byte(len(pe.Cis))
+
+	// A nil C1 or C2 is left by deletions that empty half of the leaf,
+	// and stands for the identity.
+	c1, c2 := new(Point).SetIdentity(), new(Point).SetIdentity()
+	if leaf.c1 != nil {
+		c1.Set(leaf.c1)
+	}
+	if leaf.c2 != nil {
+		c2.Set(leaf.c2)
+	}
+
+	var poly [NodeWidth]Fr
+	poly[0].SetUint64(1)
+	if err := StemFromLEBytes(&poly[1], leaf.stem); err != nil {
+		return nil, fmt.Errorf("error serializing stem '%x': %w", leaf.stem, err)
+	}
+	if err := banderwagon.BatchMapToScalarField([]*Fr{&poly[2], &poly[3]}, []*Point{c1, c2}); err != nil {
+		return nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+	}
+	for z := byte(0); z < 4; z++ {
+		pe.Cis = append(pe.Cis, leaf.commitment)
+		pe.Zis = append(pe.Zis, z)
+		pe.Yis = append(pe.Yis, &poly[z])
+		pe.Fis = append(pe.Fis, poly[:])
+	}
+	pe.ByPath[string(stem[:depth])] = leaf.commitment
+	pe.ByPath[string(stem[:depth])+string([]byte{2})] = c1
+	pe.ByPath[string(stem[:depth])+string([]byte{3})] = c2
+
+	tr := common.NewTranscript(defaultTranscriptLabel)
+	mpArg, err := ipa.CreateMultiProof(tr, GetConfig().conf, pe.Cis, pe.Fis, pe.Zis)
+	if err != nil {
+		return nil, fmt.Errorf("creating multiproof: %w", err)
+	}
+
+	return &Proof{
 		Multipoint: mpArg,
-		Cs:         cis,
-		ExtStatus:  es,
-		PoaStems:   poas,
-		Keys:       keys,
-		PreValues:  pe.Vals,
-		PostValues: postvals,
+		ExtStatus:  []byte{extStatusPresent | (depth << 3)},
+		Cs:         sortedCommitmentsByPath(pe.ByPath),
+	}, nil
+}
+
+// VerifyStemCommitmentProof verifies a proof produced by MakeStemCommitmentProof,
+// against the root commitment rootC. Upon success, the last two commitments
+// of the proof are the C1 and C2 commitments of the leaf.
+func VerifyStemCommitmentProof(proof *Proof, rootC *Point, stem []byte) error {
+	if len(stem) != StemSize {
+		return fmt.Errorf("invalid stem size %d", len(stem))
 	}
-	return proof, pe.Cis, pe.Zis, pe.Yis, nil
+	if len(proof.ExtStatus) != 1 || proof.ExtStatus[0]&3 != extStatusPresent {
+		return errors.New("proof doesn't prove the presence of a single stem")
+	}
+	depth := int(proof.ExtStatus[0] >> 3)
+	if depth == 0 || depth > StemSize {
+		return fmt.Errorf("invalid stem depth %d", depth)
+	}
+	// One commitment per internal node, except the root, then
+	// the leaf node, C1 and C2.
+	if len(proof.Cs) != depth+2 {
+		return fmt.Errorf("invalid number of commitments %d, expected %d", len(proof.Cs), depth+2)
+	}
+
+	var (
+		cis  = make([]*Point, 0, depth+4)
+		zis  = make([]byte, 0, depth+4)
+		yis  = make([]*Fr, 0, depth+4)
+		leaf = proof.Cs[depth-1]
+	)
+	for i := 0; i < depth; i++ {
+		c := rootC
+		if i > 0 {
+			c = proof.Cs[i-1]
+		}
+		var yi Fr
+		proof.Cs[i].MapToScalarField(&yi)
+		cis = append(cis, c)
+		zis = append(zis, stem[i])
+		yis = append(yis, &yi)
+	}
+	var ext [4]Fr
+	ext[0].SetOne()
+	if err := StemFromLEBytes(&ext[1], stem); err != nil {
+		return err
+	}
+	proof.Cs[depth].MapToScalarField(&ext[2])
+	proof.Cs[depth+1].MapToScalarField(&ext[3])
+	for z := byte(0); z < 4; z++ {
+		cis = append(cis, leaf)
+		zis = append(zis, z)
+		yis = append(yis, &ext[z])
+	}
+
+	if ok, err := verifyVerkleProof(proof, cis, zis, yis, GetConfig()); !ok || err != nil {
+		return fmt.Errorf("error verifying proof: verifies=%v, error=%w", ok, err)
+	}
+	return nil
+}
+
+// MakeSubtreeProof proves the commitment of the node found at path, by
+// opening each internal node along the path at the index of the next node,
+// down to the parent of the proven node. Nothing below that node is opened.
+// The proven node can be an internal node, a leaf node, or an empty node,
+// whose commitment is the identity. The returned proof has no key, and its
+// last commitment is the one of the proven node. It must be verified with
+// VerifySubtreeProof.
+func MakeSubtreeProof(root VerkleNode, path []byte, resolver NodeResolverFn) (*Proof, error) {
+	if len(path) == 0 || len(path) > StemSize {
+		return nil, fmt.Errorf("invalid path length %d", len(path))
+	}
+	pe, node, err := getPathProofItems(root, path, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("error getting path proof data: %w", err)
+	}
+	if len(pe.Cis) != len(path) {
+		return nil, fmt.Errorf("no internal node at path %x", path[:len(pe.Cis)])
+	}
+
+	var comm *Point
+	switch node := node.(type) {
+	case *InternalNode:
+		if comm, err = node.TryCommitment(); err != nil {
+			return nil, fmt.Errorf("node at path %x: %w", path, err)
+		}
+	case *LeafNode:
+		if comm, err = node.TryCommitment(); err != nil {
+			return nil, fmt.Errorf("node at path %x: %w", path, err)
+		}
+	case Empty:
+		comm = node.Commitment()
+	default:
+		return nil, fmt.Errorf("can't prove a node of type %T at path %x", node, path)
+	}
+	pe.ByPath[string(path)] = comm
+
+	tr := common.NewTranscript(defaultTranscriptLabel)
+	mpArg, err := ipa.CreateMultiProof(tr, GetConfig().conf, pe.Cis, pe.Fis, pe.Zis)
+	if err != nil {
+		return nil, fmt.Errorf("creating multiproof: %w", err)
+	}
+
+	return &Proof{
+		Multipoint: mpArg,
+		Cs:         sortedCommitmentsByPath(pe.ByPath),
+	}, nil
+}
+
+// VerifySubtreeProof verifies a proof produced by MakeSubtreeProof against
+// the root commitment rootC. Upon success, the last commitment of the proof
+// is the one of the node at path.
+func VerifySubtreeProof(proof *Proof, rootC *Point, path []byte) error {
+	if len(path) == 0 || len(path) > StemSize {
+		return fmt.Errorf("invalid path length %d", len(path))
+	}
+	// One commitment per internal node, except the root, then
+	// the proven node.
+	if len(proof.Cs) != len(path) {
+		return fmt.Errorf("invalid number of commitments %d, expected %d", len(proof.Cs), len(path))
+	}
+
+	var (
+		cis = make([]*Point, len(path))
+		yis = make([]*Fr, len(path))
+	)
+	for i := range path {
+		cis[i] = rootC
+		if i > 0 {
+			cis[i] = proof.Cs[i-1]
+		}
+		var yi Fr
+		proof.Cs[i].MapToScalarField(&yi)
+		yis[i] = &yi
+	}
+
+	if ok, err := verifyVerkleProof(proof, cis, path, yis, GetConfig()); !ok || err != nil {
+		return fmt.Errorf("error verifying proof: verifies=%v, error=%w", ok, err)
+	}
+	return nil
+}
+
+// MarginalProofSize returns how many more bytes the serialized proof
+// and state diff for baseKeys would take if extraKey was added to it.
+// The multipoint argument has a constant size, so it is left out of
+// the computation and no proof is actually created. It returns 0 if
+// extraKey is already part of baseKeys.
+func MarginalProofSize(root VerkleNode, baseKeys [][]byte, extraKey []byte, resolver NodeResolverFn) (int, error) {
+	for _, key := range baseKeys {
+		if bytes.Equal(key, extraKey) {
+			return 0, nil
+		}
+	}
+
+	baseSize, err := witnessSize(root, baseKeys, resolver)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([][]byte, len(baseKeys), len(baseKeys)+1)
+	copy(keys, baseKeys)
+	extendedSize, err := witnessSize(root, append(keys, extraKey), resolver)
+	if err != nil {
+		return 0, err
+	}
+	return extendedSize - baseSize, nil
+}
+
+// witnessSize computes the size of the serialized proof of absence
+// stems, extension statuses, commitments and state diff for a set of
+// keys, i.e. everything but the multipoint argument.
+func witnessSize(root VerkleNode, keys [][]byte, resolver NodeResolverFn) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// GetCommitmentsForMultiproof sorts the keys in place, work
+	// on a copy so that the caller's list is left untouched.
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	pe, es, poas, err := GetCommitmentsForMultiproof(root, sorted, resolver)
+	if err != nil {
+		return 0, fmt.Errorf("error getting proof data: %w", err)
+	}
+
+	// The root commitment isn't part of the proof.
+	size := len(poas)*StemSize + len(es) + (len(pe.ByPath)-1)*32
+	var stem Stem
+	for i, key := range sorted {
+		if !bytes.Equal(stem, KeyToStem(key)) {
+			stem = KeyToStem(key)
+			size += StemSize
+		}
+		size++ // suffix
+		if pe.Vals[i] != nil {
+			size += LeafValueSize
+		}
+	}
+	return size, nil
+}
+
+// ExpectedCommitmentCount returns the number of commitments that a proof
+// for the given keys should contain, i.e. the expected length of its
+// CommitmentsByPath. The root commitment isn't part of the proof, so it
+// isn't counted.
+func ExpectedCommitmentCount(root VerkleNode, keys [][]byte, resolver NodeResolverFn) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// GetCommitmentsForMultiproof sorts the keys in place, work
+	// on a copy so that the caller's list is left untouched.
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	pe, _, _, err := GetCommitmentsForMultiproof(root, sorted, resolver)
+	if err != nil {
+		return 0, fmt.Errorf("error getting proof data: %w", err)
+	}
+	return len(pe.ByPath) - 1, nil
 }
 
 // verifyVerkleProofWithPreState takes a proof and a trusted tree root and verifies that the proof is valid.
 func verifyVerkleProofWithPreState(proof *Proof, preroot VerkleNode) error {
+	return verifyVerkleProofWithPreStateAndLabel(proof, preroot, defaultTranscriptLabel)
+}
+
+func verifyVerkleProofWithPreStateAndLabel(proof *Proof, preroot VerkleNode, label string) error {
 	pe, _, _, _, err := getProofElementsFromTree(preroot, nil, proof.Keys, nil)
 	if err != nil {
 		return fmt.Errorf("error getting proof elements: %w", err)
 	}
 
+	if ok, err := verifyVerkleProofWithLabel(proof, pe.Cis, pe.Zis, pe.Yis, GetConfig(), label); !ok || err != nil {
+		return fmt.Errorf("error verifying proof: verifies=%v, error=%w", ok, err)
+	}
+
+	return nil
+}
+
+// VerifyVerkleProofWithValues verifies the proof against root, like
+// verifyVerkleProofWithPreState, and checks that it proves the values in
+// expected, indexed by key. A nil expected value means that the key must be
+// proven absent. Every key in expected must be covered by the proof, but the
+// keys of the proof that expected doesn't mention aren't checked.
+func VerifyVerkleProofWithValues(proof *Proof, root VerkleNode, expected map[string][]byte) error {
+	if len(proof.PreValues) != len(proof.Keys) {
+		return fmt.Errorf("proof has %d keys but %d values", len(proof.Keys), len(proof.PreValues))
+	}
+	pe, _, _, _, err := getProofElementsFromTree(root, nil, proof.Keys, nil)
+	if err != nil {
+		return fmt.Errorf("error getting proof elements: %w", err)
+	}
 	if ok, err := verifyVerkleProof(proof, pe.Cis, pe.Zis, pe.Yis, GetConfig()); !ok || err != nil {
 		return fmt.Errorf("error verifying proof: verifies=%v, error=%w", ok, err)
 	}
 
+	proven := make(map[string][]byte, len(proof.Keys))
+	for i, key := range proof.Keys {
+		// The proof is checked against the values of the tree, make
+		// sure that the ones it carries are the same.
+		if !bytes.Equal(proof.PreValues[i], pe.Vals[i]) || (proof.PreValues[i] == nil) != (pe.Vals[i] == nil) {
+			return fmt.Errorf("key %x: proof carries value %x, but proves %x: %w", key, proof.PreValues[i], pe.Vals[i], errUnexpectedProofValue)
+		}
+		proven[string(key)] = pe.Vals[i]
+	}
+	for key, value := range expected {
+		val, ok := proven[key]
+		if !ok {
+			return fmt.Errorf("key %x isn't covered by the proof", key)
+		}
+		if !bytes.Equal(val, value) || (val == nil) != (value == nil) {
+			return fmt.Errorf("key %x: expected value %x, got %x: %w", key, value, val, errUnexpectedProofValue)
+		}
+	}
 	return nil
 }
 
 func verifyVerkleProof(proof *Proof, Cs []*Point, indices []uint8, ys []*Fr, tc *Config) (bool, error) {
-	tr := common.NewTranscript("vt")
+	return verifyVerkleProofWithLabel(proof, Cs, indices, ys, tc, defaultTranscriptLabel)
+}
+
+// BatchVerifyVerkleProofs verifies several independent proofs concurrently.
+// The i-th proof is checked against css[i], indices[i] and ys[i], and the
+// i-th returned boolean tells whether it verifies. A proof that can't be
+// checked at all, e.g. because it is malformed, is reported as invalid. An
+// error is only returned if the input slices don't have the same length.
+func BatchVerifyVerkleProofs(proofs []*Proof, css [][]*Point, indices [][]uint8, ys [][]*Fr, tc *Config) ([]bool, error) {
+	if len(css) != len(proofs) || len(indices) != len(proofs) || len(ys) != len(proofs) {
+		return nil, fmt.Errorf("mismatched number of proofs (%d), commitments (%d), indices (%d) and evaluations (%d)", len(proofs), len(css), len(indices), len(ys))
+	}
+
+	results := make([]bool, len(proofs))
+	var group errgroup.Group
+	group.SetLimit(runtime.NumCPU())
+	for i := range proofs {
+		group.Go(func() error {
+			if proofs[i] == nil || proofs[i].Multipoint == nil {
+				return nil
+			}
+			ok, err := verifyVerkleProof(proofs[i], css[i], indices[i], ys[i], tc)
+			results[i] = ok && err == nil
+			return nil
+		})
+	}
+	_ = group.Wait() // the goroutines don't return errors
+	return results, nil
+}
+
+func verifyVerkleProofWithLabel(proof *Proof, Cs []*Point, indices []uint8, ys []*Fr, tc *Config, label string) (bool, error) {
+	tr := common.NewTranscript(label)
 	return ipa.CheckMultiProof(tr, tc.conf, proof.Multipoint, Cs, ys, indices)
 }
 
@@ -433,13 +1134,13 @@ func DeserializeProof(vp *VerkleProof, statediff StateDiff) (*Proof, error) {
 	}
 
 	proof := Proof{
-		&multipoint,
-		extStatus,
-		commitments,
-		poaStems,
-		keys,
-		prevalues,
-		postvalues,
+		Multipoint: &multipoint,
+		ExtStatus:  extStatus,
+		Cs:         commitments,
+		PoaStems:   poaStems,
+		Keys:       keys,
+		PreValues:  prevalues,
+		PostValues: postvalues,
 	}
 	return &proof, nil
 }
@@ -452,13 +1153,16 @@ type stemInfo struct {
 	stem           []byte
 }
 
-// PreStateTreeFromProof builds a stateless prestate tree from the proof.
-func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { // skipcq: GO-R1005
+// getStemInfos checks the consistency of the proof's keys, values and
+// extension statuses, and returns the information needed to rebuild
+// each stem, as well as the list of paths to rebuild in the order in
+// which they consume the proof's commitments.
+func getStemInfos(proof *Proof) (map[string]stemInfo, [][]byte, error) { // skipcq: GO-R1005
 	if len(proof.Keys) != len(proof.PreValues) {
-		return nil, fmt.Errorf("incompatible number of keys and pre-values: %d != %d", len(proof.Keys), len(proof.PreValues))
+		return nil, nil, fmt.Errorf("incompatible number of keys and pre-values: %d != %d", len(proof.Keys), len(proof.PreValues))
 	}
 	if len(proof.Keys) != len(proof.PostValues) {
-		return nil, fmt.Errorf("incompatible number of keys and post-values: %d != %d", len(proof.Keys), len(proof.PostValues))
+		return nil, nil, fmt.Errorf("incompatible number of keys and post-values: %d != %d", len(proof.Keys), len(proof.PostValues))
 	}
 	stems := make([][]byte, 0, len(proof.Keys))
 	for _, k := range proof.Keys {
@@ -468,18 +1172,17 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 		}
 	}
 	if len(stems) != len(proof.ExtStatus) {
-		return nil, fmt.Errorf("invalid number of stems and extension statuses: %d != %d", len(stems), len(proof.ExtStatus))
+		return nil, nil, fmt.Errorf("invalid number of stems and extension statuses: %d != %d", len(stems), len(proof.ExtStatus))
 	}
 	var (
 		info  = map[string]stemInfo{}
 		paths [][]byte
-		err   error
 		poas  = proof.PoaStems
 	)
 
 	// The proof of absence stems must be sorted. If that isn't the case, the proof is invalid.
 	if !sort.IsSorted(bytesSlice(proof.PoaStems)) {
-		return nil, fmt.Errorf("proof of absence stems are not sorted")
+		return nil, nil, fmt.Errorf("proof of absence stems are not sorted")
 	}
 
 	// We build a cache of paths that have a presence extension status.
@@ -505,7 +1208,7 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 			// prestate values. If that isn't the case, the proof is invalid.
 			for j := range proof.Keys { // TODO: DoS risk, use map or binary search.
 				if bytes.HasPrefix(proof.Keys[j], stems[i]) && proof.PreValues[j] != nil {
-					return nil, fmt.Errorf("proof of absence (empty) stem %x has a value", si.stem)
+					return nil, nil, fmt.Errorf("proof of absence (empty) stem %x has a value", si.stem)
 				}
 			}
 		case extStatusAbsentOther:
@@ -513,7 +1216,7 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 			// prestate values. If that isn't the case, the proof is invalid.
 			for j := range proof.Keys { // TODO: DoS risk, use map or binary search.
 				if bytes.HasPrefix(proof.Keys[j], stems[i]) && proof.PreValues[j] != nil {
-					return nil, fmt.Errorf("proof of absence (other) stem %x has a value", si.stem)
+					return nil, nil, fmt.Errorf("proof of absence (other) stem %x has a value", si.stem)
 				}
 			}
 
@@ -545,14 +1248,24 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 				}
 			}
 		default:
-			return nil, fmt.Errorf("invalid extension status: %d", si.stemType)
+			return nil, nil, fmt.Errorf("invalid extension status: %d", si.stemType)
 		}
 		info[string(path)] = si
 		paths = append(paths, path)
 	}
 
 	if len(poas) != 0 {
-		return nil, fmt.Errorf("not all proof of absence stems were used: %d", len(poas))
+		return nil, nil, fmt.Errorf("not all proof of absence stems were used: %d", len(poas))
+	}
+
+	return info, paths, nil
+}
+
+// PreStateTreeFromProof builds a stateless prestate tree from the proof.
+func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) {
+	info, paths, err := getStemInfos(proof)
+	if err != nil {
+		return nil, err
 	}
 
 	root := NewStatelessInternal(0, rootC).(*InternalNode)
@@ -583,18 +1296,278 @@ func PreStateTreeFromProof(proof *Proof, rootC *Point) (VerkleNode, error) { //
 	return root, nil
 }
 
+// PreStateTreeFromProofWithHash rebuilds the pre-state tree described by a
+// proof, when only the hash of the root commitment is known. Since several
+// points share the same hash, the tree is rebuilt from each of them, and
+// the one against which the proof verifies is returned. Note that, unlike
+// PreStateTreeFromProof, this verifies the proof.
+func PreStateTreeFromProofWithHash(proof *Proof, rootHash *Fr) (VerkleNode, error) {
+	for _, rootC := range PointsFromHash(rootHash) {
+		root, err := PreStateTreeFromProof(proof, rootC)
+		if err != nil {
+			return nil, err
+		}
+		if verifyVerkleProofWithPreState(proof, root) != nil {
+			continue
+		}
+		if !root.Hash().Equal(rootHash) {
+			return nil, fmt.Errorf("rebuilt root hash %x doesn't match %x", root.Hash().Bytes(), rootHash.Bytes())
+		}
+		return root, nil
+	}
+	return nil, fmt.Errorf("no root commitment with hash %x verifies the proof", rootHash.Bytes())
+}
+
+// StatefulTreeFromProof rebuilds the pre-state tree described by a proof,
+// like PreStateTreeFromProof, and returns its root as an *InternalNode so
+// that it can be further modified with the regular tree API. Stems that
+// are only proven absent are represented by proof-of-absence stubs, and
+// the parts of the tree not covered by the proof by UnknownNode, so any
+// write to those will fail.
+func StatefulTreeFromProof(proof *Proof, rootC *Point) (*InternalNode, error) {
+	root, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		return nil, err
+	}
+	return root.(*InternalNode), nil
+}
+
+// KeyStatus is what a proof tells about the presence of a stem.
+type KeyStatus byte
+
+const (
+	KeyStatusUnknown KeyStatus = iota // the proof doesn't cover the stem
+	KeyStatusPresent                  // the stem is in the tree
+	KeyStatusAbsent                   // the stem is not in the tree
+)
+
+// StemOracle returns a function telling if a stem is present in the tree
+// that the proof was made against. The proof must have been verified
+// beforehand. Each extension status of the proof describes the slot at the
+// end of a path: it is either empty, or holds the leaf of a single stem,
+// which is proven present. Any other stem going through that slot is thus
+// proven absent, even if it isn't part of the proof. The stems of a proof of
+// absence are also present, as they hold the slot where the absent stems
+// would be. Stems going through none of these slots are unknown. If the
+// proof is malformed, all the stems are unknown.
+func (p *Proof) StemOracle() func(stem []byte) KeyStatus {
+	info, _, err := getStemInfos(p)
+	if err != nil {
+		return func([]byte) KeyStatus { return KeyStatusUnknown }
+	}
+
+	return func(stem []byte) KeyStatus {
+		for depth := 1; depth <= len(stem) && depth <= StemSize; depth++ {
+			si, ok := info[string(stem[:depth])]
+			if !ok {
+				continue
+			}
+			if si.stemType != extStatusAbsentEmpty && bytes.Equal(si.stem, stem) {
+				return KeyStatusPresent
+			}
+			return KeyStatusAbsent
+		}
+		return KeyStatusUnknown
+	}
+}
+
+// CommitmentsByPath rebuilds the mapping from tree path to commitment
+// for all the commitments in the proof, without having to rebuild the
+// stateless tree. The root commitment isn't part of the proof, so it
+// isn't part of the mapping either. It returns nil if the proof is
+// malformed.
+func (p *Proof) CommitmentsByPath() map[string]*Point {
+	info, paths, err := getStemInfos(p)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		byPath = make(map[string]*Point, len(p.Cs))
+		comms  = p.Cs
+		next   = func(path []byte) bool {
+			if len(comms) == 0 {
+				return false
+			}
+			byPath[string(path)] = comms[0]
+			comms = comms[1:]
+			return true
+		}
+	)
+	for _, path := range paths {
+		// Walk down the internal nodes along the path, in the
+		// same order as CreatePath consumes the commitments.
+		for depth := 1; depth < len(path); depth++ {
+			if _, ok := byPath[string(path[:depth])]; ok {
+				continue
+			}
+			if !next(path[:depth]) {
+				return nil
+			}
+		}
+
+		si := info[string(path)]
+		switch si.stemType {
+		case extStatusAbsentOther:
+			if !next(path) {
+				return nil
+			}
+		case extStatusPresent:
+			if !next(path) {
+				return nil
+			}
+			if si.has_c1 && !next(append(path[:len(path):len(path)], 2)) {
+				return nil
+			}
+			if si.has_c2 && !next(append(path[:len(path):len(path)], 3)) {
+				return nil
+			}
+		}
+	}
+
+	return byPath
+}
+
+// MergeProofs combines two proofs made against the same root into a proof
+// covering the keys of both. Keys proven by both proofs must have the same
+// pre- and post-values, and commitments found at the same path must be
+// equal. The multipoint argument isn't recomputed, so the merged proof has
+// none: it can't be verified or serialized, and is only meant to rebuild a
+// stateless tree with PreStateTreeFromProof. Both proofs should have been
+// verified beforehand.
+func MergeProofs(a, b *Proof) (*Proof, error) {
+	byPath := make(map[string]*Point)
+	for _, proof := range []*Proof{a, b} {
+		comms := proof.CommitmentsByPath()
+		if comms == nil || len(proof.PreValues) != len(proof.Keys) || len(proof.PostValues) != len(proof.Keys) {
+			return nil, errors.New("malformed proof")
+		}
+		for path, c := range comms {
+			if other, ok := byPath[path]; ok && !other.Equal(c) {
+				return nil, fmt.Errorf("proofs disagree on the commitment at path %x", path)
+			}
+			byPath[path] = c
+		}
+	}
+
+	// Merge the keys and their values, and collect the
+	// extension status of each stem.
+	var (
+		merged   = &Proof{}
+		statuses = make(map[string]byte)
+		i, j     int
+	)
+	for i < len(a.Keys) || j < len(b.Keys) {
+		var (
+			from *Proof
+			idx  int
+		)
+		switch {
+		case j == len(b.Keys) || (i < len(a.Keys) && bytes.Compare(a.Keys[i], b.Keys[j]) < 0):
+			from, idx = a, i
+			i++
+		case i == len(a.Keys) || bytes.Compare(a.Keys[i], b.Keys[j]) > 0:
+			from, idx = b, j
+			j++
+		default:
+			if !bytes.Equal(a.PreValues[i], b.PreValues[j]) || !bytes.Equal(a.PostValues[i], b.PostValues[j]) {
+				return nil, fmt.Errorf("proofs disagree on the values of key %x", a.Keys[i])
+			}
+			from, idx = a, i
+			i++
+			j++
+		}
+		merged.Keys = append(merged.Keys, from.Keys[idx])
+		merged.PreValues = append(merged.PreValues, from.PreValues[idx])
+		merged.PostValues = append(merged.PostValues, from.PostValues[idx])
+	}
+	for _, proof := range []*Proof{a, b} {
+		var stem []byte
+		status := 0
+		for _, key := range proof.Keys {
+			if bytes.Equal(stem, KeyToStem(key)) {
+				continue
+			}
+			stem = KeyToStem(key)
+			if status == len(proof.ExtStatus) {
+				return nil, errors.New("malformed proof: missing extension status")
+			}
+			if es, ok := statuses[string(stem)]; ok && es != proof.ExtStatus[status] {
+				return nil, fmt.Errorf("proofs disagree on the extension status of stem %x", stem)
+			}
+			statuses[string(stem)] = proof.ExtStatus[status]
+			status++
+		}
+	}
+
+	// Keep the proof of absence stems that aren't superseded
+	// by a proof of presence at the same path.
+	var (
+		presentPaths = make(map[string]struct{})
+		absentPaths  = make(map[string]struct{})
+		stem         []byte
+	)
+	for _, key := range merged.Keys {
+		if bytes.Equal(stem, KeyToStem(key)) {
+			continue
+		}
+		stem = KeyToStem(key)
+		es := statuses[string(stem)]
+		merged.ExtStatus = append(merged.ExtStatus, es)
+		switch es & 3 {
+		case extStatusPresent:
+			presentPaths[string(stem[:es>>3])] = struct{}{}
+		case extStatusAbsentOther:
+			absentPaths[string(stem[:es>>3])] = struct{}{}
+		}
+	}
+	poaStems := append(append([]Stem{}, a.PoaStems...), b.PoaStems...)
+	sort.Sort(bytesSlice(poaStems))
+	for _, poaStem := range poaStems {
+		if len(merged.PoaStems) > 0 && bytes.Equal(merged.PoaStems[len(merged.PoaStems)-1], poaStem) {
+			continue
+		}
+		for depth := 1; depth <= len(poaStem); depth++ {
+			if _, ok := absentPaths[string(poaStem[:depth])]; ok {
+				if _, ok := presentPaths[string(poaStem[:depth])]; !ok {
+					merged.PoaStems = append(merged.PoaStems, poaStem)
+				}
+				break
+			}
+		}
+	}
+
+	merged.Cs = sortedCommitmentsByPath(byPath)
+	if len(merged.CommitmentsByPath()) != len(merged.Cs) {
+		return nil, errors.New("merged proof is inconsistent")
+	}
+	return merged, nil
+}
+
 // PostStateTreeFromProof uses the pre-state trie and the list of updated values
-// to produce the stateless post-state trie.
+// to produce the stateless post-state trie. Suffixes with a nil new value are
+// left untouched, and those whose new value is made of zeros are cleared by
+// writing that zero value, see SuffixStateDiff.
 func PostStateTreeFromStateDiff(preroot VerkleNode, statediff StateDiff) (VerkleNode, error) {
+	if _, ok := preroot.(*InternalNode); !ok {
+		return nil, fmt.Errorf("pre-state root is not an internal node: %T", preroot)
+	}
 	postroot := preroot.Copy()
 
 	for _, stemstatediff := range statediff {
 		var (
 			values     = make([][]byte, NodeWidth)
 			overwrites bool
+			seen       [NodeWidth]bool
 		)
 
 		for _, suffixdiff := range stemstatediff.SuffixDiffs {
+			// A suffix appearing twice would have its first new value
+			// silently overwritten by the second one.
+			if seen[suffixdiff.Suffix] {
+				return nil, fmt.Errorf("suffix %d appears more than once in the diff of stem %x", suffixdiff.Suffix, stemstatediff.Stem)
+			}
+			seen[suffixdiff.Suffix] = true
 			if /* len(suffixdiff.NewValue) > 0 - this only works for a slice */ suffixdiff.NewValue != nil {
 				// if this value is non-nil, it means InsertValuesAtStem should be
 				// called, otherwise, skip updating the tree.
@@ -606,7 +1579,7 @@ func PostStateTreeFromStateDiff(preroot VerkleNode, statediff StateDiff) (Verkle
 		if overwrites {
 			var stem [StemSize]byte
 			copy(stem[:StemSize], stemstatediff.Stem[:])
-			if err := postroot.(*InternalNode).InsertValuesAtStem(stem[:], values, nil); err != nil {
+			if err := postroot.InsertValuesAtStem(stem[:], values, nil); err != nil {
 				return nil, fmt.Errorf("error overwriting value in post state: %w", err)
 			}
 		}
@@ -616,6 +1589,40 @@ func PostStateTreeFromStateDiff(preroot VerkleNode, statediff StateDiff) (Verkle
 	return postroot, nil
 }
 
+// ApplyStateDiff applies the values inserted or updated by a state diff
+// directly to the tree, and commits it once all of them are written. Suffixes
+// that were only read, or whose new value is the same as the current one,
+// are skipped.
+func (n *InternalNode) ApplyStateDiff(sd StateDiff, resolver NodeResolverFn) error {
+	for _, stemstatediff := range sd {
+		var (
+			values     = make([][]byte, NodeWidth)
+			overwrites bool
+		)
+		for _, suffixdiff := range stemstatediff.SuffixDiffs {
+			if suffixdiff.NewValue == nil {
+				continue
+			}
+			if suffixdiff.CurrentValue != nil && *suffixdiff.CurrentValue == *suffixdiff.NewValue {
+				continue
+			}
+			overwrites = true
+			values[suffixdiff.Suffix] = suffixdiff.NewValue[:]
+		}
+
+		if overwrites {
+			var stem [StemSize]byte
+			copy(stem[:], stemstatediff.Stem[:])
+			if err := n.InsertValuesAtStem(stem[:], values, resolver); err != nil {
+				return fmt.Errorf("error applying state diff at stem %x: %w", stem, err)
+			}
+		}
+	}
+	n.Commit()
+
+	return nil
+}
+
 type bytesSlice []Stem
 
 func (x bytesSlice) Len() int           { return len(x) }
@@ -624,19 +1631,57 @@ func (x bytesSlice) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 
 // Verify is the API function that verifies a verkle proofs as found in a block/execution payload.
 func Verify(vp *VerkleProof, preStateRoot []byte, postStateRoot []byte, statediff StateDiff) error {
+	return VerifyWithLabel(vp, preStateRoot, postStateRoot, statediff, defaultTranscriptLabel)
+}
 
-	proof, err := DeserializeProof(vp, statediff)
-	if err != nil {
-		return fmt.Errorf("verkle proof deserialization error: %w", err)
-	}
-
+// VerifyWithLabel is Verify for a proof created with a custom transcript
+// label, see MakeVerkleMultiProofWithLabel.
+func VerifyWithLabel(vp *VerkleProof, preStateRoot []byte, postStateRoot []byte, statediff StateDiff, label string) error {
 	rootC := new(Point)
 	if err := rootC.SetBytes(preStateRoot); err != nil {
 		return fmt.Errorf("error setting prestate root: %w", err)
 	}
+	postC, err := verifyAndApply(vp, rootC, statediff, label)
+	if err != nil {
+		return err
+	}
+	regeneratedPostTreeRoot := postC.Bytes()
+	if !bytes.Equal(regeneratedPostTreeRoot[:], postStateRoot) {
+		return fmt.Errorf("post tree root mismatch: %x != %x", regeneratedPostTreeRoot, postStateRoot)
+	}
+	return nil
+}
+
+// VerifyWitnessChain verifies the witnesses of a sequence of blocks, each one
+// against the post-state root of the previous one, starting with startRoot.
+// It returns the post-state root of the last block, or an error for the first
+// block whose proof doesn't verify against the running root.
+func VerifyWitnessChain(startRoot *Point, proofs []*VerkleProof, diffs []StateDiff) (*Point, error) {
+	if len(proofs) != len(diffs) {
+		return nil, fmt.Errorf("number of proofs (%d) and state diffs (%d) differ", len(proofs), len(diffs))
+	}
+	root := startRoot
+	for i := range proofs {
+		postC, err := verifyAndApply(proofs[i], root, diffs[i], defaultTranscriptLabel)
+		if err != nil {
+			return nil, fmt.Errorf("block #%d: %w", i, err)
+		}
+		root = postC
+	}
+	return root, nil
+}
+
+// verifyAndApply verifies a proof against a pre-state root, and returns the
+// post-state root obtained by applying the state diff.
+func verifyAndApply(vp *VerkleProof, rootC *Point, statediff StateDiff, label string) (*Point, error) {
+	proof, err := DeserializeProof(vp, statediff)
+	if err != nil {
+		return nil, fmt.Errorf("verkle proof deserialization error: %w", err)
+	}
+
 	pretree, err := PreStateTreeFromProof(proof, rootC)
 	if err != nil {
-		return fmt.Errorf("error rebuilding the pre-tree from proof: %w", err)
+		return nil, fmt.Errorf("error rebuilding the pre-tree from proof: %w", err)
 	}
 	// TODO this should not be necessary, remove it
 	// after the new proof generation code has stabilized.
@@ -648,15 +1693,15 @@ func Verify(vp *VerkleProof, preStateRoot []byte, postStateRoot []byte, statedif
 
 			val, err := pretree.Get(key[:], nil)
 			if err != nil {
-				return fmt.Errorf("could not find key %x in tree rebuilt from proof: %w", key, err)
+				return nil, fmt.Errorf("could not find key %x in tree rebuilt from proof: %w", key, err)
 			}
 			if len(val) > 0 {
 				if !bytes.Equal(val, suffixdiff.CurrentValue[:]) {
-					return fmt.Errorf("could not find correct value at %x in tree rebuilt from proof: %x != %x", key, val, *suffixdiff.CurrentValue)
+					return nil, fmt.Errorf("could not find correct value at %x in tree rebuilt from proof: %x != %x", key, val, *suffixdiff.CurrentValue)
 				}
 			} else {
 				if suffixdiff.CurrentValue != nil && len(suffixdiff.CurrentValue) != 0 {
-					return fmt.Errorf("could not find correct value at %x in tree rebuilt from proof: %x != %x", key, val, *suffixdiff.CurrentValue)
+					return nil, fmt.Errorf("could not find correct value at %x in tree rebuilt from proof: %x != %x", key, val, *suffixdiff.CurrentValue)
 				}
 			}
 		}
@@ -668,12 +1713,11 @@ func Verify(vp *VerkleProof, preStateRoot []byte, postStateRoot []byte, statedif
 	// This can avoid regenerating the post-tree which is somewhat expensive.
 	posttree, err := PostStateTreeFromStateDiff(pretree, statediff)
 	if err != nil {
-		return fmt.Errorf("error rebuilding the post-tree from proof: %w", err)
-	}
-	regeneratedPostTreeRoot := posttree.Commitment().Bytes()
-	if !bytes.Equal(regeneratedPostTreeRoot[:], postStateRoot) {
-		return fmt.Errorf("post tree root mismatch: %x != %x", regeneratedPostTreeRoot, postStateRoot)
+		return nil, fmt.Errorf("error rebuilding the post-tree from proof: %w", err)
 	}
 
-	return verifyVerkleProofWithPreState(proof, pretree)
+	if err := verifyVerkleProofWithPreStateAndLabel(proof, pretree, label); err != nil {
+		return nil, err
+	}
+	return posttree.Commitment(), nil
 }
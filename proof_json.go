@@ -28,7 +28,9 @@ package verkle
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 )
 
 // HexToPrefixedString turns a byte slice into its hex representation
@@ -205,6 +207,9 @@ func (ssd *StemStateDiff) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("invalid hex string for stem: %w", err)
 	}
+	if len(stem) != StemSize {
+		return fmt.Errorf("invalid stem length %d, expected %d", len(stem), StemSize)
+	}
 	*ssd = StemStateDiff{
 		SuffixDiffs: aux.SuffixDiffs,
 	}
@@ -245,6 +250,9 @@ func (ssd *SuffixStateDiff) UnmarshalJSON(data []byte) error {
 	if aux.CurrentValue != nil && len(*aux.CurrentValue) != 64 && len(*aux.CurrentValue) != 0 && len(*aux.CurrentValue) != 66 {
 		return fmt.Errorf("invalid hex string for current value: %s", *aux.CurrentValue)
 	}
+	if aux.NewValue != nil && len(*aux.NewValue) != 64 && len(*aux.NewValue) != 0 && len(*aux.NewValue) != 66 {
+		return fmt.Errorf("invalid hex string for new value: %s", *aux.NewValue)
+	}
 
 	*ssd = SuffixStateDiff{
 		Suffix: aux.Suffix,
@@ -263,7 +271,7 @@ func (ssd *SuffixStateDiff) UnmarshalJSON(data []byte) error {
 	if aux.NewValue != nil && len(*aux.NewValue) != 0 {
 		newValueBytes, err := PrefixedHexStringToBytes(*aux.NewValue)
 		if err != nil {
-			return fmt.Errorf("error decoding hex string for current value: %v", err)
+			return fmt.Errorf("error decoding hex string for new value: %v", err)
 		}
 
 		ssd.NewValue = &[32]byte{}
@@ -272,3 +280,97 @@ func (ssd *SuffixStateDiff) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// chunkedProofMarshaller is the JSON layout of a chunked proof.
+type chunkedProofMarshaller struct {
+	VerkleProof *VerkleProof `json:"verkleProof"`
+	StateDiff   StateDiff    `json:"stateDiff"`
+}
+
+// chunkWriter accumulates the data written to it and passes it to emit
+// in chunks of chunkSize bytes. The last chunk can be shorter.
+type chunkWriter struct {
+	chunk     []byte
+	chunkSize int
+	emit      func([]byte) error
+}
+
+func (cw *chunkWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		n := cw.chunkSize - len(cw.chunk)
+		if n > len(data) {
+			n = len(data)
+		}
+		cw.chunk = append(cw.chunk, data[:n]...)
+		data = data[n:]
+		if len(cw.chunk) == cw.chunkSize {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) flush() error {
+	if len(cw.chunk) == 0 {
+		return nil
+	}
+	chunk := cw.chunk
+	cw.chunk = make([]byte, 0, cw.chunkSize)
+	return cw.emit(chunk)
+}
+
+// SerializeProofChunked serializes a proof as JSON, and hands the result
+// to emit in chunks of chunkSize bytes, so that the whole serialized
+// witness never has to be held in memory. The state diff is encoded one
+// stem at a time. The chunks are owned by the callee. The output can be
+// read back with DeserializeProofChunked.
+func SerializeProofChunked(proof *Proof, chunkSize int, emit func(chunk []byte) error) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		return fmt.Errorf("serializing proof: %w", err)
+	}
+
+	cw := &chunkWriter{chunk: make([]byte, 0, chunkSize), chunkSize: chunkSize, emit: emit}
+	if _, err := cw.Write([]byte(`{"verkleProof":`)); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(cw).Encode(vp); err != nil {
+		return err
+	}
+	if _, err := cw.Write([]byte(`,"stateDiff":[`)); err != nil {
+		return err
+	}
+	for i := range statediff {
+		if i > 0 {
+			if _, err := cw.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		if err := json.NewEncoder(cw).Encode(statediff[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := cw.Write([]byte("]}")); err != nil {
+		return err
+	}
+	return cw.flush()
+}
+
+// DeserializeProofChunked reassembles a proof serialized by
+// SerializeProofChunked.
+func DeserializeProofChunked(r io.Reader) (*Proof, error) {
+	var cp chunkedProofMarshaller
+	if err := json.NewDecoder(r).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("decoding chunked proof: %w", err)
+	}
+	if cp.VerkleProof == nil {
+		return nil, errors.New("chunked proof is missing the verkle proof")
+	}
+	return DeserializeProof(cp.VerkleProof, cp.StateDiff)
+}
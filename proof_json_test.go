@@ -1,7 +1,10 @@
 package verkle
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"reflect"
 	"testing"
 )
 
@@ -22,3 +25,148 @@ func TestJSONDeserialization(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSerializeProofChunked(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	keys := randomKeys(t, 200)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const chunkSize = 100
+	var chunks []io.Reader
+	err = SerializeProofChunked(proof, chunkSize, func(chunk []byte) error {
+		if len(chunk) > chunkSize {
+			t.Fatalf("chunk too large: %d > %d", len(chunk), chunkSize)
+		}
+		chunks = append(chunks, bytes.NewReader(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected the proof to be split, got %d chunks", len(chunks))
+	}
+
+	dproof, err := DeserializeProofChunked(io.MultiReader(chunks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyVerkleProofWithPreState(dproof, root); err != nil {
+		t.Fatalf("reassembled proof didn't verify: %v", err)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dvp, dstatediff, err := SerializeProof(dproof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(vp.CanonicalBytes(), dvp.CanonicalBytes()) || !reflect.DeepEqual(statediff, dstatediff) {
+		t.Fatal("reassembled proof differs from the original")
+	}
+
+	if err := SerializeProofChunked(proof, 0, nil); err == nil {
+		t.Fatal("expected an error with a zero chunk size")
+	}
+}
+
+func TestStemStateDiffUnmarshalInvalidStem(t *testing.T) {
+	t.Parallel()
+
+	var ssd StemStateDiff
+	if err := json.Unmarshal([]byte(`{"stem":"0x0102","suffixDiffs":[]}`), &ssd); err == nil {
+		t.Fatal("expected an error for a short stem")
+	}
+}
+
+func TestStateDiffJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	readKey, _ := JoinKey(zeroKeyTest[:StemSize], 0)
+	clearedKey, _ := JoinKey(zeroKeyTest[:StemSize], 1)
+	insertedKey, _ := JoinKey(zeroKeyTest[:StemSize], 2)
+	untouchedKey, _ := JoinKey(zeroKeyTest[:StemSize], 3)
+
+	preroot := New()
+	for _, key := range [][]byte{readKey, clearedKey} {
+		if err := preroot.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	preroot.Commit()
+	postroot := preroot.Copy()
+	if err := postroot.Insert(clearedKey, zero32[:], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := postroot.Insert(insertedKey, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	postroot.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(preroot, postroot, [][]byte{readKey, clearedKey, insertedKey, untouchedKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statediff) != 1 || len(statediff[0].SuffixDiffs) != 4 {
+		t.Fatalf("expected a single stem with 4 suffix diffs, got %v", statediff)
+	}
+
+	encoded, err := json.Marshal(statediff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded StateDiff
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, statediff) {
+		t.Fatalf("state diff differs after a JSON round trip: %v != %v", decoded, statediff)
+	}
+
+	diffs := decoded[0].SuffixDiffs
+	if diffs[0].CurrentValue == nil || diffs[0].NewValue != nil {
+		t.Error("read-only suffix should only have a current value")
+	}
+	if diffs[1].CurrentValue == nil || diffs[1].NewValue == nil || *diffs[1].NewValue != zero32 {
+		t.Error("cleared suffix should have a zero new value")
+	}
+	if diffs[2].CurrentValue != nil || diffs[2].NewValue == nil || !bytes.Equal(diffs[2].NewValue[:], fourtyKeyTest) {
+		t.Error("inserted suffix should only have a new value")
+	}
+	if diffs[3].CurrentValue != nil || diffs[3].NewValue != nil {
+		t.Error("untouched suffix should have no value")
+	}
+
+	reencoded, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, reencoded) {
+		t.Fatalf("JSON encoding isn't stable: %s != %s", encoded, reencoded)
+	}
+}
+
+func TestSuffixStateDiffUnmarshalInvalidNewValue(t *testing.T) {
+	t.Parallel()
+
+	var ssd SuffixStateDiff
+	if err := json.Unmarshal([]byte(`{"suffix":0,"currentValue":null,"newValue":"0x0102"}`), &ssd); err == nil {
+		t.Fatal("expected an error for a short new value")
+	}
+}
@@ -29,10 +29,15 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/crate-crypto/go-ipa/banderwagon"
 	"github.com/crate-crypto/go-ipa/common"
 )
 
@@ -463,6 +468,60 @@ func TestProofDeserialize(t *testing.T) {
 	}
 }
 
+func TestExtensionStatus(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	otherKey := bytes.Clone(fourtyKeyTest)
+	otherKey[20] = 1
+
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := flushToResolver(t, root)
+
+	for _, tc := range []struct {
+		name      string
+		key       []byte
+		status    byte
+		otherStem []byte
+	}{
+		{"present", zeroKeyTest, extStatusPresent | 2<<3, nil},
+		{"absent empty", ffx32KeyTest, extStatusAbsentEmpty | 1<<3, nil},
+		{"absent other", otherKey, extStatusAbsentOther | 1<<3, KeyToStem(fourtyKeyTest)},
+	} {
+		for _, tree := range []*InternalNode{root, view.(*InternalNode)} {
+			status, otherStem, err := tree.ExtensionStatus(tc.key, resolver)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if status != tc.status || !bytes.Equal(otherStem, tc.otherStem) {
+				t.Fatalf("%s: invalid extension status, got %x %x, expected %x %x", tc.name, status, otherStem, tc.status, tc.otherStem)
+			}
+		}
+
+		// The status is the one found in a proof.
+		_, esses, _, err := root.GetProofItems(keylist{tc.key}, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(esses) != 1 || esses[0] != tc.status {
+			t.Fatalf("%s: extension status differs from the proof, got %x, expected %x", tc.name, tc.status, esses)
+		}
+	}
+}
+
 func TestProofOfAbsenceEdgeCase(t *testing.T) {
 	t.Parallel()
 
@@ -1246,3 +1305,1656 @@ func TestProveAbsenceInEmptyHalf(t *testing.T) {
 		t.Fatalf("invalid number of extension status: %d", len(proof.ExtStatus))
 	}
 }
+
+func TestMarginalProofSize(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	root.Commit()
+
+	baseKeys := [][]byte{zeroKeyTest}
+
+	covered, err := MarginalProofSize(root, baseKeys, zeroKeyTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered != 0 {
+		t.Fatalf("expected no marginal cost for an already-proven key, got %d", covered)
+	}
+
+	// oneKeyTest shares its stem with zeroKeyTest, and is absent: only
+	// its suffix has to be added.
+	sameStem, err := MarginalProofSize(root, baseKeys, oneKeyTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameStem != 1 {
+		t.Fatalf("expected a marginal cost of 1 byte for a key in the same stem, got %d", sameStem)
+	}
+
+	otherSubtree, err := MarginalProofSize(root, baseKeys, ffx32KeyTest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherSubtree <= sameStem {
+		t.Fatalf("expected a key in another subtree to cost more than %d bytes, got %d", sameStem, otherSubtree)
+	}
+
+	if !bytes.Equal(baseKeys[0], zeroKeyTest) || len(baseKeys) != 1 {
+		t.Fatalf("base keys were modified: %x", baseKeys)
+	}
+}
+
+func TestProofCommitmentsByPath(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	root.Commit()
+
+	absentKey, _ := hex.DecodeString("0001000000000000000000000000000000000000000000000000000000000080")
+	absentStem, _ := hex.DecodeString("8000000000000000000000000000000000000000000000000000000000000000")
+	keys := [][]byte{zeroKeyTest, ffx32KeyTest, absentKey, absentStem}
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe, _, _, err := GetCommitmentsForMultiproof(root, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dproof, err := DeserializeProof(vp, statediff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := dproof.CommitmentsByPath()
+	if len(byPath) != len(pe.ByPath)-1 {
+		t.Fatalf("invalid number of commitments, got %d, expected %d", len(byPath), len(pe.ByPath)-1)
+	}
+	for path, c := range pe.ByPath {
+		if len(path) == 0 {
+			continue
+		}
+		got, ok := byPath[path]
+		if !ok {
+			t.Fatalf("missing commitment for path %x", path)
+		}
+		if !got.Equal(c) {
+			t.Fatalf("invalid commitment at path %x: got %x, expected %x", path, got.Bytes(), c.Bytes())
+		}
+	}
+}
+
+func TestStemCommitmentProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	rootC := root.Commit()
+
+	stem := KeyToStem(forkOneKeyTest)
+	proof, err := MakeStemCommitmentProof(root, stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.Keys) != 0 || len(proof.PreValues) != 0 {
+		t.Fatalf("stem commitment proof should not reveal any value")
+	}
+	if err := VerifyStemCommitmentProof(proof, rootC, stem); err != nil {
+		t.Fatalf("could not verify stem commitment proof: %v", err)
+	}
+
+	// The proven C1 and C2 are those of the leaf.
+	leaf := getKeyFullPath(root, forkOneKeyTest)[2].(*LeafNode)
+	if !proof.Cs[len(proof.Cs)-2].Equal(leaf.c1) || !proof.Cs[len(proof.Cs)-1].Equal(leaf.c2) {
+		t.Fatalf("proof doesn't contain the leaf's suffix commitments")
+	}
+
+	// Claiming another C1 must fail.
+	proof.Cs[len(proof.Cs)-2] = leaf.c2
+	if err := VerifyStemCommitmentProof(proof, rootC, stem); err == nil {
+		t.Fatalf("verification should fail with an invalid C1")
+	}
+
+	// Absent stems can't be proven.
+	if _, err := MakeStemCommitmentProof(root, KeyToStem(fourtyKeyTest), nil); err == nil {
+		t.Fatalf("expected an error when proving an absent stem")
+	}
+	// Emptying half of a leaf clears its C1, which is then proven as
+	// the identity.
+	root = New()
+	for _, suffix := range []byte{5, 200} {
+		key, _ := JoinKey(stem, suffix)
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	root.Commit()
+	key, _ := JoinKey(stem, 5)
+	if _, err := root.Delete(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	rootC = root.Commit()
+	if root.(*InternalNode).children[stem[0]].(*LeafNode).c1 != nil {
+		t.Fatal("expected C1 to be cleared by the deletion")
+	}
+	proof, err = MakeStemCommitmentProof(root, stem, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.Cs[len(proof.Cs)-2].Equal(new(Point).SetIdentity()) {
+		t.Fatal("a cleared C1 should be proven as the identity")
+	}
+	if err := VerifyStemCommitmentProof(proof, rootC, stem); err != nil {
+		t.Fatalf("could not verify stem commitment proof: %v", err)
+	}
+}
+
+func TestSubtreeProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	rootC := root.Commit()
+	internal := root.(*InternalNode).children[0].(*InternalNode)
+
+	for _, tc := range []struct {
+		path []byte
+		comm *Point
+	}{
+		{[]byte{0}, internal.commitment},
+		{[]byte{0, 0}, internal.children[0].Commitment()},
+		{[]byte{0, 1}, internal.children[1].Commitment()},
+		{[]byte{0, 5}, Empty{}.Commitment()},
+	} {
+		proof, err := MakeSubtreeProof(root, tc.path, nil)
+		if err != nil {
+			t.Fatalf("could not prove subtree at %x: %v", tc.path, err)
+		}
+		if len(proof.Keys) != 0 || len(proof.PreValues) != 0 {
+			t.Fatalf("subtree proof should not reveal any value")
+		}
+		if !proof.Cs[len(proof.Cs)-1].Equal(tc.comm) {
+			t.Fatalf("proof doesn't contain the commitment of the subtree at %x", tc.path)
+		}
+		if err := VerifySubtreeProof(proof, rootC, tc.path); err != nil {
+			t.Fatalf("could not verify subtree proof at %x: %v", tc.path, err)
+		}
+	}
+
+	// Claiming another child must fail.
+	proof, err := MakeSubtreeProof(root, []byte{0, 0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof.Cs[len(proof.Cs)-1] = internal.children[1].Commitment()
+	if err := VerifySubtreeProof(proof, rootC, []byte{0, 0}); err == nil {
+		t.Fatalf("verification should fail with an invalid child commitment")
+	}
+	proof.Cs[len(proof.Cs)-1] = internal.children[0].Commitment()
+	if err := VerifySubtreeProof(proof, rootC, []byte{0, 1}); err == nil {
+		t.Fatalf("verification should fail at another path")
+	}
+
+	// Paths going through a leaf can't be proven.
+	if _, err := MakeSubtreeProof(root, []byte{0, 0, 0}, nil); err == nil {
+		t.Fatalf("expected an error when proving a path going through a leaf")
+	}
+	if _, err := MakeSubtreeProof(root, nil, nil); err == nil {
+		t.Fatalf("expected an error when proving an empty path")
+	}
+}
+
+func TestVerkleProofCanonicalBytes(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	root.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{zeroKeyTest, fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, _, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the same proof through a JSON round-trip.
+	encoded, err := json.Marshal(vp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded VerkleProof
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	canonical := vp.CanonicalBytes()
+	if !bytes.Equal(canonical, decoded.CanonicalBytes()) {
+		t.Fatalf("canonical bytes differ after a JSON round-trip")
+	}
+	if !bytes.Equal(canonical, vp.Copy().CanonicalBytes()) {
+		t.Fatalf("canonical bytes differ after a copy")
+	}
+
+	other, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{ffx32KeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVp, _, err := SerializeProof(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(canonical, otherVp.CanonicalBytes()) {
+		t.Fatalf("different proofs have the same canonical bytes")
+	}
+}
+
+func TestVerkleProofMarshalBinary(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("could not insert key: %v", err)
+		}
+	}
+	root.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{zeroKeyTest, fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, _, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := vp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded VerkleProof
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.Equal(&decoded); err != nil {
+		t.Fatalf("proof differs after a binary round-trip: %v", err)
+	}
+	if *decoded.IPAProof != *vp.IPAProof {
+		t.Fatal("IPA proof differs after a binary round-trip")
+	}
+	reencoded, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, reencoded) {
+		t.Fatal("encoding differs after a binary round-trip")
+	}
+
+	// Truncated or extended inputs are rejected without panicking.
+	for i := 0; i < len(encoded); i++ {
+		if err := new(VerkleProof).UnmarshalBinary(encoded[:i]); err == nil {
+			t.Fatalf("expected an error for an input truncated to %d bytes", i)
+		}
+	}
+	if err := new(VerkleProof).UnmarshalBinary(append(encoded, 0)); err == nil {
+		t.Fatal("expected an error for an input with a trailing byte")
+	}
+
+	// Random corruptions of the input never panic.
+	corrupted := make([]byte, len(encoded))
+	random := make([]byte, 2)
+	for i := 0; i < 1000; i++ {
+		copy(corrupted, encoded)
+		if _, err := rand.Read(random); err != nil {
+			t.Fatal(err)
+		}
+		// Only corrupt the bytes of the variable-length
+		// fields, which drive the decoding.
+		corrupted[int(random[0])%(len(encoded)-(2*IPA_PROOF_DEPTH+2)*32)] = random[1]
+		_ = new(VerkleProof).UnmarshalBinary(corrupted)
+	}
+}
+
+func TestStatefulTreeFromProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dproof, err := DeserializeProof(vp, statediff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := StatefulTreeFromProof(dproof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !droot.Commitment().Equal(rootC) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", droot.Commitment().Bytes(), rootC.Bytes())
+	}
+
+	// Insert a new value in the leaf that was proven, and check that
+	// the commitment is the same as when inserting in the full tree.
+	if err := droot.Insert(oneKeyTest, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Insert(oneKeyTest, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !droot.Commit().Equal(root.Commit()) {
+		t.Fatalf("invalid root commitment after insert, got %x, expected %x", droot.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+
+	// Inserting into a part of the tree that isn't covered by the proof
+	// must fail.
+	if err := droot.Insert(ffx32KeyTest, fourtyKeyTest, nil); err == nil {
+		t.Fatal("expected an error when inserting into a subtree missing from the proof")
+	}
+}
+
+func TestProofNoKeys(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+
+	if _, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{}, nil); !errors.Is(err, errNoKeys) {
+		t.Fatalf("invalid error, got %v, expected %v", err, errNoKeys)
+	}
+
+	pe, es, poas, err := GetCommitmentsForMultiproof(root, [][]byte{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Cis) != 0 || len(pe.Zis) != 0 || len(pe.Yis) != 0 || len(pe.Vals) != 0 || len(es) != 0 || len(poas) != 0 {
+		t.Fatalf("expected empty proof elements, got %d openings, %d values, %d extension statuses and %d poa stems", len(pe.Cis), len(pe.Vals), len(es), len(poas))
+	}
+}
+
+func TestWriteIntoPOAStub(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	presentKey, _ := hex.DecodeString("4000000000000000000000000000000000000000000000000000000000000000")
+	if err := root.Insert(presentKey, zeroKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	rootC := root.Commit()
+
+	// Prove the absence of a key, so that the leaf of presentKey
+	// ends up as a poa stub in the reconstructed tree.
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{absentKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := StatefulTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, ok := droot.children[presentKey[0]].(*LeafNode)
+	if !ok || !stub.isPOAStub {
+		t.Fatalf("expected a poa stub, got %T", droot.children[presentKey[0]])
+	}
+	stubC := new(Point).Set(stub.commitment)
+
+	values := make([][]byte, NodeWidth)
+	values[presentKey[StemSize]] = testValue
+	if err := droot.InsertValuesAtStem(KeyToStem(presentKey), values, nil); err != errIsPOAStub {
+		t.Fatalf("invalid error from InsertValuesAtStem, got %v, expected %v", err, errIsPOAStub)
+	}
+	if err := stub.insertMultiple(KeyToStem(presentKey), values); err != errIsPOAStub {
+		t.Fatalf("invalid error from insertMultiple, got %v, expected %v", err, errIsPOAStub)
+	}
+	if err := stub.updateLeaf(presentKey[StemSize], testValue); err != errIsPOAStub {
+		t.Fatalf("invalid error from updateLeaf, got %v, expected %v", err, errIsPOAStub)
+	}
+	if _, err := stub.Delete(presentKey, nil); err != errIsPOAStub {
+		t.Fatalf("invalid error from Delete, got %v, expected %v", err, errIsPOAStub)
+	}
+	if !stub.commitment.Equal(stubC) {
+		t.Fatal("poa stub commitment changed after a failed write")
+	}
+}
+
+func TestExpectedCommitmentCount(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	for _, keys := range []keylist{
+		{zeroKeyTest},
+		{zeroKeyTest, oneKeyTest},
+		{zeroKeyTest, forkOneKeyTest},
+		{fourtyKeyTest, absentKey},
+		{absentKey},
+		{zeroKeyTest, forkOneKeyTest, fourtyKeyTest, ffx32KeyTest, absentKey},
+	} {
+		count, err := ExpectedCommitmentCount(root, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(proof.Cs) {
+			t.Fatalf("invalid commitment count for keys %x, got %d, expected %d", keys, count, len(proof.Cs))
+		}
+	}
+}
+
+func TestStateDiffStemsAndSuffixCount(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// zeroKeyTest and oneKeyTest share a stem, and absentKey isn't
+	// in the tree but still gets an entry in the state diff.
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	keys := keylist{zeroKeyTest, oneKeyTest, forkOneKeyTest, fourtyKeyTest, absentKey}
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStems := [][]byte{KeyToStem(zeroKeyTest), KeyToStem(forkOneKeyTest), KeyToStem(fourtyKeyTest), KeyToStem(absentKey)}
+	stems := statediff.Stems()
+	if len(stems) != len(expectedStems) {
+		t.Fatalf("invalid number of stems, got %d, expected %d", len(stems), len(expectedStems))
+	}
+	for i := range stems {
+		if !bytes.Equal(stems[i], expectedStems[i]) {
+			t.Fatalf("invalid stem #%d, got %x, expected %x", i, stems[i], expectedStems[i])
+		}
+	}
+	if count := statediff.SuffixCount(); count != len(keys) {
+		t.Fatalf("invalid suffix count, got %d, expected %d", count, len(keys))
+	}
+}
+
+func TestProofStemOracle(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// absentKey ends up in the leaf of fourtyKeyTest, whose stem is
+	// then part of the proof of absence stems. ffx32KeyTest goes to
+	// an empty slot.
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest, absentKey, ffx32KeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.PoaStems) != 1 || !bytes.Equal(proof.PoaStems[0], KeyToStem(fourtyKeyTest)) {
+		t.Fatalf("unexpected proof of absence stems %x", proof.PoaStems)
+	}
+
+	withPrefix := func(prefix ...byte) []byte {
+		stem := make([]byte, StemSize)
+		copy(stem, prefix)
+		return stem
+	}
+	oracle := proof.StemOracle()
+	for _, tc := range []struct {
+		stem     []byte
+		expected KeyStatus
+	}{
+		{KeyToStem(zeroKeyTest), KeyStatusPresent},
+		{KeyToStem(fourtyKeyTest), KeyStatusPresent}, // proof of absence stem
+		{KeyToStem(absentKey), KeyStatusAbsent},
+		{KeyToStem(ffx32KeyTest), KeyStatusAbsent},
+		{withPrefix(0xff, 0x01), KeyStatusAbsent}, // same empty slot as ffx32KeyTest
+		{withPrefix(0x00, 0x01), KeyStatusAbsent}, // same slot as zeroKeyTest
+		{withPrefix(0x80), KeyStatusUnknown},
+	} {
+		if status := oracle(tc.stem); status != tc.expected {
+			t.Fatalf("invalid status for stem %x, got %d, expected %d", tc.stem, status, tc.expected)
+		}
+	}
+}
+
+func TestInsertMigratedLeavesStateless(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := new(Point).Set(root.Commit())
+
+	// forkOneKeyTest is proven absent by the leaf at zeroKeyTest, and
+	// ffx32KeyTest by an empty root child.
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{forkOneKeyTest, ffx32KeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeaves := func() []LeafNode {
+		leaves, err := BatchNewLeafNode([]BatchNewLeafNodeData{
+			{Stem: KeyToStem(forkOneKeyTest), Values: map[byte][]byte{forkOneKeyTest[StemSize]: testValue, 5: fourtyKeyTest}},
+			{Stem: KeyToStem(ffx32KeyTest), Values: map[byte][]byte{ffx32KeyTest[StemSize]: testValue}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaves
+	}
+
+	droot, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := droot.(*InternalNode).InsertMigratedLeaves(newLeaves(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.(*InternalNode).InsertMigratedLeaves(newLeaves(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !droot.Commit().Equal(root.Commit()) {
+		t.Fatalf("invalid stateless root commitment, got %x, expected %x", droot.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+
+	// Leaves at stems that the proof doesn't cover, or that are only
+	// known through a proof of absence stub, can't be inserted.
+	droot, err = PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		data BatchNewLeafNodeData
+		err  error
+	}{
+		{BatchNewLeafNodeData{Stem: KeyToStem(fourtyKeyTest), Values: map[byte][]byte{1: testValue}}, errMissingNodeInStateless},
+		{BatchNewLeafNodeData{Stem: KeyToStem(zeroKeyTest), Values: map[byte][]byte{1: testValue}}, errIsPOAStub},
+	} {
+		leaves, err := BatchNewLeafNode([]BatchNewLeafNodeData{tc.data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := droot.(*InternalNode).InsertMigratedLeaves(leaves, nil); !errors.Is(err, tc.err) {
+			t.Fatalf("invalid error when inserting a leaf at stem %x, got %v, expected %v", tc.data.Stem, err, tc.err)
+		}
+	}
+}
+
+func TestPreStateTreeFromProofWithHash(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	keys := randomKeys(t, 20)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys[:5], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root commitment must be among the points matching its hash.
+	found := false
+	for _, p := range PointsFromHash(root.Hash()) {
+		found = found || p.Equal(root.Commitment())
+	}
+	if !found {
+		t.Fatal("root commitment not found from its hash")
+	}
+
+	droot, err := PreStateTreeFromProofWithHash(proof, root.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !droot.Commitment().Equal(root.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", droot.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+	for _, key := range keys[:5] {
+		val, err := droot.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, testValue) {
+			t.Fatalf("invalid value for key %x, got %x, expected %x", key, val, testValue)
+		}
+	}
+
+	var wrongHash Fr
+	wrongHash.Add(root.Hash(), &FrOne)
+	if _, err := PreStateTreeFromProofWithHash(proof, &wrongHash); err == nil {
+		t.Fatal("expected an error when rebuilding from a wrong hash")
+	}
+}
+
+func TestMakeVerkleMultiProofPresorted(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	keys := randomKeys(t, 100)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	keys = append(keys, absentKey)
+
+	proof, cis, zis, yis, err := MakeVerkleMultiProof(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys is now sorted.
+	sproof, scis, szis, syis, err := MakeVerkleMultiProofPresorted(root, nil, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cis) != len(scis) || !bytes.Equal(zis, szis) || len(yis) != len(syis) {
+		t.Fatal("proof elements differ")
+	}
+	for i := range cis {
+		if !cis[i].Equal(scis[i]) || !yis[i].Equal(syis[i]) {
+			t.Fatalf("proof element #%d differs", i)
+		}
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svp, sstatediff, err := SerializeProof(sproof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(vp.CanonicalBytes(), svp.CanonicalBytes()) {
+		t.Fatal("serialized proofs differ")
+	}
+	if err := statediff.Equal(sstatediff); err != nil {
+		t.Fatalf("state diffs differ: %v", err)
+	}
+
+	keys[0], keys[1] = keys[1], keys[0]
+	if _, _, _, _, err := MakeVerkleMultiProofPresorted(root, nil, keys, nil); err == nil {
+		t.Fatal("expected an error with unsorted keys")
+	}
+	keys[0] = keys[1]
+	if _, _, _, _, err := MakeVerkleMultiProofPresorted(root, nil, keys, nil); err == nil {
+		t.Fatal("expected an error with duplicate keys")
+	}
+}
+
+func BenchmarkMakeVerkleMultiProofPresorted(b *testing.B) {
+	keys := make([][]byte, 100000)
+	root := New()
+	for i := range keys {
+		keys[i] = make([]byte, KeySize)
+		if _, err := rand.Read(keys[i]); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(keys[i], zeroKeyTest, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root.Commit()
+	sort.Sort(keylist(keys))
+
+	b.Run("Sort", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Presorted", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, _, _, err := MakeVerkleMultiProofPresorted(root, nil, keys, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestApplyStateDiff(t *testing.T) {
+	t.Parallel()
+
+	// Same setup as the new_key_in_internal_node case of TestProofVerificationWithPostState.
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, zeroKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	postroot := root.Copy()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest} {
+		if err := postroot.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	postroot.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, postroot, keylist{ffx32KeyTest, zeroKeyTest, fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.(*InternalNode).ApplyStateDiff(statediff, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commitment().Equal(postroot.Commitment()) {
+		t.Fatalf("invalid post-state root, got %x, expected %x", root.Commitment().Bytes(), postroot.Commitment().Bytes())
+	}
+}
+
+func TestMakeSuffixRangeProof(t *testing.T) {
+	t.Parallel()
+
+	stem := KeyToStem(zeroKeyTest)
+	root := New()
+	for _, suffix := range []byte{3, 10, 20} {
+		key := append(append([]byte{}, stem...), suffix)
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Insert(fourtyKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+
+	proof, err := MakeSuffixRangeProof(root, stem, 0, 15, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof.Keys) != 16 {
+		t.Fatalf("invalid number of proven keys, got %d, expected 16", len(proof.Keys))
+	}
+	for i, key := range proof.Keys {
+		if !bytes.Equal(key[:StemSize], stem) || key[StemSize] != byte(i) {
+			t.Fatalf("invalid key #%d: %x", i, key)
+		}
+		if i == 3 || i == 10 {
+			if !bytes.Equal(proof.PreValues[i], testValue) {
+				t.Fatalf("invalid value for suffix %d, got %x, expected %x", i, proof.PreValues[i], testValue)
+			}
+		} else if proof.PreValues[i] != nil {
+			t.Fatalf("suffix %d should be absent, got %x", i, proof.PreValues[i])
+		}
+	}
+	if err := verifyVerkleProofWithPreState(proof, root); err != nil {
+		t.Fatalf("could not verify suffix range proof: %v", err)
+	}
+
+	if _, err := MakeSuffixRangeProof(root, stem, 15, 0, nil); err == nil {
+		t.Fatal("an inverted range should be rejected")
+	}
+}
+
+func TestInsertIntoMissingStatelessNode(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := StatefulTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := droot.children[0xff].(UnknownNode); !ok {
+		t.Fatalf("expected an unknown node, got %T", droot.children[0xff])
+	}
+
+	// The proven stem can be written to, the other one can't.
+	if err := droot.Insert(zeroKeyTest, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = droot.Insert(ffx32KeyTest, fourtyKeyTest, nil)
+	if !errors.Is(err, errMissingNodeInStateless) {
+		t.Fatalf("invalid error, got %v, expected %v", err, errMissingNodeInStateless)
+	}
+	if !strings.Contains(err.Error(), "node at path ff ") {
+		t.Fatalf("error doesn't name the missing path: %v", err)
+	}
+}
+
+func TestMakeEmptyLeafProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deleting all the values of a leaf removes it.
+	if _, err := root.Delete(fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	if _, err := MakeEmptyLeafProof(root, KeyToStem(fourtyKeyTest), nil); err == nil {
+		t.Fatal("proved an empty leaf at a deleted stem")
+	}
+	if _, err := MakeEmptyLeafProof(root, KeyToStem(zeroKeyTest), nil); err == nil {
+		t.Fatal("proved an empty leaf at a stem with a value")
+	}
+
+	// Inserting no value at a stem creates an empty leaf.
+	if err := root.(*InternalNode).InsertValuesAtStem(KeyToStem(fourtyKeyTest), make([][]byte, NodeWidth), nil); err != nil {
+		t.Fatal(err)
+	}
+	rootC := root.Commit()
+	proof, err := MakeEmptyLeafProof(root, KeyToStem(fourtyKeyTest), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyVerkleProofWithPreState(proof, root); err != nil {
+		t.Fatalf("could not verify empty leaf proof: %v", err)
+	}
+	if len(proof.ExtStatus) != 1 || proof.ExtStatus[0]&3 != extStatusPresent {
+		t.Fatalf("invalid extension statuses %x", proof.ExtStatus)
+	}
+
+	droot, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, ok := droot.(*InternalNode).children[fourtyKeyTest[0]].(*LeafNode)
+	if !ok {
+		t.Fatalf("expected a leaf node, got %T", droot.(*InternalNode).children[fourtyKeyTest[0]])
+	}
+	if !leaf.c1.Equal(&banderwagon.Identity) || !leaf.c2.Equal(&banderwagon.Identity) {
+		t.Fatal("empty leaf has non-empty suffix trees")
+	}
+}
+
+func TestVerifyWitnessChain(t *testing.T) {
+	t.Parallel()
+
+	root0 := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root0.Insert(key, zeroKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root0C := new(Point).Set(root0.Commit())
+
+	// Each block writes some keys, and proves all of them.
+	var (
+		pre    = root0
+		proofs []*VerkleProof
+		diffs  []StateDiff
+	)
+	for _, writes := range [][][]byte{{zeroKeyTest, fourtyKeyTest}, {ffx32KeyTest, oneKeyTest}} {
+		post := pre.Copy()
+		for _, key := range writes {
+			if err := post.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		post.Commit()
+		proof, _, _, _, err := MakeVerkleMultiProof(pre, post, keylist{writes[0], writes[1]}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vp, sd, err := SerializeProof(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs, diffs = append(proofs, vp), append(diffs, sd)
+		pre = post
+	}
+
+	endRoot, err := VerifyWitnessChain(root0C, proofs, diffs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !endRoot.Equal(pre.Commitment()) {
+		t.Fatalf("invalid end root, got %x, expected %x", endRoot.Bytes(), pre.Commitment().Bytes())
+	}
+
+	// The second block doesn't apply on top of the start root.
+	if _, err := VerifyWitnessChain(root0C, proofs[1:], diffs[1:]); err == nil {
+		t.Fatal("verified a broken witness chain")
+	}
+	if _, err := VerifyWitnessChain(root0C, []*VerkleProof{proofs[1], proofs[0]}, []StateDiff{diffs[1], diffs[0]}); err == nil {
+		t.Fatal("verified a witness chain out of order")
+	}
+}
+
+func TestPostStateTreeFromMalformedStateDiff(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+
+	var stem [StemSize]byte
+	copy(stem[:], KeyToStem(zeroKeyTest))
+	value1, value2 := [32]byte{1}, [32]byte{2}
+	statediff := StateDiff{{
+		Stem: stem,
+		SuffixDiffs: SuffixStateDiffs{
+			{Suffix: 5, NewValue: &value1},
+			{Suffix: 5, NewValue: &value2},
+		},
+	}}
+	_, err := PostStateTreeFromStateDiff(root, statediff)
+	if err == nil || !strings.Contains(err.Error(), "suffix 5 appears more than once") {
+		t.Fatalf("invalid error for a duplicated suffix: %v", err)
+	}
+
+	leaf := root.(*InternalNode).children[0]
+	if _, err := PostStateTreeFromStateDiff(leaf, statediff[:0]); err == nil {
+		t.Fatal("expected an error for a leaf pre-state root")
+	}
+}
+
+func TestProofDeduplicationSavings(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// A single key has nothing to share.
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savings := proof.DeduplicationSavings(); savings != 0 {
+		t.Fatalf("invalid savings for a single key, got %d, expected 0", savings)
+	}
+
+	// zeroKeyTest and oneKeyTest share the internal node at 00, their
+	// leaf and its C1. forkOneKeyTest shares the internal node at 00.
+	proof, _, _, _, err = MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest, oneKeyTest, forkOneKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Separately, each key needs the internal node, its leaf and a Cn, so
+	// 9 commitments instead of 5.
+	if len(proof.Cs) != 5 {
+		t.Fatalf("invalid number of commitments, got %d, expected 5", len(proof.Cs))
+	}
+	if savings := proof.DeduplicationSavings(); savings != 4*32 {
+		t.Fatalf("invalid savings, got %d, expected %d", savings, 4*32)
+	}
+}
+
+func TestWritableKeys(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	presentKey, _ := hex.DecodeString("4000000000000000000000000000000000000000000000000000000000000000")
+	for _, key := range [][]byte{presentKey, zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	// The leaf of presentKey ends up as a poa stub, that of zeroKeyTest
+	// is fully known, and that of ffx32KeyTest is missing.
+	absentKey, _ := hex.DecodeString("4010000000000000000000000000000000000000000000000000000000000000")
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keylist{zeroKeyTest, absentKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := StatefulTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := [][]byte{zeroKeyTest, oneKeyTest, absentKey, presentKey, ffx32KeyTest}
+	writable, err := droot.WritableKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bool{true, true, true, false, false}
+	for i := range keys {
+		if writable[i] != expected[i] {
+			t.Fatalf("invalid writability for key %x, got %v, expected %v", keys[i], writable[i], expected[i])
+		}
+	}
+
+	// Writing the keys flagged as writable succeeds.
+	for i, key := range keys {
+		if expected[i] {
+			if err := droot.Insert(key, fourtyKeyTest, nil); err != nil {
+				t.Fatalf("writing writable key %x: %v", key, err)
+			}
+		}
+	}
+}
+
+func TestGetWithProof(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	absentInEmptyHalf := append([]byte{}, zeroKeyTest...)
+	absentInEmptyHalf[StemSize] = 200
+
+	for _, tc := range []struct {
+		name  string
+		key   []byte
+		value []byte
+	}{
+		{"present key", zeroKeyTest, testValue},
+		{"absent key in an empty half", absentInEmptyHalf, nil},
+		{"absent stem", fourtyKeyTest, nil},
+	} {
+		value, vp, statediff, err := GetWithProof(root, tc.key, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(value, tc.value) {
+			t.Fatalf("%s: invalid value, got %x, expected %x", tc.name, value, tc.value)
+		}
+		if len(statediff) != 1 || len(statediff[0].SuffixDiffs) != 1 {
+			t.Fatalf("%s: invalid state diff %v", tc.name, statediff)
+		}
+		if current := statediff[0].SuffixDiffs[0].CurrentValue; (current == nil) != (tc.value == nil) || (current != nil && !bytes.Equal(current[:], tc.value)) {
+			t.Fatalf("%s: invalid proven value %x", tc.name, current)
+		}
+		rootBytes := root.Commitment().Bytes()
+		if err := Verify(vp, rootBytes[:], rootBytes[:], statediff); err != nil {
+			t.Fatalf("%s: proof doesn't verify: %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerifyVerkleProofWithValues(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest} {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+	proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{zeroKeyTest, oneKeyTest, fourtyKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droot, err := PreStateTreeFromProof(proof, rootC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string][]byte{
+		string(zeroKeyTest):   zeroKeyTest,
+		string(fourtyKeyTest): nil,
+	}
+	for _, tree := range []VerkleNode{root, droot} {
+		if err := VerifyVerkleProofWithValues(proof, tree, valid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		expected map[string][]byte
+		err      error
+	}{
+		{"wrong value", map[string][]byte{string(oneKeyTest): zeroKeyTest}, errUnexpectedProofValue},
+		{"absent key claimed present", map[string][]byte{string(fourtyKeyTest): testValue}, errUnexpectedProofValue},
+		{"present key claimed absent", map[string][]byte{string(zeroKeyTest): nil}, errUnexpectedProofValue},
+		{"key not covered", map[string][]byte{string(ffx32KeyTest): nil}, nil},
+	} {
+		err := VerifyVerkleProofWithValues(proof, droot, tc.expected)
+		if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+			t.Fatalf("%s: invalid error, got %v, expected %v", tc.name, err, tc.err)
+		}
+	}
+
+	// The values carried by the proof must be the ones it proves.
+	proof.PreValues[0] = testValue
+	if err := VerifyVerkleProofWithValues(proof, root, nil); !errors.Is(err, errUnexpectedProofValue) {
+		t.Fatalf("invalid error for a proof carrying a wrong value, got %v", err)
+	}
+}
+
+func TestProofWithLabel(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	rootBytes := root.Commitment().Bytes()
+
+	proof, _, _, _, err := MakeVerkleMultiProofWithLabel(root, nil, [][]byte{zeroKeyTest, fourtyKeyTest}, nil, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyWithLabel(vp, rootBytes[:], rootBytes[:], statediff, "A"); err != nil {
+		t.Fatalf("proof doesn't verify with its label: %v", err)
+	}
+	if err := VerifyWithLabel(vp, rootBytes[:], rootBytes[:], statediff, "B"); err == nil {
+		t.Fatal("proof verifies with another label")
+	}
+	if err := Verify(vp, rootBytes[:], rootBytes[:], statediff); err == nil {
+		t.Fatal("proof verifies with the default label")
+	}
+}
+
+func TestProveAbsent(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// An absent stem in an empty child, an absent stem in the
+	// child of another leaf, and a missing suffix of a present stem.
+	absentSuffix := append([]byte{}, zeroKeyTest...)
+	absentSuffix[StemSize] = 200
+	proof, err := ProveAbsent(root, [][]byte{fourtyKeyTest, forkOneKeyTest, absentSuffix}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyVerkleProofWithPreState(proof, root); err != nil {
+		t.Fatalf("proof of absence doesn't verify: %v", err)
+	}
+
+	if _, err := ProveAbsent(root, [][]byte{fourtyKeyTest, zeroKeyTest}, nil); err == nil {
+		t.Fatal("expected an error when proving the absence of a present key")
+	}
+}
+
+func BenchmarkProveAbsent(b *testing.B) {
+	root := New()
+	keys := make([][]byte, 10_000)
+	for i := range keys {
+		keys[i] = make([]byte, KeySize)
+		if _, err := rand.Read(keys[i]); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(keys[i], testValue, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	absent := make([][]byte, 100)
+	for i := range absent {
+		absent[i] = make([]byte, KeySize)
+		if _, err := rand.Read(absent[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("MakeVerkleMultiProof", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, _, _, err := MakeVerkleMultiProof(root, nil, absent, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ProveAbsent", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ProveAbsent(root, absent, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestBatchVerifyVerkleProofs(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	var (
+		proofs  []*Proof
+		css     [][]*Point
+		indices [][]uint8
+		ys      [][]*Fr
+	)
+	for _, keys := range [][][]byte{{zeroKeyTest}, {oneKeyTest, ffx32KeyTest}, {fourtyKeyTest}, {ffx32KeyTest}} {
+		proof, cis, zis, yis, err := MakeVerkleMultiProof(root, nil, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs = append(proofs, proof)
+		css = append(css, cis)
+		indices = append(indices, zis)
+		ys = append(ys, yis)
+	}
+
+	// Corrupt an evaluation of the second proof, and check the
+	// fourth one against the commitments of the third one.
+	var wrong Fr
+	wrong.SetUint64(42)
+	ys[1] = append([]*Fr{&wrong}, ys[1][1:]...)
+	css[3] = css[2]
+
+	results, err := BatchVerifyVerkleProofs(proofs, css, indices, ys, GetConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []bool{true, false, true, false}; !reflect.DeepEqual(results, expected) {
+		t.Fatalf("invalid results, got %v, expected %v", results, expected)
+	}
+
+	if _, err := BatchVerifyVerkleProofs(proofs, css[:2], indices, ys, GetConfig()); err == nil {
+		t.Fatal("expected an error with mismatched input lengths")
+	}
+}
+
+func TestLeafProofCache(t *testing.T) {
+	t.Parallel()
+
+	highKey, _ := JoinKey(KeyToStem(zeroKeyTest), 200)
+	cached, uncached := New(), New()
+	for _, root := range []VerkleNode{cached, uncached} {
+		for _, key := range [][]byte{zeroKeyTest, oneKeyTest, highKey, fourtyKeyTest} {
+			if err := root.Insert(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	leaf := cached.(*InternalNode).children[0].(*LeafNode)
+	leaf.EnableProofCache()
+
+	proofBytes := func(root VerkleNode) []byte {
+		t.Helper()
+		root.Commit()
+		proof, _, _, _, err := MakeVerkleMultiProof(root, nil, [][]byte{zeroKeyTest, highKey, forkOneKeyTest}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vp, _, err := SerializeProof(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized, err := vp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serialized
+	}
+
+	// The second proof is built from the cache.
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(proofBytes(cached), proofBytes(uncached)) {
+			t.Fatalf("proof #%d differs when the cache is enabled", i)
+		}
+	}
+	if !leaf.proofCache.valid || leaf.proofCache.suffPolys[0] == nil || leaf.proofCache.suffPolys[1] == nil {
+		t.Fatal("the leaf polynomials weren't cached")
+	}
+
+	// Writing to the leaf invalidates the cache.
+	newValue := bytes.Repeat([]byte{0x42}, 32)
+	for _, root := range []VerkleNode{cached, uncached} {
+		if err := root.Insert(highKey, newValue, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := root.Delete(oneKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if leaf.proofCache.valid {
+		t.Fatal("the cache wasn't invalidated by a write")
+	}
+	if !bytes.Equal(proofBytes(cached), proofBytes(uncached)) {
+		t.Fatal("proof differs after writing to a leaf with a cache")
+	}
+}
+
+func BenchmarkLeafProofCache(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%v", enabled), func(b *testing.B) {
+			root := New()
+			keys := make([][]byte, 0, 64)
+			for i := 0; i < 64; i++ {
+				key, _ := JoinKey(KeyToStem(zeroKeyTest), byte(i*4))
+				keys = append(keys, key)
+				if err := root.Insert(key, testValue, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			root.Commit()
+			leaf := root.(*InternalNode).children[0].(*LeafNode)
+			if enabled {
+				leaf.EnableProofCache()
+			}
+
+			b.Run("MakeVerkleMultiProof", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, _, _, _, err := MakeVerkleMultiProof(root, nil, keys[:4], nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("GetProofItems", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, _, _, err := leaf.GetProofItems(keys[:4], nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestProofEstimatedSerializedSize(t *testing.T) {
+	t.Parallel()
+
+	serializedSize := func(vp *VerkleProof, statediff StateDiff) int {
+		size := len(vp.OtherStems)*StemSize + len(vp.DepthExtensionPresent) + len(vp.CommitmentsByPath)*32 + len(vp.D)
+		size += len(vp.IPAProof.CL)*32 + len(vp.IPAProof.CR)*32 + len(vp.IPAProof.FinalEvaluation)
+		for _, stemdiff := range statediff {
+			size += len(stemdiff.Stem)
+			for _, suffixdiff := range stemdiff.SuffixDiffs {
+				size++
+				if suffixdiff.CurrentValue != nil {
+					size += len(suffixdiff.CurrentValue)
+				}
+				if suffixdiff.NewValue != nil {
+					size += len(suffixdiff.NewValue)
+				}
+			}
+		}
+		return size
+	}
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	postroot := root.Copy()
+	if err := postroot.Insert(fourtyKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := postroot.Insert(zeroKeyTest, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	postroot.Commit()
+
+	for _, tc := range []struct {
+		name     string
+		postroot VerkleNode
+		keys     [][]byte
+	}{
+		{"single present key", nil, [][]byte{zeroKeyTest}},
+		{"keys sharing a stem", nil, [][]byte{zeroKeyTest, oneKeyTest}},
+		{"absent stems", nil, [][]byte{fourtyKeyTest, forkOneKeyTest}},
+		{"mixed", nil, [][]byte{zeroKeyTest, fourtyKeyTest, ffx32KeyTest}},
+		{"with post values", postroot, [][]byte{zeroKeyTest, oneKeyTest, fourtyKeyTest}},
+	} {
+		proof, _, _, _, err := MakeVerkleMultiProof(root, tc.postroot, tc.keys, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		vp, statediff, err := SerializeProof(proof)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if estimated, actual := proof.EstimatedSerializedSize(), serializedSize(vp, statediff); estimated != actual {
+			t.Fatalf("%s: invalid estimated size, got %d, expected %d", tc.name, estimated, actual)
+		}
+	}
+}
+
+func TestPostStateTreeFromStateDiffClearedValue(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// Clear a value that was present before, by writing zeros.
+	postroot := root.Copy()
+	if err := postroot.Insert(oneKeyTest, make([]byte, LeafValueSize), nil); err != nil {
+		t.Fatal(err)
+	}
+	postroot.Commit()
+
+	proof, _, _, _, err := MakeVerkleMultiProof(root, postroot, [][]byte{zeroKeyTest, oneKeyTest}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, statediff, err := SerializeProof(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := statediff[0].SuffixDiffs; diff[0].NewValue != nil || diff[1].NewValue == nil || *diff[1].NewValue != [32]byte{} {
+		t.Fatalf("invalid new values for an untouched and a cleared suffix: %v %v", diff[0].NewValue, diff[1].NewValue)
+	}
+
+	preBytes, postBytes := root.Commitment().Bytes(), postroot.Commitment().Bytes()
+	if err := Verify(vp, preBytes[:], postBytes[:], statediff); err != nil {
+		t.Fatalf("post-state root with a cleared value doesn't match: %v", err)
+	}
+
+	// A value removed with Delete can't be told apart from an
+	// untouched one in a state diff, so it is rejected.
+	deleted := root.Copy()
+	if _, err := deleted.Delete(oneKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	deleted.Commit()
+	if _, _, _, _, err := MakeVerkleMultiProof(root, deleted, [][]byte{oneKeyTest}, nil); err == nil {
+		t.Fatal("expected an error with a value deleted from the post-state tree")
+	}
+}
+
+func TestMergeProofs(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootC := root.Commit()
+
+	prove := func(keys ...[]byte) *Proof {
+		proof, _, _, _, err := MakeVerkleMultiProof(root, nil, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+	absentInC2 := append([]byte{}, oneKeyTest...)
+	absentInC2[StemSize] = 200
+
+	for _, tc := range []struct {
+		name string
+		a, b [][]byte
+	}{
+		{"single keys", [][]byte{zeroKeyTest}, [][]byte{ffx32KeyTest}},
+		{"same stem, both halves", [][]byte{oneKeyTest}, [][]byte{absentInC2}},
+		{"absent and present stems", [][]byte{fourtyKeyTest}, [][]byte{zeroKeyTest, forkOneKeyTest}},
+		{"shared key", [][]byte{zeroKeyTest, ffx32KeyTest}, [][]byte{ffx32KeyTest}},
+	} {
+		merged, err := MergeProofs(prove(tc.a...), prove(tc.b...))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var all [][]byte
+		for _, key := range append(append([][]byte{}, tc.a...), tc.b...) {
+			if !slices.ContainsFunc(all, func(k []byte) bool { return bytes.Equal(k, key) }) {
+				all = append(all, key)
+			}
+		}
+		expected := prove(all...)
+		if !reflect.DeepEqual(merged.Keys, expected.Keys) || !bytes.Equal(merged.ExtStatus, expected.ExtStatus) || !reflect.DeepEqual(merged.PoaStems, expected.PoaStems) {
+			t.Fatalf("%s: merged proof differs from a proof of all the keys", tc.name)
+		}
+		if len(merged.Cs) != len(expected.Cs) {
+			t.Fatalf("%s: invalid number of commitments, got %d, expected %d", tc.name, len(merged.Cs), len(expected.Cs))
+		}
+		for i := range merged.Cs {
+			if !merged.Cs[i].Equal(expected.Cs[i]) {
+				t.Fatalf("%s: commitment #%d differs", tc.name, i)
+			}
+		}
+
+		pretree, err := PreStateTreeFromProof(merged, rootC)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for i, key := range merged.Keys {
+			value, err := pretree.Get(key, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if !bytes.Equal(value, merged.PreValues[i]) {
+				t.Fatalf("%s: invalid value for key %x in the rebuilt tree, got %x, expected %x", tc.name, key, value, merged.PreValues[i])
+			}
+		}
+	}
+
+	// Proofs that disagree on the value of a shared key can't be merged.
+	a, b := prove(zeroKeyTest), prove(zeroKeyTest)
+	b.PreValues[0] = fourtyKeyTest
+	if _, err := MergeProofs(a, b); err == nil {
+		t.Fatal("expected an error when merging proofs that disagree on a value")
+	}
+
+	// Proofs with a missing value are rejected instead of panicking.
+	a, b = prove(zeroKeyTest, ffx32KeyTest), prove(zeroKeyTest)
+	a.PostValues = a.PostValues[:1]
+	if _, err := MergeProofs(a, b); err == nil {
+		t.Fatal("expected an error when merging a malformed proof")
+	}
+	a = prove(zeroKeyTest, ffx32KeyTest)
+	a.PreValues = a.PreValues[:1]
+	if _, err := MergeProofs(b, a); err == nil {
+		t.Fatal("expected an error when merging a malformed proof")
+	}
+}
@@ -0,0 +1,220 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// snapshotLengthSize is the size of the length prefix of each node in a
+// snapshot.
+const snapshotLengthSize = 4
+
+// SerializeTo writes all the resolved nodes of the tree to w, each one as
+// a 4-byte big-endian length followed by its serialization. It returns an
+// index of the offset at which each node starts, by path, which can be
+// passed to OpenLazyTree along with the written blob.
+func (n *InternalNode) SerializeTo(w io.Writer) (map[string]int64, error) {
+	nodes, err := n.BatchSerialize()
+	if err != nil {
+		return nil, fmt.Errorf("serializing tree: %w", err)
+	}
+
+	var (
+		index  = make(map[string]int64, len(nodes))
+		offset int64
+		length [snapshotLengthSize]byte
+	)
+	for _, node := range nodes {
+		binary.BigEndian.PutUint32(length[:], uint32(len(node.SerializedBytes)))
+		if _, err := w.Write(length[:]); err != nil {
+			return nil, fmt.Errorf("writing node at path %x: %w", node.Path, err)
+		}
+		if _, err := w.Write(node.SerializedBytes); err != nil {
+			return nil, fmt.Errorf("writing node at path %x: %w", node.Path, err)
+		}
+		index[string(node.Path)] = offset
+		offset += snapshotLengthSize + int64(len(node.SerializedBytes))
+	}
+	return index, nil
+}
+
+// OpenLazyTree opens a tree written by SerializeTo. Only the root node is
+// read, and its children are hashed nodes. The returned resolver reads the
+// other nodes from r when they are needed, at the offsets given by index.
+func OpenLazyTree(r io.ReaderAt, index map[string]int64) (VerkleNode, NodeResolverFn, error) {
+	resolver := func(path []byte) ([]byte, error) {
+		offset, ok := index[string(path)]
+		if !ok {
+			return nil, fmt.Errorf("resolving path %x: %w", path, errNotInSnapshot)
+		}
+		var length [snapshotLengthSize]byte
+		if _, err := r.ReadAt(length[:], offset); err != nil {
+			return nil, fmt.Errorf("reading length of node at path %x: %w", path, err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxSerializedNodeSize {
+			return nil, fmt.Errorf("node at path %x has an invalid length %d, at most %d", path, size, maxSerializedNodeSize)
+		}
+		serialized := make([]byte, size)
+		if _, err := r.ReadAt(serialized, offset+snapshotLengthSize); err != nil {
+			return nil, fmt.Errorf("reading node at path %x: %w", path, err)
+		}
+		return serialized, nil
+	}
+
+	serialized, err := resolver(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := ParseNode(serialized, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing root node: %w", err)
+	}
+	return root, resolver, nil
+}
+
+// SerializeToWriter commits the tree, and writes its nodes to w in
+// depth-first order, each one as its 32-byte commitment followed by a 4-byte
+// big-endian length and its serialization. Only one node is serialized at a
+// time, so that the memory usage doesn't grow with the size of the tree. All
+// the nodes must be resolved.
+func (n *InternalNode) SerializeToWriter(w io.Writer) error {
+	n.Commit()
+	return n.serializeToWriter(nil, w)
+}
+
+func (n *InternalNode) serializeToWriter(path []byte, w io.Writer) error {
+	if err := writeStreamedNode(path, n, w); err != nil {
+		return err
+	}
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case Empty:
+		case *InternalNode:
+			if err := child.serializeToWriter(childPath(path, byte(i)), w); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if err := writeStreamedNode(childPath(path, byte(i)), child, w); err != nil {
+				return err
+			}
+		case HashedNode:
+			return fmt.Errorf("serializing node at path %x: %w", childPath(path, byte(i)), errSerializeHashedNode)
+		default:
+			return fmt.Errorf("serializing node at path %x: %w %T", childPath(path, byte(i)), errUnknownNodeType, child)
+		}
+	}
+	return nil
+}
+
+// writeStreamedNode writes the commitment, length and serialization of a
+// single node to w.
+func writeStreamedNode(path []byte, node VerkleNode, w io.Writer) error {
+	serialized, err := node.Serialize()
+	if err != nil {
+		return fmt.Errorf("serializing node at path %x: %w", path, err)
+	}
+	var header [32 + snapshotLengthSize]byte
+	comm := node.Commitment().Bytes()
+	copy(header[:], comm[:])
+	binary.BigEndian.PutUint32(header[32:], uint32(len(serialized)))
+	if _, err := w.Write(header[:]); err != nil {
+		return fmt.Errorf("writing node at path %x: %w", path, err)
+	}
+	if _, err := w.Write(serialized); err != nil {
+		return fmt.Errorf("writing node at path %x: %w", path, err)
+	}
+	return nil
+}
+
+// ParseTreeFromReader reads a tree written by SerializeToWriter. If full is
+// true, the whole tree is read and parsed. Otherwise only the root node is
+// read, and its children are left as hashed nodes.
+func ParseTreeFromReader(r io.Reader, full bool) (VerkleNode, error) {
+	root, err := readStreamedNode(nil, r)
+	if err != nil {
+		return nil, err
+	}
+	if full {
+		if err := readStreamedChildren(nil, root, r); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+// readStreamedChildren reads the children of node, and recursively theirs,
+// in the order in which they were written by SerializeToWriter.
+func readStreamedChildren(path []byte, node VerkleNode, r io.Reader) error {
+	internal, ok := node.(*InternalNode)
+	if !ok {
+		return nil
+	}
+	for i, child := range internal.children {
+		if _, ok := child.(HashedNode); !ok {
+			continue
+		}
+		childpath := childPath(path, byte(i))
+		resolved, err := readStreamedNode(childpath, r)
+		if err != nil {
+			return err
+		}
+		if err := readStreamedChildren(childpath, resolved, r); err != nil {
+			return err
+		}
+		internal.children[i] = resolved
+	}
+	return nil
+}
+
+// readStreamedNode reads a single node from r, and checks that its
+// commitment matches the one it was written with.
+func readStreamedNode(path []byte, r io.Reader) (VerkleNode, error) {
+	var header [32 + snapshotLengthSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading node at path %x: %w", path, err)
+	}
+	length := binary.BigEndian.Uint32(header[32:])
+	if length > maxSerializedNodeSize {
+		return nil, fmt.Errorf("node at path %x has an invalid length %d, at most %d", path, length, maxSerializedNodeSize)
+	}
+	serialized := make([]byte, length)
+	if _, err := io.ReadFull(r, serialized); err != nil {
+		return nil, fmt.Errorf("reading node at path %x: %w", path, err)
+	}
+	node, err := ParseNode(serialized, byte(len(path)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing node at path %x: %w", path, err)
+	}
+	if comm := node.Commitment().Bytes(); !bytes.Equal(comm[:], header[:32]) {
+		return nil, fmt.Errorf("node at path %x doesn't match its commitment %x", path, header[:32])
+	}
+	return node, nil
+}
@@ -0,0 +1,153 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOpenLazyTree(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var blob bytes.Buffer
+	index, err := root.SerializeTo(&blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lazy, resolver, err := OpenLazyTree(bytes.NewReader(blob.Bytes()), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lazy.Commitment().Equal(root.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", lazy.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+	for _, child := range lazy.(*InternalNode).children {
+		if _, ok := child.(*LeafNode); ok {
+			t.Fatal("lazily-opened tree has a resolved child")
+		}
+	}
+
+	recorder, recorded := RecordingResolver(resolver)
+	for _, key := range keys {
+		value, err := lazy.Get(key, recorder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, key) {
+			t.Fatalf("invalid value for key %x, got %x", key, value)
+		}
+	}
+	if len(recorded()) == 0 {
+		t.Fatal("no node was read from the snapshot")
+	}
+
+	if _, err := resolver([]byte{1, 2, 3}); !errors.Is(err, errNotInSnapshot) {
+		t.Fatalf("invalid error for a missing node, got %v, expected %v", err, errNotInSnapshot)
+	}
+
+	// The length prefix is checked before allocating the node.
+	corrupted := bytes.Clone(blob.Bytes())
+	copy(corrupted[index[""]:], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, _, err := OpenLazyTree(bytes.NewReader(corrupted), index); err == nil || !strings.Contains(err.Error(), "invalid length") {
+		t.Fatalf("expected an error with an invalid length, got %v", err)
+	}
+}
+
+func TestSerializeToWriter(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 10_000)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stream bytes.Buffer
+	if err := root.SerializeToWriter(&stream); err != nil {
+		t.Fatal(err)
+	}
+	encoded := stream.Bytes()
+
+	parsed, err := ParseTreeFromReader(bytes.NewReader(encoded), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Commit().Equal(root.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", parsed.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+	for _, key := range keys[:100] {
+		value, err := parsed.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, key) {
+			t.Fatalf("invalid value for key %x, got %x", key, value)
+		}
+	}
+
+	rootOnly, err := ParseTreeFromReader(bytes.NewReader(encoded), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootOnly.Commitment().Equal(root.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", rootOnly.Commitment().Bytes(), root.Commitment().Bytes())
+	}
+	for _, child := range rootOnly.(*InternalNode).children {
+		if _, ok := child.(*LeafNode); ok {
+			t.Fatal("root-only tree has a resolved child")
+		}
+	}
+
+	if _, err := ParseTreeFromReader(bytes.NewReader(encoded[:len(encoded)-1]), true); err == nil {
+		t.Fatal("expected an error with a truncated stream")
+	}
+	// The length prefix is checked before allocating the node.
+	corrupted := bytes.Clone(encoded)
+	copy(corrupted[32:32+snapshotLengthSize], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := ParseTreeFromReader(bytes.NewReader(corrupted), true); err == nil || !strings.Contains(err.Error(), "invalid length") {
+		t.Fatalf("expected an error with an invalid length, got %v", err)
+	}
+
+	// Unresolved nodes can't be streamed.
+	flushToResolver(t, root)
+	if err := root.SerializeToWriter(&stream); !errors.Is(err, errSerializeHashedNode) {
+		t.Fatalf("invalid error with a hashed node, got %v, expected %v", err, errSerializeHashedNode)
+	}
+}
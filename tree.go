@@ -31,17 +31,126 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"runtime"
+	"slices"
+	"sort"
 	"sync"
+	"unsafe"
 
 	"github.com/crate-crypto/go-ipa/banderwagon"
 )
 
 type (
-	NodeFlushFn    func([]byte, VerkleNode)
+	NodeFlushFn func([]byte, VerkleNode)
+
+	// NodeResolverFn returns the serialized node found at a path, i.e.
+	// the list of child indices leading to it from the root. This is the
+	// same path that NodeFlushFn receives, so nodes can be stored and
+	// looked up by path. Hashed nodes don't carry their commitment, so
+	// it can't be used as a key.
 	NodeResolverFn func([]byte) ([]byte, error)
+
+	// BatchNodeResolverFn resolves several paths at once. It returns the
+	// serialized nodes in the same order as the paths, with a nil entry
+	// for each path that doesn't correspond to a node.
+	BatchNodeResolverFn func([][]byte) ([][]byte, error)
 )
 
+// ErroringResolver returns a resolver that fails every resolution with
+// an error containing msg and the requested path. It can be passed instead
+// of a nil resolver, to get some context when an unexpected hashed node is
+// encountered.
+func ErroringResolver(msg string) NodeResolverFn {
+	return func(path []byte) ([]byte, error) {
+		return nil, fmt.Errorf("%s: unexpected resolution of path %x", msg, path)
+	}
+}
+
+// RecordingResolver wraps a resolver, and records the paths that it is asked
+// to resolve. The returned function gives the paths requested so far, in the
+// order of the requests, which can be used to design prefetching heuristics.
+// Resolvers only receive paths, so these are recorded instead of the
+// commitments of the resolved nodes.
+func RecordingResolver(backing NodeResolverFn) (NodeResolverFn, func() [][]byte) {
+	var (
+		lock  sync.Mutex
+		paths [][]byte
+	)
+	resolver := func(path []byte) ([]byte, error) {
+		lock.Lock()
+		paths = append(paths, append([]byte{}, path...))
+		lock.Unlock()
+		return backing(path)
+	}
+	recorded := func() [][]byte {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]byte{}, paths...)
+	}
+	return resolver, recorded
+}
+
+// ResolverCache memoizes the nodes returned by a resolver. Resolvers only
+// receive paths, so nodes are cached by path: a cache must not outlive the
+// version of the tree it was used with, e.g. it should be dropped once the
+// tree is committed and flushed. Errors aren't cached. A ResolverCache is
+// safe for concurrent use.
+type ResolverCache struct {
+	backing NodeResolverFn
+
+	lock         sync.Mutex
+	nodes        map[string][]byte
+	hits, misses int
+}
+
+// NewResolverCache creates a cache in front of backing.
+func NewResolverCache(backing NodeResolverFn) *ResolverCache {
+	return &ResolverCache{
+		backing: backing,
+		nodes:   make(map[string][]byte),
+	}
+}
+
+// Resolve returns the cached node at path, or resolves it with the
+// backing resolver on the first request. It is a NodeResolverFn.
+func (rc *ResolverCache) Resolve(path []byte) ([]byte, error) {
+	rc.lock.Lock()
+	serialized, ok := rc.nodes[string(path)]
+	if ok {
+		rc.hits++
+	} else {
+		rc.misses++
+	}
+	rc.lock.Unlock()
+	if ok {
+		return serialized, nil
+	}
+
+	serialized, err := rc.backing(path)
+	if err != nil {
+		return nil, err
+	}
+	rc.lock.Lock()
+	rc.nodes[string(path)] = serialized
+	rc.lock.Unlock()
+	return serialized, nil
+}
+
+// Stats returns the number of requests that were served from the cache,
+// and the number of those that were passed to the backing resolver.
+func (rc *ResolverCache) Stats() (hits, misses int) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.hits, rc.misses
+}
+
+// CachingResolver wraps a resolver with a ResolverCache.
+func CachingResolver(backing NodeResolverFn) NodeResolverFn {
+	return NewResolverCache(backing).Resolve
+}
+
 type keylist [][]byte
 
 func (kl keylist) Len() int {
@@ -65,6 +174,47 @@ func KeyToStem(key []byte) Stem {
 	return Stem(key[:StemSize])
 }
 
+// SplitKey returns the stem and the suffix of a key.
+func SplitKey(key []byte) ([]byte, byte, error) {
+	if len(key) != KeySize {
+		return nil, 0, fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	return key[:StemSize], key[StemSize], nil
+}
+
+// JoinKey builds the key made of a stem and a suffix.
+func JoinKey(stem []byte, suffix byte) ([]byte, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d, expected %d", len(stem), StemSize)
+	}
+	key := make([]byte, KeySize)
+	copy(key, stem)
+	key[StemSize] = suffix
+	return key, nil
+}
+
+// DeepestCommonPrefix returns the longest prefix shared by all the keys,
+// capped at StemSize bytes. Keys that share a prefix of length d are found
+// under the same internal node at depth d, so their proofs share the
+// commitments along that path.
+func DeepestCommonPrefix(keys [][]byte) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefix := keys[0]
+	if len(prefix) > StemSize {
+		prefix = prefix[:StemSize]
+	}
+	for _, key := range keys[1:] {
+		i := 0
+		for i < len(prefix) && i < len(key) && prefix[i] == key[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return append([]byte{}, prefix...)
+}
+
 type VerkleNode interface {
 	// Insert or Update value into the tree
 	Insert([]byte, []byte, NodeResolverFn) error
@@ -72,6 +222,13 @@ type VerkleNode interface {
 	// Delete a leaf with the given key
 	Delete([]byte, NodeResolverFn) (bool, error)
 
+	// InsertValuesAtStem inserts a full group of values at a stem
+	InsertValuesAtStem(Stem, [][]byte, NodeResolverFn) error
+
+	// DeleteAtStem deletes the leaf at the given stem, and
+	// errors out if it doesn't exist
+	DeleteAtStem([]byte, NodeResolverFn) (bool, error)
+
 	// Get value at a given key
 	Get([]byte, NodeResolverFn) ([]byte, error)
 
@@ -98,6 +255,10 @@ type VerkleNode interface {
 	// Copy a node and its children
 	Copy() VerkleNode
 
+	// Size returns an estimate of the memory used by the node
+	// and its children, in bytes.
+	Size() int
+
 	// toDot returns a string representing this subtree in DOT language
 	toDot(string, string) string
 
@@ -115,6 +276,10 @@ type ProofElements struct {
 
 	// dedups flags the presence of each (Ci,zi) tuple
 	dedups map[*Point]map[byte]struct{}
+
+	// naiveCs is the number of commitments, excluding the root, that the
+	// proofs of each key would contain if they were made separately.
+	naiveCs int
 }
 
 // Merge merges the elements of two proofs and removes duplicates.
@@ -154,6 +319,8 @@ func (pe *ProofElements) Merge(other *ProofElements) {
 		}
 	}
 
+	pe.naiveCs += other.naiveCs
+
 	for path, C := range other.ByPath {
 		if _, ok := pe.ByPath[path]; !ok {
 			pe.ByPath[path] = C
@@ -166,10 +333,11 @@ func (pe *ProofElements) Merge(other *ProofElements) {
 const (
 	// These types will distinguish internal
 	// and leaf nodes when decoding from RLP.
-	internalType   byte = 1
-	leafType       byte = 2
-	eoAccountType  byte = 3
-	singleSlotType byte = 4
+	internalType          byte = 1
+	leafType              byte = 2
+	eoAccountType         byte = 3
+	singleSlotType        byte = 4
+	leafZeroCollapsedType byte = 5
 )
 
 type (
@@ -185,6 +353,10 @@ type (
 		commitment *Point
 
 		cow map[byte]*Point
+
+		// journal records the nodes modified since the last call to
+		// CommitAndSnapshotRoot, it is nil if no snapshot is active.
+		journal *treeJournal
 	}
 
 	LeafNode struct {
@@ -200,6 +372,23 @@ type (
 		// for a steam that isn't present in the tree. This flag is only
 		// true in the context of a stateless tree.
 		isPOAStub bool
+
+		// proofCache holds the polynomials used by GetProofItems, it
+		// is nil unless enabled with EnableProofCache.
+		proofCache *leafProofCache
+	}
+
+	// leafProofCache memoizes the polynomials of a leaf that go into
+	// its proofs. It is reset each time the leaf is written to.
+	leafProofCache struct {
+		lock sync.Mutex
+
+		valid bool
+		top   [4]Fr // 1, stem, C1 and C2 mapped to scalars
+
+		// suffPolys holds the C1 and C2 polynomials, they are
+		// filled when a proof first needs them.
+		suffPolys [2]*[NodeWidth]Fr
 	}
 )
 
@@ -267,14 +456,95 @@ func NewStatelessInternal(depth byte, comm *Point) VerkleNode {
 
 // New creates a new leaf node
 func NewLeafNode(stem Stem, values [][]byte) (*LeafNode, error) {
+	var c1poly, c2poly, poly [NodeWidth]Fr
+	return newLeafNode(stem, values, &c1poly, &c2poly, &poly)
+}
+
+// LeafBuilder creates leaf nodes, reusing the same polynomial scratch
+// space for each of them. It is meant to be used in tight loops that
+// create a lot of leaves, like the conversion. A LeafBuilder must not
+// be used concurrently.
+type LeafBuilder struct {
+	c1poly, c2poly, poly [NodeWidth]Fr
+}
+
+// Build creates a new leaf node, like NewLeafNode would.
+func (lb *LeafBuilder) Build(stem Stem, values [][]byte) (*LeafNode, error) {
+	lb.c1poly = [NodeWidth]Fr{}
+	lb.c2poly = [NodeWidth]Fr{}
+	lb.poly = [NodeWidth]Fr{}
+	return newLeafNode(stem, values, &lb.c1poly, &lb.c2poly, &lb.poly)
+}
+
+// newLeafNode creates a leaf node, using the provided polynomials
+// as scratch space. They are expected to be zeroed.
+func newLeafNode(stem Stem, values [][]byte, c1poly, c2poly, poly *[NodeWidth]Fr) (*LeafNode, error) {
+	stem = stem[:StemSize] // enforce a 31-byte length
+	commitment, c1, c2, err := leafCommitments(stem, values, c1poly, c2poly, poly)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LeafNode{
+		// depth will be 0, but the commitment calculation
+		// does not need it, and so it won't be free.
+		values:     values,
+		stem:       stem,
+		commitment: commitment,
+		c1:         c1,
+		c2:         c2,
+	}, nil
+}
+
+// ImportLeafNode creates a leaf node at the given depth, computing its
+// commitments. It is the inverse of LeafNode.Export, and copies the stem
+// and the values slice so that the caller can keep using them. Proof of
+// absence stubs are exported with nil values, and can't be imported back.
+func ImportLeafNode(stem []byte, values [][]byte, depth byte) (*LeafNode, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d, expected %d", len(stem), StemSize)
+	}
+	if values == nil {
+		return nil, errors.New("no values to import, proof of absence stubs can't be imported")
+	}
+	if len(values) != NodeWidth {
+		return nil, fmt.Errorf("invalid number of values %d, expected %d", len(values), NodeWidth)
+	}
+	if depth > StemSize {
+		return nil, fmt.Errorf("invalid leaf depth %d", depth)
+	}
+	leaf, err := NewLeafNode(bytes.Clone(stem), slices.Clone(values))
+	if err != nil {
+		return nil, err
+	}
+	leaf.setDepth(depth)
+	return leaf, nil
+}
+
+// StemCommitment returns the commitment of the leaf that would hold values
+// at stem, without creating the leaf.
+func StemCommitment(stem []byte, values [][]byte) (*Point, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d, expected %d", len(stem), StemSize)
+	}
+	if len(values) != NodeWidth {
+		return nil, fmt.Errorf("invalid number of values %d, expected %d", len(values), NodeWidth)
+	}
+	var c1poly, c2poly, poly [NodeWidth]Fr
+	commitment, _, _, err := leafCommitments(stem, values, &c1poly, &c2poly, &poly)
+	return commitment, err
+}
+
+// leafCommitments computes the C1 and C2 commitments of the values of a
+// leaf, and the commitment to [1, stem, C1, C2], using the provided
+// polynomials as scratch space. They are expected to be zeroed.
+func leafCommitments(stem []byte, values [][]byte, c1poly, c2poly, poly *[NodeWidth]Fr) (commitment, c1, c2 *Point, err error) {
 	cfg := GetConfig()
 
 	// C1.
-	var c1poly [NodeWidth]Fr
-	var c1 *Point
 	count, err := fillSuffixTreePoly(c1poly[:], values[:NodeWidth/2])
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	containsEmptyCodeHash := c1poly[EmptyCodeHashFirstHalfIdx].Equal(&EmptyCodeHashFirstHalfValue) &&
 		c1poly[EmptyCodeHashSecondHalfIdx].Equal(&EmptyCodeHashSecondHalfValue)
@@ -291,33 +561,22 @@ func NewLeafNode(stem Stem, values [][]byte) (*LeafNode, error) {
 	}
 
 	// C2.
-	var c2poly [NodeWidth]Fr
 	count, err = fillSuffixTreePoly(c2poly[:], values[NodeWidth/2:])
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	c2 := cfg.CommitToPoly(c2poly[:], NodeWidth-count)
+	c2 = cfg.CommitToPoly(c2poly[:], NodeWidth-count)
 
 	// Root commitment preparation for calculation.
-	stem = stem[:StemSize] // enforce a 31-byte length
-	var poly [NodeWidth]Fr
 	poly[0].SetUint64(1)
 	if err := StemFromLEBytes(&poly[1], stem); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	if err := banderwagon.BatchMapToScalarField([]*Fr{&poly[2], &poly[3]}, []*Point{c1, c2}); err != nil {
-		return nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+		return nil, nil, nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
 	}
 
-	return &LeafNode{
-		// depth will be 0, but the commitment calculation
-		// does not need it, and so it won't be free.
-		values:     values,
-		stem:       stem,
-		commitment: cfg.CommitToPoly(poly[:], NodeWidth-4),
-		c1:         c1,
-		c2:         c2,
-	}, nil
+	return cfg.CommitToPoly(poly[:], NodeWidth-4), c1, c2, nil
 }
 
 // NewLeafNodeWithNoComms create a leaf node but does not compute its
@@ -348,6 +607,12 @@ func (n *InternalNode) SetChild(i int, c VerkleNode) error {
 }
 
 func (n *InternalNode) cowChild(index byte) {
+	n.journalChild(index)
+	// A node whose commitment has been dropped is recomputed from
+	// scratch, it doesn't need the previous commitments of its children.
+	if n.commitment == nil {
+		return
+	}
 	if n.cow == nil {
 		n.cow = make(map[byte]*Point)
 	}
@@ -359,17 +624,146 @@ func (n *InternalNode) cowChild(index byte) {
 }
 
 func (n *InternalNode) Insert(key []byte, value []byte, resolver NodeResolverFn) error {
+	// Overwriting a value with itself is a no-op, don't mark the
+	// path as modified so that the commitments aren't recomputed.
+	if n.holdsValue(key, value) {
+		return nil
+	}
+
 	values := make([][]byte, NodeWidth)
 	values[key[StemSize]] = value
 	return n.InsertValuesAtStem(KeyToStem(key), values, resolver)
 }
 
+// InsertWithOld inserts a value in the tree like Insert, and returns the
+// value that was previously stored at key, or nil if there was none. It saves
+// a call to Get to callers that keep a journal of the writes.
+func (n *InternalNode) InsertWithOld(key []byte, value []byte, resolver NodeResolverFn) ([]byte, error) {
+	if n.holdsValue(key, value) {
+		return value, nil
+	}
+
+	values := make([][]byte, NodeWidth)
+	values[key[StemSize]] = value
+	prev := make([][]byte, NodeWidth)
+	if err := n.insertValuesAtStem(KeyToStem(key), values, prev, resolver); err != nil {
+		return nil, err
+	}
+	return prev[key[StemSize]], nil
+}
+
+// InsertIfAbsent inserts value at key only if the tree doesn't already hold
+// a value there, resolving hashed nodes along the path as needed. It returns
+// true if the value was inserted, and false if the tree was left untouched.
+func (n *InternalNode) InsertIfAbsent(key []byte, value []byte, resolver NodeResolverFn) (bool, error) {
+	current, err := n.Get(key, resolver)
+	if err != nil {
+		return false, fmt.Errorf("looking up existing value: %w", err)
+	}
+	if current != nil {
+		return false, nil
+	}
+	if err := n.Insert(key, value, resolver); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertLargeValue writes a value longer than LeafValueSize by splitting it
+// into chunks of LeafValueSize bytes, stored at consecutive suffixes starting
+// at key[StemSize]. The last chunk is right-padded with zeroes. All chunks are
+// written at once, so C1 and C2 are both updated once if the chunks straddle
+// suffix 128. It returns the number of chunks, and fails if they don't all
+// fit in the stem of key. The size of the value isn't stored in the tree,
+// the caller has to keep track of it to read the value with GetLargeValue.
+func InsertLargeValue(root VerkleNode, key, value []byte, resolver NodeResolverFn) (int, error) {
+	if len(key) != KeySize {
+		return 0, fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	if len(value) == 0 {
+		return 0, fmt.Errorf("empty value for key %x", key)
+	}
+	numChunks := (len(value) + LeafValueSize - 1) / LeafValueSize
+	if int(key[StemSize])+numChunks > NodeWidth {
+		return 0, fmt.Errorf("value of %d bytes doesn't fit in %d chunks from suffix %d", len(value), NodeWidth-int(key[StemSize]), key[StemSize])
+	}
+
+	values := make([][]byte, NodeWidth)
+	for i := 0; i < numChunks; i++ {
+		chunk := make([]byte, LeafValueSize)
+		copy(chunk, value[i*LeafValueSize:])
+		values[int(key[StemSize])+i] = chunk
+	}
+	if err := root.InsertValuesAtStem(KeyToStem(key), values, resolver); err != nil {
+		return 0, err
+	}
+	return numChunks, nil
+}
+
+// GetLargeValue reads a value of size bytes written by InsertLargeValue.
+// It fails if any of its chunks is missing.
+func GetLargeValue(root VerkleNode, key []byte, size int, resolver NodeResolverFn) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+	}
+	numChunks := (size + LeafValueSize - 1) / LeafValueSize
+	if size <= 0 || int(key[StemSize])+numChunks > NodeWidth {
+		return nil, fmt.Errorf("invalid size %d for a value at suffix %d", size, key[StemSize])
+	}
+
+	value := make([]byte, 0, numChunks*LeafValueSize)
+	chunkKey := bytes.Clone(key)
+	for i := 0; i < numChunks; i++ {
+		chunkKey[StemSize] = key[StemSize] + byte(i)
+		chunk, err := root.Get(chunkKey, resolver)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return nil, fmt.Errorf("missing chunk %d of the value at key %x", i, key)
+		}
+		value = append(value, chunk...)
+	}
+	if len(value) < size {
+		return nil, fmt.Errorf("value at key %x is %d bytes long, expected %d", key, len(value), size)
+	}
+	return value[:size], nil
+}
+
+// holdsValue returns true if the resolved part of the tree holds value at
+// key. It doesn't resolve hashed nodes, and returns false if one is found
+// along the path.
+func (n *InternalNode) holdsValue(key, value []byte) bool {
+	if value == nil {
+		return false
+	}
+	node := n
+	for {
+		switch child := node.children[offset2key(key, node.depth)].(type) {
+		case *InternalNode:
+			node = child
+		case *LeafNode:
+			return !child.isPOAStub && equalPaths(child.stem, key) && bytes.Equal(child.values[key[StemSize]], value)
+		default:
+			return false
+		}
+	}
+}
+
 func (n *InternalNode) InsertValuesAtStem(stem Stem, values [][]byte, resolver NodeResolverFn) error {
+	return n.insertValuesAtStem(stem, values, nil, resolver)
+}
+
+// insertValuesAtStem implements InsertValuesAtStem. If prev isn't nil, the
+// values previously stored at stem are copied into it before the insertion.
+func (n *InternalNode) insertValuesAtStem(stem Stem, values, prev [][]byte, resolver NodeResolverFn) error {
 	nChild := offset2key(stem, n.depth) // index of the child pointed by the next byte in the key
 
 	switch child := n.children[nChild].(type) {
 	case UnknownNode:
-		return errMissingNodeInStateless
+		// This happens when writing to a tree rebuilt from a proof, at
+		// a stem that the proof doesn't cover.
+		return fmt.Errorf("inserting at stem %x: node at path %x isn't part of the proof the tree was rebuilt from: %w", stem, stem[:n.depth+1], errMissingNodeInStateless)
 	case Empty:
 		n.cowChild(nChild)
 		var err error
@@ -394,7 +788,7 @@ func (n *InternalNode) InsertValuesAtStem(stem Stem, values [][]byte, resolver N
 		n.cowChild(nChild)
 		// recurse to handle the case of a LeafNode child that
 		// splits.
-		return n.InsertValuesAtStem(stem, values, resolver)
+		return n.insertValuesAtStem(stem, values, prev, resolver)
 	case *LeafNode:
 		if equalPaths(child.stem, stem) {
 			// We can't insert any values into a POA leaf node.
@@ -402,6 +796,7 @@ func (n *InternalNode) InsertValuesAtStem(stem Stem, values [][]byte, resolver N
 				return errIsPOAStub
 			}
 			n.cowChild(nChild)
+			copy(prev, child.values)
 			return child.insertMultiple(stem, values)
 		}
 		n.cowChild(nChild)
@@ -418,7 +813,7 @@ func (n *InternalNode) InsertValuesAtStem(stem Stem, values [][]byte, resolver N
 
 		nextWordInInsertedKey := offset2key(stem, n.depth+1)
 		if nextWordInInsertedKey == nextWordInExistingKey {
-			return newBranch.InsertValuesAtStem(stem, values, resolver)
+			return newBranch.insertValuesAtStem(stem, values, prev, resolver)
 		}
 
 		// Next word differs, so this was the last level.
@@ -432,14 +827,65 @@ func (n *InternalNode) InsertValuesAtStem(stem Stem, values [][]byte, resolver N
 		newBranch.children[nextWordInInsertedKey] = leaf
 	case *InternalNode:
 		n.cowChild(nChild)
-		return child.InsertValuesAtStem(stem, values, resolver)
-	default: // It should be an UknownNode.
-		return errUnknownNodeType
+		return child.insertValuesAtStem(stem, values, prev, resolver)
+	default:
+		return fmt.Errorf("inserting at stem %x: %w %T at path %x", stem, errUnknownNodeType, child, stem[:n.depth+1])
 	}
 
 	return nil
 }
 
+// InsertResolving inserts a value in the tree, resolving the hashed nodes
+// found along the way to the key with a single call to batchResolver. Since
+// the depth at which the key's stem lives isn't known before resolving, all
+// the prefixes of the stem below the first hashed node are requested.
+func (n *InternalNode) InsertResolving(key []byte, value []byte, batchResolver BatchNodeResolverFn) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("invalid key size %d", len(key))
+	}
+	stem := KeyToStem(key)
+
+	// Find the first hashed node on the path to the stem, if any.
+	node := n
+	for {
+		child, ok := node.children[offset2key(stem, node.depth)].(*InternalNode)
+		if !ok {
+			break
+		}
+		node = child
+	}
+	if _, ok := node.children[offset2key(stem, node.depth)].(HashedNode); !ok {
+		return n.Insert(key, value, nil)
+	}
+	if batchResolver == nil {
+		return errInsertIntoHash
+	}
+
+	paths := make([][]byte, 0, StemSize-int(node.depth))
+	for i := int(node.depth) + 1; i <= StemSize; i++ {
+		paths = append(paths, stem[:i])
+	}
+	serialized, err := batchResolver(paths)
+	if err != nil {
+		return fmt.Errorf("verkle tree: error resolving path to %x: %w", stem, err)
+	}
+	if len(serialized) != len(paths) {
+		return fmt.Errorf("verkle tree: batch resolver returned %d nodes for %d paths", len(serialized), len(paths))
+	}
+	resolved := make(map[string][]byte, len(paths))
+	for i := range paths {
+		resolved[string(paths[i])] = serialized[i]
+	}
+
+	return n.Insert(key, value, func(path []byte) ([]byte, error) {
+		serialized, ok := resolved[string(path)]
+		if !ok || serialized == nil {
+			return nil, fmt.Errorf("path %x was not returned by the batch resolver", path)
+		}
+		return serialized, nil
+	})
+}
+
 // CreatePath inserts a given stem in the tree, placing it as
 // described by stemInfo. Its third parameters is the list of
 // commitments that have not been assigned a node. It returns
@@ -583,6 +1029,37 @@ func (n *InternalNode) GetValuesAtStem(stem Stem, resolver NodeResolverFn) ([][]
 	}
 }
 
+// GetValuesAtStem returns the NodeWidth values of the leaf at stem in the
+// tree rooted at root, with nil entries for the absent suffixes, or nil if
+// the stem isn't in the tree. It is the read counterpart of
+// InsertValuesAtStem. Like InternalNode.GetValuesAtStem, the returned slice
+// is internal to the tree and must be considered read-only.
+func GetValuesAtStem(root VerkleNode, stem []byte, resolver NodeResolverFn) ([][]byte, error) {
+	if len(stem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d, expected %d", len(stem), StemSize)
+	}
+	switch n := root.(type) {
+	case *InternalNode:
+		return n.GetValuesAtStem(stem, resolver)
+	case *LeafNode:
+		if !equalPaths(n.stem, stem) {
+			return nil, nil
+		}
+		if n.isPOAStub {
+			return nil, errIsPOAStub
+		}
+		return n.values, nil
+	case Empty:
+		return nil, nil
+	case UnknownNode:
+		return nil, errMissingNodeInStateless
+	case HashedNode:
+		return nil, errReadFromInvalid
+	default:
+		return nil, errUnknownNodeType
+	}
+}
+
 func (n *InternalNode) Delete(key []byte, resolver NodeResolverFn) (bool, error) {
 	nChild := offset2key(key, n.depth)
 	switch child := n.children[nChild].(type) {
@@ -631,6 +1108,78 @@ func (n *InternalNode) Delete(key []byte, resolver NodeResolverFn) (bool, error)
 	}
 }
 
+// DeleteMultiple deletes the values at the given keys. Keys are grouped by
+// stem, so that the values of each leaf are deleted in a single batched
+// update of its commitment.
+func (n *InternalNode) DeleteMultiple(keys [][]byte, resolver NodeResolverFn) error {
+	suffixes := make(map[string][]byte)
+	for _, key := range keys {
+		if len(key) != KeySize {
+			return fmt.Errorf("invalid key length %d, expected %d", len(key), KeySize)
+		}
+		stem := string(KeyToStem(key))
+		suffixes[stem] = append(suffixes[stem], key[StemSize])
+	}
+
+	stems := make([]string, 0, len(suffixes))
+	for stem := range suffixes {
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+	for _, stem := range stems {
+		if _, err := n.deleteMultiple([]byte(stem), suffixes[stem], resolver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMultiple deletes the values at the given suffixes of a stem, and
+// returns true if the node is left empty and should be removed by its parent.
+func (n *InternalNode) deleteMultiple(stem []byte, suffixes []byte, resolver NodeResolverFn) (bool, error) {
+	nChild := offset2key(stem, n.depth)
+	child, err := n.resolveChild(stem[:n.depth], nChild, resolver)
+	if err != nil {
+		return false, err
+	}
+
+	var del bool
+	switch child := child.(type) {
+	case Empty:
+		return false, nil
+	case *LeafNode:
+		if !bytes.Equal(child.stem, stem) {
+			return false, nil
+		}
+		n.cowChild(nChild)
+		if err := child.DeleteMultiple(suffixes); err != nil {
+			return false, err
+		}
+		del = child.isCnEmpty(0) && child.isCnEmpty(1)
+	case *InternalNode:
+		n.cowChild(nChild)
+		if del, err = child.deleteMultiple(stem, suffixes, resolver); err != nil {
+			return false, err
+		}
+	default:
+		return false, errDeleteUnknown
+	}
+
+	if !del {
+		return false, nil
+	}
+	n.children[nChild] = Empty{}
+
+	// Check if all children are gone, if so signal that
+	// this node should be deleted as well.
+	for _, c := range n.children {
+		if _, ok := c.(Empty); !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 // DeleteAtStem delete a full stem. Unlike Delete, it will error out if the stem that is to
 // be deleted does not exist in the tree, because it's meant to be used by rollback code,
 // that should only delete things that exist.
@@ -783,34 +1332,370 @@ func (n *InternalNode) Get(key []byte, resolver NodeResolverFn) ([]byte, error)
 	return stemValues[key[StemSize]], nil
 }
 
-func (n *InternalNode) Hash() *Fr {
-	var hash Fr
-	n.Commitment().MapToScalarField(&hash)
-	return &hash
+// sortKeysWithOrder checks that the keys are KeySize long, and returns them
+// sorted, along with the position in keys of each of the sorted keys, so that
+// results computed in sorted order can be returned in the order of keys.
+func sortKeysWithOrder(keys [][]byte) (keylist, []int, error) {
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, nil, fmt.Errorf("invalid key length, expected %d, got %d", KeySize, len(key))
+		}
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	sorted := make(keylist, len(keys))
+	for i, idx := range order {
+		sorted[i] = keys[idx]
+	}
+	return sorted, order, nil
 }
 
-func (n *InternalNode) Commitment() *Point {
-	if n.commitment == nil {
-		panic("nil commitment")
+// ContainsMany reports, for each key, whether a value is present in the
+// tree. The keys are sorted and looked up in a single traversal, so that
+// each hashed node along the way is resolved at most once. It must be
+// called on the root of the tree.
+func (n *InternalNode) ContainsMany(keys [][]byte, resolver NodeResolverFn) ([]bool, error) {
+	sorted, order, err := sortKeysWithOrder(keys)
+	if err != nil {
+		return nil, err
 	}
-	return n.commitment
-}
 
-func (n *InternalNode) fillLevels(levels [][]*InternalNode) {
-	levels[int(n.depth)] = append(levels[int(n.depth)], n)
-	for idx := range n.cow {
-		child := n.children[idx]
-		if childInternalNode, ok := child.(*InternalNode); ok && len(childInternalNode.cow) > 0 {
-			childInternalNode.fillLevels(levels)
+	present := make([]bool, len(keys))
+	err = n.visitLeavesOfKeys(sorted, nil, 0, resolver, func(leaf *LeafNode, group keylist, offset int) error {
+		for i, key := range group {
+			if !equalPaths(leaf.stem, key) {
+				continue
+			}
+			if leaf.isPOAStub {
+				return errIsPOAStub
+			}
+			present[offset+i] = leaf.values[key[StemSize]] != nil
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (n *InternalNode) Commit() *Point {
-	if len(n.cow) == 0 {
-		return n.commitment
+	ret := make([]bool, len(keys))
+	for i, idx := range order {
+		ret[idx] = present[i]
 	}
-
+	return ret, nil
+}
+
+// BatchGet returns the values of the keys, in the same order as the keys,
+// like calling Get for each one of them. The keys are sorted and looked up
+// in a single traversal, so that each hashed node along the way is resolved
+// at most once. It must be called on the root of the tree.
+func (n *InternalNode) BatchGet(keys [][]byte, resolver NodeResolverFn) ([][]byte, error) {
+	sorted, order, err := sortKeysWithOrder(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	err = n.visitLeavesOfKeys(sorted, nil, 0, resolver, func(leaf *LeafNode, group keylist, offset int) error {
+		for i, key := range group {
+			value, err := leaf.Get(key, nil)
+			if err != nil {
+				return err
+			}
+			values[offset+i] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([][]byte, len(keys))
+	for i, idx := range order {
+		ret[idx] = values[i]
+	}
+	return ret, nil
+}
+
+// visitLeavesOfKeys calls fn for each leaf that the sorted keys lead to, in
+// the subtree rooted at this node, whose path is path. offset is the position
+// of the first key in the list that the traversal started with. fn receives
+// the keys leading to the leaf, and the position of the first of them in
+// that same list.
+func (n *InternalNode) visitLeavesOfKeys(keys keylist, path []byte, offset int, resolver NodeResolverFn, fn func(*LeafNode, keylist, int) error) error {
+	for _, group := range groupKeys(keys, n.depth) {
+		groupOffset := offset
+		offset += len(group)
+
+		childIdx := offset2key(group[0], n.depth)
+		child, err := n.resolveChild(path, childIdx, resolver)
+		if err != nil {
+			return err
+		}
+		switch child := child.(type) {
+		case Empty:
+			// nothing to do, the keys are absent
+		case UnknownNode:
+			return errMissingNodeInStateless
+		case *InternalNode:
+			if err := child.visitLeavesOfKeys(group, childPath(path, childIdx), groupOffset, resolver, fn); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if err := fn(child, group, groupOffset); err != nil {
+				return err
+			}
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+// TouchedInternalNodes returns the number of distinct internal nodes found
+// along the paths to the keys, including the root. It must be called on the
+// root node.
+func (n *InternalNode) TouchedInternalNodes(keys [][]byte, resolver NodeResolverFn) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	sorted := make(keylist, len(keys))
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return 0, fmt.Errorf("invalid key size %d", len(key))
+		}
+		sorted[i] = key
+	}
+	sort.Sort(sorted)
+	return n.touchedInternalNodes(sorted, nil, resolver)
+}
+
+func (n *InternalNode) touchedInternalNodes(keys keylist, path []byte, resolver NodeResolverFn) (int, error) {
+	count := 1
+	for _, group := range groupKeys(keys, n.depth) {
+		childIdx := offset2key(group[0], n.depth)
+		child, err := n.resolveChild(path, childIdx, resolver)
+		if err != nil {
+			return 0, err
+		}
+		switch child := child.(type) {
+		case Empty, *LeafNode:
+			// the path ends here
+		case UnknownNode:
+			return 0, errMissingNodeInStateless
+		case *InternalNode:
+			childCount, err := child.touchedInternalNodes(group, childPath(path, childIdx), resolver)
+			if err != nil {
+				return 0, err
+			}
+			count += childCount
+		default:
+			return 0, errUnknownNodeType
+		}
+	}
+	return count, nil
+}
+
+// Fold calls fn on every value present in the tree, in key order, passing it
+// the result of the previous call, starting with acc. It returns the result
+// of the last call. Hashed nodes are resolved along the way.
+func (n *InternalNode) Fold(acc interface{}, fn func(acc interface{}, key, value []byte) interface{}, resolver NodeResolverFn) (interface{}, error) {
+	err := n.IterateLeaves(func(leaf *LeafNode) error {
+		if leaf.isPOAStub {
+			return errIsPOAStub
+		}
+		for suffix, value := range leaf.values {
+			if value == nil {
+				continue
+			}
+			key := make([]byte, KeySize)
+			copy(key, leaf.stem)
+			key[StemSize] = byte(suffix)
+			acc = fn(acc, key, value)
+		}
+		return nil
+	}, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// IterateLeaves calls cb on every leaf of the tree, in ascending stem order,
+// and stops at the first error that cb returns. Hashed nodes are resolved
+// along the way. Proof of absence stubs are passed to cb like other leaves.
+func (n *InternalNode) IterateLeaves(cb func(*LeafNode) error, resolver NodeResolverFn) error {
+	return n.iterateLeaves(nil, cb, resolver)
+}
+
+// IterateStemPrefix calls cb on every leaf whose stem starts with prefix,
+// in ascending stem order, only descending into the children that are
+// consistent with the prefix. An empty prefix iterates over the whole tree.
+func (n *InternalNode) IterateStemPrefix(prefix []byte, cb func(*LeafNode) error, resolver NodeResolverFn) error {
+	if len(prefix) > StemSize {
+		return fmt.Errorf("invalid prefix length %d, max %d", len(prefix), StemSize)
+	}
+	if int(n.depth) >= len(prefix) {
+		return n.iterateLeaves(prefix, cb, resolver)
+	}
+
+	index := offset2key(prefix, n.depth)
+	child, err := n.resolveChild(prefix[:n.depth], index, resolver)
+	if err != nil {
+		return err
+	}
+	switch child := child.(type) {
+	case Empty:
+		return nil
+	case UnknownNode:
+		return errMissingNodeInStateless
+	case *LeafNode:
+		if bytes.HasPrefix(child.stem, prefix) {
+			return cb(child)
+		}
+		return nil
+	case *InternalNode:
+		return child.IterateStemPrefix(prefix, cb, resolver)
+	default:
+		return errUnknownNodeType
+	}
+}
+
+func (n *InternalNode) iterateLeaves(path []byte, cb func(*LeafNode) error, resolver NodeResolverFn) error {
+	for i := range n.children {
+		child, err := n.resolveChild(path, byte(i), resolver)
+		if err != nil {
+			return err
+		}
+		switch child := child.(type) {
+		case Empty:
+		case UnknownNode:
+			return errMissingNodeInStateless
+		case *LeafNode:
+			if err := cb(child); err != nil {
+				return err
+			}
+		case *InternalNode:
+			if err := child.iterateLeaves(childPath(path, byte(i)), cb, resolver); err != nil {
+				return err
+			}
+		default:
+			return errUnknownNodeType
+		}
+	}
+	return nil
+}
+
+func (n *InternalNode) Hash() *Fr {
+	var hash Fr
+	n.Commitment().MapToScalarField(&hash)
+	return &hash
+}
+
+// Commitment returns the cached commitment of the node, and panics if it
+// hasn't been computed. See TryCommitment for a version returning an error.
+func (n *InternalNode) Commitment() *Point {
+	comm, err := n.TryCommitment()
+	if err != nil {
+		panic(err)
+	}
+	return comm
+}
+
+// TryCommitment returns the cached commitment of the node, or an error if
+// it hasn't been computed, e.g. after a call to DropCommitments.
+func (n *InternalNode) TryCommitment() (*Point, error) {
+	if n.commitment == nil {
+		return nil, errCommitmentNotComputed
+	}
+	return n.commitment, nil
+}
+
+func (n *InternalNode) fillLevels(levels [][]*InternalNode) {
+	levels[int(n.depth)] = append(levels[int(n.depth)], n)
+	if n.commitment == nil {
+		// The commitment has been dropped, any child can be stale.
+		for _, child := range n.children {
+			if childInternalNode, ok := child.(*InternalNode); ok && childInternalNode.IsDirty() {
+				childInternalNode.fillLevels(levels)
+			}
+		}
+		return
+	}
+	for idx := range n.cow {
+		child := n.children[idx]
+		if childInternalNode, ok := child.(*InternalNode); ok && childInternalNode.IsDirty() {
+			childInternalNode.fillLevels(levels)
+		}
+	}
+}
+
+// PendingChanges returns, for each child touched since the last call to
+// Commit, the commitment it had before being modified and its current one,
+// indexed by the path of the child. These are the pairs that Commit will use
+// to update the commitments of the tree. Note that the current commitment of
+// an internal child that has pending changes of its own is only updated when
+// Commit is called. The commitment of a node dropped by DropCommitments is
+// reported as nil, and since such a node is recomputed from all its
+// children, each of them is reported with a nil previous commitment.
+func (n *InternalNode) PendingChanges() map[string][2]*Point {
+	changes := make(map[string][2]*Point)
+	n.pendingChanges(nil, changes)
+	return changes
+}
+
+func (n *InternalNode) pendingChanges(path []byte, changes map[string][2]*Point) {
+	if n.commitment == nil {
+		for i, child := range n.children {
+			switch child.(type) {
+			case *InternalNode, *LeafNode:
+				n.pendingChildChange(path, byte(i), nil, changes)
+			}
+		}
+		return
+	}
+	for idx, oldComm := range n.cow {
+		n.pendingChildChange(path, idx, new(Point).Set(oldComm), changes)
+	}
+}
+
+// pendingChildChange records the change of the child at index, and those
+// of its own children if it is a dirty internal node.
+func (n *InternalNode) pendingChildChange(path []byte, index byte, oldComm *Point, changes map[string][2]*Point) {
+	childpath := childPath(path, index)
+	var newComm *Point
+	switch child := n.children[index].(type) {
+	case *InternalNode:
+		if child.commitment != nil {
+			newComm = new(Point).Set(child.commitment)
+		}
+		if child.IsDirty() {
+			child.pendingChanges(childpath, changes)
+		}
+	default:
+		newComm = new(Point).Set(child.Commitment())
+	}
+	changes[string(childpath)] = [2]*Point{oldComm, newComm}
+}
+
+func (n *InternalNode) Commit() *Point {
+	return n.CommitParallel(runtime.NumCPU())
+}
+
+// CommitParallel computes the commitment of the tree like Commit, spreading
+// the nodes of each level over numWorkers goroutines. The nodes of a level
+// are independent, so they can be committed concurrently. Commit uses one
+// worker per CPU, and a single worker commits the tree sequentially.
+func (n *InternalNode) CommitParallel(numWorkers int) *Point {
+	if !n.IsDirty() {
+		return n.commitment
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
 	internalNodeLevels := make([][]*InternalNode, StemSize)
 	n.fillLevels(internalNodeLevels)
 
@@ -821,15 +1706,14 @@ func (n *InternalNode) Commit() *Point {
 		}
 
 		minBatchSize := 4
-		if len(nodes) <= minBatchSize {
+		if len(nodes) <= minBatchSize || numWorkers == 1 {
 			if err := commitNodesAtLevel(nodes); err != nil {
 				// TODO: make Commit() return an error
 				panic(err)
 			}
 		} else {
 			var wg sync.WaitGroup
-			numBatches := runtime.NumCPU()
-			batchSize := (len(nodes) + numBatches - 1) / numBatches
+			batchSize := (len(nodes) + numWorkers - 1) / numWorkers
 			if batchSize < minBatchSize {
 				batchSize = minBatchSize
 			}
@@ -855,6 +1739,293 @@ func (n *InternalNode) Commit() *Point {
 	return n.commitment
 }
 
+// IsDirty returns true if the tree has been modified since it was last
+// committed, i.e. if its commitment is outdated, or if its commitment has
+// been dropped by DropCommitments.
+func (n *InternalNode) IsDirty() bool {
+	return len(n.cow) > 0 || n.commitment == nil
+}
+
+// DropCommitments releases the commitments of the internal nodes deeper
+// than belowDepth, keeping the nodes themselves and their values. Their
+// commitments are recomputed from scratch by the next call to Commit, which
+// must happen before they are used, e.g. to serialize the tree or to build
+// a proof. Nodes with hashed or unknown children can't be recomputed that
+// way, and keep their commitment. Leaf commitments are updated at each
+// write, and are always kept.
+func (n *InternalNode) DropCommitments(belowDepth uint8) {
+	for i, child := range n.children {
+		c, ok := child.(*InternalNode)
+		if !ok {
+			continue
+		}
+		if n.journal != nil {
+			c.journal = n.journal
+		}
+		c.DropCommitments(belowDepth)
+
+		if c.depth > belowDepth && c.commitment != nil && c.canRecomputeCommitment() {
+			n.journalChild(byte(i))
+			// If this node keeps its commitment, it needs the one its
+			// child had so that the next commit can compute the delta.
+			if n.commitment != nil {
+				if n.cow == nil {
+					n.cow = make(map[byte]*Point)
+				}
+				if n.cow[byte(i)] == nil {
+					n.cow[byte(i)] = c.commitment
+				}
+			}
+			c.commitment = nil
+			c.cow = nil
+		} else if c.IsDirty() {
+			n.cowChild(byte(i))
+		}
+	}
+}
+
+// canRecomputeCommitment returns true if the commitment of the node can be
+// computed from its children alone.
+func (n *InternalNode) canRecomputeCommitment() bool {
+	for _, child := range n.children {
+		switch child.(type) {
+		case HashedNode, UnknownNode:
+			return false
+		}
+	}
+	return true
+}
+
+// Fingerprint returns a short identifier of the state of the tree, made of
+// the first 8 bytes of its root commitment, hex-encoded. It is meant for
+// logging, and commits the tree first if it has pending changes.
+func (n *InternalNode) Fingerprint() string {
+	if n.IsDirty() {
+		n.Commit()
+	}
+	comm := n.commitment.Bytes()
+	return hex.EncodeToString(comm[:8])
+}
+
+// CommitmentsEqualLazy returns true if both nodes have the same commitment.
+// Only the nodes with pending changes are committed, so that comparing two
+// committed trees is cheap. Hashed nodes have no commitment, and are never
+// equal to anything.
+func CommitmentsEqualLazy(a, b VerkleNode) bool {
+	for _, node := range []VerkleNode{a, b} {
+		switch node := node.(type) {
+		case HashedNode:
+			return false
+		case *InternalNode:
+			if node.IsDirty() {
+				node.Commit()
+			}
+		}
+	}
+	return a.Commitment().Equal(b.Commitment())
+}
+
+// NodesEqual returns true if both subtrees have the same structure and
+// values. Hashed nodes carry no data, so an internal node with hashed
+// children is only equal to another one if their commitments are equal as
+// well, and is never equal to another one if either commitment is missing.
+// Such trees should thus be committed before being compared.
+func NodesEqual(a, b VerkleNode) bool {
+	switch a := a.(type) {
+	case Empty:
+		_, ok := b.(Empty)
+		return ok
+	case UnknownNode:
+		_, ok := b.(UnknownNode)
+		return ok
+	case HashedNode:
+		_, ok := b.(HashedNode)
+		return ok
+	case *LeafNode:
+		b, ok := b.(*LeafNode)
+		if !ok || a.isPOAStub != b.isPOAStub || !bytes.Equal(a.stem, b.stem) || len(a.values) != len(b.values) {
+			return false
+		}
+		for i := range a.values {
+			if !bytes.Equal(a.values[i], b.values[i]) {
+				return false
+			}
+		}
+		return true
+	case *InternalNode:
+		b, ok := b.(*InternalNode)
+		if !ok || len(a.children) != len(b.children) {
+			return false
+		}
+		var hasHashed bool
+		for i := range a.children {
+			if !NodesEqual(a.children[i], b.children[i]) {
+				return false
+			}
+			_, isHashed := a.children[i].(HashedNode)
+			hasHashed = hasHashed || isHashed
+		}
+		if !hasHashed {
+			return true
+		}
+		return a.commitment != nil && b.commitment != nil && a.commitment.Equal(b.commitment)
+	default:
+		return false
+	}
+}
+
+// CommitAndSnapshotRoot commits the tree and returns its root commitment,
+// along with a function that reverts the tree to its current state. This
+// is meant to handle shallow reorgs. Nothing is copied upfront: the state
+// of each node is saved the first time it is modified after the snapshot,
+// so the cost of a snapshot is proportional to the number of nodes that are
+// modified before the next one. Reverting to a snapshot also reverts the
+// changes made after any later snapshot, whose revert functions become
+// no-ops. The tree can be reverted to the same snapshot several times.
+// Only the changes made by the write methods of the tree, e.g. Insert,
+// Delete or DropCommitments, are tracked, not those made with SetChild.
+func (n *InternalNode) CommitAndSnapshotRoot() (*Point, func()) {
+	root := new(Point).Set(n.Commit())
+	journal := newTreeJournal(n)
+	if n.journal != nil {
+		n.journal.lock.Lock()
+		n.journal.next = journal
+		n.journal.lock.Unlock()
+	}
+	n.journal = journal
+	return root, journal.revert
+}
+
+// journalChild saves the state of the child at index before it gets
+// modified, if a snapshot is active.
+func (n *InternalNode) journalChild(index byte) {
+	if n.journal == nil {
+		return
+	}
+	child := n.children[index]
+	n.journal.record(child)
+	if c, ok := child.(*InternalNode); ok {
+		c.journal = n.journal
+	}
+}
+
+// treeJournal holds the state that the nodes of a tree had when a snapshot
+// was taken, for the nodes modified since. It is filled until the next
+// snapshot is taken, at which point it links to the journal of that
+// snapshot.
+type treeJournal struct {
+	lock      sync.Mutex
+	root      *InternalNode
+	internals map[*InternalNode]internalNodeState
+	leaves    map[*LeafNode]LeafNode
+	next      *treeJournal
+	closed    bool
+}
+
+// internalNodeState is the part of the state of an internal node that is
+// saved in a journal. Its cow map is empty right after a commit.
+type internalNodeState struct {
+	children   []VerkleNode
+	commitment *Point
+	depth      byte
+}
+
+func newTreeJournal(root *InternalNode) *treeJournal {
+	journal := &treeJournal{
+		root:      root,
+		internals: make(map[*InternalNode]internalNodeState),
+		leaves:    make(map[*LeafNode]LeafNode),
+	}
+	journal.record(root)
+	return journal
+}
+
+// record saves the state of node, unless it was already saved. Several
+// goroutines can record nodes at once, e.g. in InsertMigratedLeaves.
+func (j *treeJournal) record(node VerkleNode) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.closed || j.next != nil {
+		return
+	}
+
+	switch node := node.(type) {
+	case *InternalNode:
+		if _, ok := j.internals[node]; ok {
+			return
+		}
+		state := internalNodeState{
+			children: slices.Clone(node.children),
+			depth:    node.depth,
+		}
+		if node.commitment != nil {
+			state.commitment = new(Point).Set(node.commitment)
+		}
+		j.internals[node] = state
+	case *LeafNode:
+		if _, ok := j.leaves[node]; ok {
+			return
+		}
+		// Commitments are updated in place, and values are replaced
+		// in the values slice.
+		state := *node
+		state.values = slices.Clone(node.values)
+		for _, c := range []**Point{&state.commitment, &state.c1, &state.c2} {
+			if *c != nil {
+				*c = new(Point).Set(*c)
+			}
+		}
+		j.leaves[node] = state
+	}
+}
+
+// revert restores the tree to its state when the snapshot was taken, undoing
+// the later snapshots first. The journal is then emptied, so that it keeps
+// recording the changes made from that state.
+func (j *treeJournal) revert() {
+	j.lock.Lock()
+	closed := j.closed
+	j.lock.Unlock()
+	if closed {
+		return
+	}
+
+	var journals []*treeJournal
+	for journal := j; journal != nil; journal = journal.next {
+		journals = append(journals, journal)
+	}
+	for i := len(journals) - 1; i >= 0; i-- {
+		journals[i].restore()
+		if i > 0 {
+			journals[i].closed = true
+		}
+	}
+
+	j.internals = make(map[*InternalNode]internalNodeState)
+	j.leaves = make(map[*LeafNode]LeafNode)
+	j.next = nil
+	j.record(j.root)
+	j.root.journal = j
+}
+
+// restore writes the saved states back into the nodes.
+func (j *treeJournal) restore() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for node, state := range j.internals {
+		node.children = state.children
+		node.commitment = state.commitment
+		node.depth = state.depth
+		node.cow = nil
+		node.journal = nil
+	}
+	for leaf, state := range j.leaves {
+		*leaf = state
+		leaf.resetProofCache()
+	}
+	j.internals, j.leaves = nil, nil
+}
+
 func commitNodesAtLevel(nodes []*InternalNode) error {
 	points := make([]*Point, 0, 1024)
 	cowIndexes := make([]int, 0, 1024)
@@ -862,12 +2033,29 @@ func commitNodesAtLevel(nodes []*InternalNode) error {
 	// For each internal node, we collect in `points` all the ones we need to map to a field element.
 	// That is, for each touched children in a node, we collect the old and new commitment to do the diff updating
 	// later.
-	for _, node := range nodes {
+	// Nodes whose commitment has been dropped are recomputed from all
+	// their children, as a delta from the identity.
+	var identity Point
+	identity.SetIdentity()
+	counts := make([]int, len(nodes))
+	for i, node := range nodes {
+		if node.commitment == nil {
+			for idx, child := range node.children {
+				if _, ok := child.(Empty); ok {
+					continue
+				}
+				points = append(points, &identity, child.Commitment())
+				cowIndexes = append(cowIndexes, idx)
+				counts[i]++
+			}
+			continue
+		}
 		for idx, nodeChildComm := range node.cow {
 			points = append(points, nodeChildComm)
 			points = append(points, node.children[idx].Commitment())
 			cowIndexes = append(cowIndexes, int(idx))
 		}
+		counts[i] = len(node.cow)
 	}
 
 	// We generate `frs` which will contain the result for each element in `points`.
@@ -893,14 +2081,18 @@ func commitNodesAtLevel(nodes []*InternalNode) error {
 	var frsIdx int
 	var cowIndex int
 
-	for _, node := range nodes {
+	for i, node := range nodes {
 		poly := make([]Fr, NodeWidth)
-		for i := 0; i < len(node.cow); i++ {
+		for j := 0; j < counts[i]; j++ {
 			poly[cowIndexes[cowIndex]] = *frs[frsIdx]
 			frsIdx++
 			cowIndex++
 		}
 		node.cow = nil
+		if node.commitment == nil {
+			node.commitment = cfg.CommitToPoly(poly, 0)
+			continue
+		}
 		node.commitment.Add(node.commitment, cfg.CommitToPoly(poly, 0))
 	}
 
@@ -939,6 +2131,10 @@ func groupKeys(keys keylist, depth byte) []keylist {
 }
 
 func (n *InternalNode) GetProofItems(keys keylist, resolver NodeResolverFn) (*ProofElements, []byte, []Stem, error) {
+	if len(keys) == 0 {
+		return &ProofElements{ByPath: map[string]*Point{}}, nil, nil, nil
+	}
+
 	var (
 		groups = groupKeys(keys, n.depth)
 		pe     = &ProofElements{
@@ -955,39 +2151,8 @@ func (n *InternalNode) GetProofItems(keys keylist, resolver NodeResolverFn) (*Pr
 
 	// fill in the polynomial for this node
 	var fi [NodeWidth]Fr
-	var fiPtrs [NodeWidth]*Fr
-	var points [NodeWidth]*Point
-	for i, child := range n.children {
-		fiPtrs[i] = &fi[i]
-		if child != nil {
-			var c VerkleNode
-			if _, ok := child.(HashedNode); ok {
-				childpath := make([]byte, n.depth+1)
-				copy(childpath[:n.depth+1], keys[0][:n.depth])
-				childpath[n.depth] = byte(i)
-				if resolver == nil {
-					return nil, nil, nil, fmt.Errorf("no resolver for path %x", childpath)
-				}
-				serialized, err := resolver(childpath)
-				if err != nil {
-					return nil, nil, nil, fmt.Errorf("error resolving for path %x: %w", childpath, err)
-				}
-				c, err = ParseNode(serialized, n.depth+1)
-				if err != nil {
-					return nil, nil, nil, err
-				}
-				n.children[i] = c
-			} else {
-				c = child
-			}
-			points[i] = c.Commitment()
-		} else {
-			// TODO: add a test case to cover this scenario.
-			points[i] = new(Point)
-		}
-	}
-	if err := banderwagon.BatchMapToScalarField(fiPtrs[:], points[:]); err != nil {
-		return nil, nil, nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+	if err := n.fillChildrenPoly(&fi, keys[0][:n.depth], resolver); err != nil {
+		return nil, nil, nil, err
 	}
 
 	for _, group := range groups {
@@ -1045,9 +2210,131 @@ func (n *InternalNode) GetProofItems(keys keylist, resolver NodeResolverFn) (*Pr
 		esses = append(esses, es...)
 	}
 
+	// The root commitment isn't part of the proof.
+	if n.depth > 0 {
+		pe.naiveCs += len(keys)
+	}
+
 	return pe, esses, poass, nil
 }
 
+// ExtensionStatus returns the extension status that a proof for key would
+// hold, without computing the rest of the proof. It uses the encoding of
+// GetProofItems: the two lowest bits are 0 if the stem is absent because its
+// path leads to an empty slot, 1 if it leads to a leaf of another stem, and
+// 2 if the stem is present, the remaining bits being the depth of the
+// extension. In the second case, the stem of that other leaf is returned as
+// well.
+func (n *InternalNode) ExtensionStatus(key []byte, resolver NodeResolverFn) (byte, []byte, error) {
+	if len(key) < StemSize {
+		return 0, nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	node := n
+	for {
+		child, err := node.resolveChild(key[:node.depth], offset2key(key, node.depth), resolver)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch child := child.(type) {
+		case Empty:
+			return extStatusAbsentEmpty | ((node.depth + 1) << 3), nil, nil
+		case UnknownNode:
+			return 0, nil, errMissingNodeInStateless
+		case *LeafNode:
+			if !equalPaths(child.stem, key) {
+				return extStatusAbsentOther | (child.depth << 3), child.stem, nil
+			}
+			return extStatusPresent | (child.depth << 3), nil, nil
+		case *InternalNode:
+			node = child
+		default:
+			return 0, nil, fmt.Errorf("unexpected node type %T at path %x", child, key[:node.depth+1])
+		}
+	}
+}
+
+// fillChildrenPoly fills fi with the field representation of the
+// commitment of each child. Hashed children are resolved, given that
+// path is the path to this node.
+func (n *InternalNode) fillChildrenPoly(fi *[NodeWidth]Fr, path []byte, resolver NodeResolverFn) error {
+	var fiPtrs [NodeWidth]*Fr
+	var points [NodeWidth]*Point
+	for i, child := range n.children {
+		fiPtrs[i] = &fi[i]
+		if child != nil {
+			var c VerkleNode
+			if _, ok := child.(HashedNode); ok {
+				childpath := make([]byte, n.depth+1)
+				copy(childpath[:n.depth+1], path[:n.depth])
+				childpath[n.depth] = byte(i)
+				if resolver == nil {
+					return fmt.Errorf("no resolver for path %x", childpath)
+				}
+				serialized, err := resolver(childpath)
+				if err != nil {
+					return fmt.Errorf("error resolving for path %x: %w", childpath, err)
+				}
+				c, err = ParseNode(serialized, n.depth+1)
+				if err != nil {
+					return err
+				}
+				n.children[i] = c
+			} else {
+				c = child
+			}
+			points[i] = c.Commitment()
+		} else {
+			// TODO: add a test case to cover this scenario.
+			points[i] = new(Point)
+		}
+	}
+	if err := banderwagon.BatchMapToScalarField(fiPtrs[:], points[:]); err != nil {
+		return fmt.Errorf("batch mapping to scalar fields: %s", err)
+	}
+	return nil
+}
+
+// getPathProofItems opens the commitment of each internal node along
+// path, at the index of the next node along that path. The walk stops
+// at the first node that isn't an internal node, or after len(path)
+// levels. It returns the proof elements, as well as the node at which
+// the walk stopped.
+func getPathProofItems(root VerkleNode, path []byte, resolver NodeResolverFn) (*ProofElements, VerkleNode, error) {
+	var (
+		pe = &ProofElements{
+			Cis:    []*Point{},
+			Zis:    []byte{},
+			Yis:    []*Fr{},
+			Fis:    [][]Fr{},
+			ByPath: map[string]*Point{},
+		}
+		node = root
+	)
+
+	for depth := range path {
+		n, ok := node.(*InternalNode)
+		if !ok {
+			break
+		}
+
+		var fi [NodeWidth]Fr
+		if err := n.fillChildrenPoly(&fi, path[:depth], resolver); err != nil {
+			return nil, nil, err
+		}
+		var yi Fr
+		yi.Set(&fi[path[depth]])
+		pe.Cis = append(pe.Cis, n.commitment)
+		pe.Zis = append(pe.Zis, path[depth])
+		pe.Yis = append(pe.Yis, &yi)
+		pe.Fis = append(pe.Fis, fi[:])
+		pe.ByPath[string(path[:depth])] = n.commitment
+
+		node = n.children[path[depth]]
+	}
+
+	return pe, node, nil
+}
+
 // Serialize returns the serialized form of the internal node.
 // The format is: <nodeType><bitlist><commitment>
 func (n *InternalNode) Serialize() ([]byte, error) {
@@ -1073,17 +2360,18 @@ func (n *InternalNode) Serialize() ([]byte, error) {
 
 func (n *InternalNode) Copy() VerkleNode {
 	ret := &InternalNode{
-		children:   make([]VerkleNode, len(n.children)),
-		commitment: new(Point),
-		depth:      n.depth,
+		children: make([]VerkleNode, len(n.children)),
+		depth:    n.depth,
 	}
 
 	for i, child := range n.children {
 		ret.children[i] = child.Copy()
 	}
 
+	// A nil commitment marks a node whose commitment has been dropped,
+	// keep it that way in the copy.
 	if n.commitment != nil {
-		ret.commitment.Set(n.commitment)
+		ret.commitment = new(Point).Set(n.commitment)
 	}
 
 	if n.cow != nil {
@@ -1120,30 +2408,429 @@ func (n *InternalNode) setDepth(d byte) {
 	n.depth = d
 }
 
-// MergeTrees takes a series of subtrees that got filled following
-// a command-and-conquer method, and merges them into a single tree.
-// This method is deprecated, use with caution.
-func MergeTrees(subroots []*InternalNode) VerkleNode {
-	root := New().(*InternalNode)
-	for _, subroot := range subroots {
-		for i := 0; i < NodeWidth; i++ {
-			if _, ok := subroot.children[i].(Empty); ok {
+// pointSize is the in-memory size of a cached commitment.
+const pointSize = int(unsafe.Sizeof(Point{}))
+
+func (n *InternalNode) Size() int {
+	size := int(unsafe.Sizeof(*n)) + len(n.children)*int(unsafe.Sizeof(VerkleNode(nil)))
+	if n.commitment != nil {
+		size += pointSize
+	}
+	size += len(n.cow) * (1 + int(unsafe.Sizeof(n.commitment)) + pointSize)
+	for _, child := range n.children {
+		size += child.Size()
+	}
+	return size
+}
+
+// MergeTrees takes a series of subtrees that got filled following
+// a command-and-conquer method, and merges them into a single tree.
+// This method is deprecated, use with caution.
+func MergeTrees(subroots []*InternalNode) VerkleNode {
+	root := New().(*InternalNode)
+	for _, subroot := range subroots {
+		for i := 0; i < NodeWidth; i++ {
+			if _, ok := subroot.children[i].(Empty); ok {
+				continue
+			}
+			root.touchCoW(byte(i))
+			root.children[i] = subroot.children[i]
+		}
+	}
+
+	return root
+}
+
+// RootFromLeafCommitments computes the root commitment of the tree holding
+// leaves with the given stems and commitments, e.g. as computed by separate
+// workers. The leaf commitments are used as is, and only the internal nodes
+// get committed. The stems are passed as the map keys.
+func RootFromLeafCommitments(stemsWithComms map[string]*Point) (*Point, error) {
+	leaves := make([]LeafNode, 0, len(stemsWithComms))
+	for stem, comm := range stemsWithComms {
+		if len(stem) != StemSize {
+			return nil, fmt.Errorf("invalid stem size %d for stem %x", len(stem), stem)
+		}
+		if comm == nil {
+			return nil, fmt.Errorf("missing commitment for stem %x", stem)
+		}
+		// The leaves are stubs, since only their commitment is known.
+		leaves = append(leaves, LeafNode{
+			commitment: comm,
+			stem:       Stem(stem),
+			isPOAStub:  true,
+		})
+	}
+
+	root := New().(*InternalNode)
+	if len(leaves) > 0 {
+		if err := root.InsertMigratedLeaves(leaves, nil); err != nil {
+			return nil, fmt.Errorf("building tree structure: %w", err)
+		}
+	}
+	return root.Commit(), nil
+}
+
+// TouchCoW is a helper function that will mark a child as
+// "inserted into". It is used by the conversion code to
+// mark reconstructed subtrees as 'written to', so that its
+// root commitment can be computed.
+func (n *InternalNode) touchCoW(index byte) {
+	n.cowChild(index)
+}
+
+// VerifyLeafMarkers walks the tree and recomputes the C1 and C2
+// commitments of every leaf, checking that they match the cached
+// ones. The tree always adds the 2^128 leaf marker to a present
+// value, so this catches leaves that were built by an implementation
+// following a different marker policy. Hashed nodes are resolved
+// along the way.
+func (n *InternalNode) VerifyLeafMarkers(resolver NodeResolverFn) error {
+	return n.verifyLeafMarkers(nil, resolver)
+}
+
+func (n *InternalNode) verifyLeafMarkers(path []byte, resolver NodeResolverFn) error {
+	for i := range n.children {
+		child, err := n.resolveChild(path, byte(i), resolver)
+		if err != nil {
+			return err
+		}
+
+		switch child := child.(type) {
+		case *InternalNode:
+			if err := child.verifyLeafMarkers(childPath(path, byte(i)), resolver); err != nil {
+				return err
+			}
+		case *LeafNode:
+			if err := child.verifyLeafMarkers(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyCommitments recomputes the commitment of every node in the tree
+// from its values, without relying on the cached commitments or on the
+// pending changes used by Commit, and checks that it matches the cached
+// one. It returns an error naming the path of the first node, in
+// depth-first order, whose cached commitment is wrong. The tree must be
+// committed first. Commitments of internal nodes with hashed or unknown
+// children can't be recomputed, and are taken as is.
+func (n *InternalNode) VerifyCommitments() error {
+	_, err := n.verifyCommitments(nil)
+	return err
+}
+
+func (n *InternalNode) verifyCommitments(path []byte) (*Point, error) {
+	if n.IsDirty() {
+		return nil, fmt.Errorf("internal node at path %x has uncommitted changes", path)
+	}
+
+	var (
+		points        [NodeWidth]*Point
+		recomputeable = true
+	)
+	for i, child := range n.children {
+		var err error
+		switch child := child.(type) {
+		case Empty:
+			points[i] = child.Commitment()
+		case *InternalNode:
+			points[i], err = child.verifyCommitments(childPath(path, byte(i)))
+		case *LeafNode:
+			points[i], err = child.verifyCommitments(childPath(path, byte(i)))
+		default:
+			recomputeable = false
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !recomputeable {
+		return n.commitment, nil
+	}
+
+	var (
+		poly    [NodeWidth]Fr
+		polyPtr [NodeWidth]*Fr
+	)
+	for i := range poly {
+		polyPtr[i] = &poly[i]
+	}
+	if err := banderwagon.BatchMapToScalarField(polyPtr[:], points[:]); err != nil {
+		return nil, fmt.Errorf("batch mapping to scalar fields: %w", err)
+	}
+	expected := GetConfig().CommitToPoly(poly[:], 0)
+	if !expected.Equal(n.commitment) {
+		return nil, fmt.Errorf("internal node at path %x: %w", path, errStaleCommitment)
+	}
+	return expected, nil
+}
+
+// TopLevelLeafCounts returns the number of leaves found under each
+// child of the root node. Hashed nodes are resolved along the way, so
+// it must be called on the root of the tree.
+func (n *InternalNode) TopLevelLeafCounts(resolver NodeResolverFn) ([NodeWidth]int, error) {
+	var counts [NodeWidth]int
+	for i := range n.children {
+		child, err := n.resolveChild(nil, byte(i), resolver)
+		if err != nil {
+			return counts, err
+		}
+		switch child := child.(type) {
+		case *InternalNode:
+			counts[i], err = child.countLeaves(childPath(nil, byte(i)), resolver)
+			if err != nil {
+				return counts, err
+			}
+		case *LeafNode:
+			counts[i] = 1
+		}
+	}
+	return counts, nil
+}
+
+func (n *InternalNode) countLeaves(path []byte, resolver NodeResolverFn) (int, error) {
+	var count int
+	for i := range n.children {
+		child, err := n.resolveChild(path, byte(i), resolver)
+		if err != nil {
+			return 0, err
+		}
+		switch child := child.(type) {
+		case *InternalNode:
+			c, err := child.countLeaves(childPath(path, byte(i)), resolver)
+			if err != nil {
+				return 0, err
+			}
+			count += c
+		case *LeafNode:
+			count++
+		}
+	}
+	return count, nil
+}
+
+// resolveChild returns the child at the given index. If the child is a
+// HashedNode, it gets resolved and replaced in the tree. path is the path
+// to this node.
+func (n *InternalNode) resolveChild(path []byte, index byte, resolver NodeResolverFn) (VerkleNode, error) {
+	if _, ok := n.children[index].(HashedNode); !ok {
+		return n.children[index], nil
+	}
+
+	childpath := childPath(path, index)
+	if resolver == nil {
+		return nil, fmt.Errorf("no resolver for path %x", childpath)
+	}
+	serialized, err := resolver(childpath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving for path %x: %w", childpath, err)
+	}
+	child, err := ParseNode(serialized, n.depth+1)
+	if err != nil {
+		return nil, err
+	}
+	n.children[index] = child
+	return child, nil
+}
+
+// WritableKeys reports, for each key, whether it can be written to the tree
+// without resolving any node, e.g. in a tree rebuilt from a proof. A key is
+// not writable if its path leads to a node missing from the tree, or to the
+// proof of absence stub of its own stem, since the values of that leaf are
+// unknown. A stub of another stem can be written next to.
+func (n *InternalNode) WritableKeys(keys [][]byte) ([]bool, error) {
+	writable := make([]bool, len(keys))
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("invalid key size %d for key #%d", len(key), i)
+		}
+		node := n
+	walk:
+		for {
+			switch child := node.children[offset2key(key, node.depth)].(type) {
+			case *InternalNode:
+				node = child
+			case Empty:
+				writable[i] = true
+				break walk
+			case *LeafNode:
+				writable[i] = !child.isPOAStub || !equalPaths(child.stem, key)
+				break walk
+			default:
+				break walk
+			}
+		}
+	}
+	return writable, nil
+}
+
+// ParentOf returns the internal node that holds the leaf of a stem, and the
+// index of the leaf among its children. Hashed nodes are resolved along the
+// way. An error is returned if the tree holds no leaf for the stem.
+func (n *InternalNode) ParentOf(stem []byte, resolver NodeResolverFn) (*InternalNode, byte, error) {
+	if len(stem) < StemSize {
+		return nil, 0, fmt.Errorf("invalid stem length %d", len(stem))
+	}
+	var (
+		node = n
+		path []byte
+	)
+	for {
+		index := offset2key(stem, node.depth)
+		child, err := node.resolveChild(path, index, resolver)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch child := child.(type) {
+		case *InternalNode:
+			node, path = child, childPath(path, index)
+		case *LeafNode:
+			if !equalPaths(child.stem, stem) {
+				return nil, 0, fmt.Errorf("no leaf for stem %x, found stem %x at path %x", stem[:StemSize], child.stem, childPath(path, index))
+			}
+			return node, index, nil
+		case UnknownNode:
+			return nil, 0, errMissingNodeInStateless
+		default:
+			return nil, 0, fmt.Errorf("no leaf for stem %x, found %T at path %x", stem[:StemSize], child, childPath(path, index))
+		}
+	}
+}
+
+// AllCommitments returns the compressed commitment of every resolved node
+// in the tree, indexed by the node's path. It is meant to be called after
+// Commit, since the commitments of internal nodes are otherwise outdated.
+func (n *InternalNode) AllCommitments() map[string][32]byte {
+	comms := make(map[string][32]byte)
+	n.allCommitments(nil, comms)
+	return comms
+}
+
+func (n *InternalNode) allCommitments(path []byte, comms map[string][32]byte) {
+	comms[string(path)] = n.commitment.Bytes()
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			child.allCommitments(childPath(path, byte(i)), comms)
+		case *LeafNode:
+			comms[string(childPath(path, byte(i)))] = child.commitment.Bytes()
+		}
+	}
+}
+
+// HashedNodePaths returns the paths of all the hashed nodes left in the
+// tree. A tree that was expected to be fully resolved, e.g. because all
+// its keys were read or written, shouldn't have any.
+func (n *InternalNode) HashedNodePaths() [][]byte {
+	return n.hashedNodePaths(nil, nil)
+}
+
+func (n *InternalNode) hashedNodePaths(path []byte, paths [][]byte) [][]byte {
+	for i, child := range n.children {
+		switch child := child.(type) {
+		case HashedNode:
+			paths = append(paths, childPath(path, byte(i)))
+		case *InternalNode:
+			paths = child.hashedNodePaths(childPath(path, byte(i)), paths)
+		}
+	}
+	return paths
+}
+
+// TreeStats describes the shape of a tree.
+type TreeStats struct {
+	NumLeaves   int // number of leaves, including proof of absence stubs
+	NumInternal int // number of internal nodes, including the root
+	NumHashed   int // number of unresolved nodes
+	NumValues   int // number of values held by the leaves
+	MaxDepth    int // depth of the deepest node, the root being at depth 0
+}
+
+// Stats walks the resolved part of the tree and counts its nodes. Hashed
+// nodes aren't resolved, only counted.
+func (n *InternalNode) Stats() TreeStats {
+	var stats TreeStats
+	n.stats(&stats)
+	return stats
+}
+
+func (n *InternalNode) stats(stats *TreeStats) {
+	stats.NumInternal++
+	if int(n.depth) > stats.MaxDepth {
+		stats.MaxDepth = int(n.depth)
+	}
+	for _, child := range n.children {
+		switch child := child.(type) {
+		case *InternalNode:
+			child.stats(stats)
+			continue
+		case *LeafNode:
+			stats.NumLeaves++
+			for _, v := range child.values {
+				if v != nil {
+					stats.NumValues++
+				}
+			}
+		case HashedNode:
+			stats.NumHashed++
+		default:
+			continue
+		}
+		if int(n.depth)+1 > stats.MaxDepth {
+			stats.MaxDepth = int(n.depth) + 1
+		}
+	}
+}
+
+// StructuralChecksum returns a non-cryptographic hash of the tree, computed
+// from the node types, stems and values. It doesn't require the tree to be
+// committed, so it can be used as a cheap check that two trees are probably
+// equal before comparing their commitments. Hashed nodes are only accounted
+// for by their position, so the checksum of trees that aren't fully resolved
+// can collide.
+func (n *InternalNode) StructuralChecksum() uint64 {
+	h := fnv.New64a()
+	writeStructure(h, n)
+	return h.Sum64()
+}
+
+func writeStructure(h hash.Hash64, node VerkleNode) {
+	switch node := node.(type) {
+	case *InternalNode:
+		h.Write([]byte{internalType})
+		for i, child := range node.children {
+			if _, ok := child.(Empty); ok {
 				continue
 			}
-			root.touchCoW(byte(i))
-			root.children[i] = subroot.children[i]
+			h.Write([]byte{byte(i)})
+			writeStructure(h, child)
+		}
+	case *LeafNode:
+		h.Write([]byte{leafType})
+		h.Write(node.stem)
+		for i, v := range node.values {
+			if v == nil {
+				continue
+			}
+			h.Write([]byte{byte(i), byte(len(v))})
+			h.Write(v)
 		}
+	case HashedNode:
+		h.Write([]byte{0xfe})
+	default:
+		h.Write([]byte{0xff})
 	}
-
-	return root
 }
 
-// TouchCoW is a helper function that will mark a child as
-// "inserted into". It is used by the conversion code to
-// mark reconstructed subtrees as 'written to', so that its
-// root commitment can be computed.
-func (n *InternalNode) touchCoW(index byte) {
-	n.cowChild(index)
+// childPath returns a copy of path, with index appended to it.
+func childPath(path []byte, index byte) []byte {
+	childpath := make([]byte, len(path)+1)
+	copy(childpath, path)
+	childpath[len(path)] = index
+	return childpath
 }
 
 func (n *LeafNode) Insert(key []byte, value []byte, _ NodeResolverFn) error {
@@ -1164,6 +2851,41 @@ func (n *LeafNode) Insert(key []byte, value []byte, _ NodeResolverFn) error {
 	return n.insertMultiple(stem, values)
 }
 
+// InsertWithOld inserts a value in the leaf like Insert, and returns the
+// value that was previously stored at key, or nil if there was none.
+func (n *LeafNode) InsertWithOld(key []byte, value []byte, resolver NodeResolverFn) ([]byte, error) {
+	if n.isPOAStub {
+		return nil, errIsPOAStub
+	}
+	if len(key) != StemSize+1 {
+		return nil, fmt.Errorf("invalid key size: %d", len(key))
+	}
+
+	old := n.values[key[StemSize]]
+	if err := n.Insert(key, value, resolver); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// InsertValuesAtStem inserts the non-nil values at the stem of the leaf, and
+// returns an error if stem is a different one.
+func (n *LeafNode) InsertValuesAtStem(stem Stem, values [][]byte, _ NodeResolverFn) error {
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+	return n.insertMultiple(stem, values)
+}
+
+// DeleteAtStem returns true if key belongs to the stem of the leaf, to signal
+// that the parent should delete it, and an error otherwise.
+func (n *LeafNode) DeleteAtStem(key []byte, _ NodeResolverFn) (bool, error) {
+	if !equalPaths(n.stem, key) {
+		return false, errDeleteMissing
+	}
+	return true, nil
+}
+
 func (n *LeafNode) insertMultiple(stem Stem, values [][]byte) error {
 	// Sanity check: ensure the stems are the same.
 	if !equalPaths(stem, n.stem) {
@@ -1222,6 +2944,12 @@ func (n *LeafNode) updateCn(index byte, value []byte, c *Point) error {
 }
 
 func (n *LeafNode) updateLeaf(index byte, value []byte) error {
+	// The values of a POA stub are unknown, so its commitment
+	// can't be updated.
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+
 	// Update the corresponding C1 or C2 commitment.
 	var c *Point
 	var oldC Point
@@ -1247,10 +2975,15 @@ func (n *LeafNode) updateLeaf(index byte, value []byte) error {
 	n.updateC(cxIndex, frs[0], frs[1])
 
 	n.values[index] = value
+	n.resetProofCache()
 	return nil
 }
 
-func (n *LeafNode) updateMultipleLeaves(values [][]byte) error { // skipcq: GO-R1005
+func (n *LeafNode) updateMultipleLeaves(values [][]byte) error {
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+
 	var oldC1, oldC2 *Point
 
 	// We iterate the values, and we update the C1 and/or C2 commitments depending on the index.
@@ -1259,31 +2992,49 @@ func (n *LeafNode) updateMultipleLeaves(values [][]byte) error { // skipcq: GO-R
 	// after this loop.
 	for i, v := range values {
 		if len(v) != 0 && !bytes.Equal(v, n.values[i]) {
-			if i < NodeWidth/2 {
-				// First time we touch C1? Save the original point for later.
-				if oldC1 == nil {
-					oldC1 = &Point{}
-					oldC1.Set(n.c1)
-				}
-				// We update C1 directly in `n`. We have our original copy in oldC1.
-				if err := n.updateCn(byte(i), v, n.c1); err != nil {
-					return err
-				}
-			} else {
-				// First time we touch C2? Save the original point for later.
-				if oldC2 == nil {
-					oldC2 = &Point{}
-					oldC2.Set(n.c2)
-				}
-				// We update C2 directly in `n`. We have our original copy in oldC2.
-				if err := n.updateCn(byte(i), v, n.c2); err != nil {
-					return err
-				}
+			if err := n.updateCnDeferred(byte(i), v, &oldC1, &oldC2); err != nil {
+				return err
 			}
-			n.values[i] = v
 		}
 	}
 
+	return n.updateCDeferred(oldC1, oldC2)
+}
+
+// updateCnDeferred sets the value at index and updates the C1 or C2
+// commitment it belongs to, but not the leaf commitment. The first time that
+// C1 or C2 is touched, its original value is saved in oldC1 or oldC2, so that
+// updateCDeferred can later batch the update of the leaf commitment.
+func (n *LeafNode) updateCnDeferred(index byte, value []byte, oldC1, oldC2 **Point) error {
+	if index < NodeWidth/2 {
+		// First time we touch C1? Save the original point for later.
+		if *oldC1 == nil {
+			*oldC1 = &Point{}
+			(*oldC1).Set(n.c1)
+		}
+		// We update C1 directly in `n`. We have our original copy in oldC1.
+		if err := n.updateCn(index, value, n.c1); err != nil {
+			return err
+		}
+	} else {
+		// First time we touch C2? Save the original point for later.
+		if *oldC2 == nil {
+			*oldC2 = &Point{}
+			(*oldC2).Set(n.c2)
+		}
+		// We update C2 directly in `n`. We have our original copy in oldC2.
+		if err := n.updateCn(index, value, n.c2); err != nil {
+			return err
+		}
+	}
+	n.values[index] = value
+	n.resetProofCache()
+	return nil
+}
+
+// updateCDeferred updates the leaf commitment after a series of calls to
+// updateCnDeferred, batching the Fr transformation of the touched C1 and C2.
+func (n *LeafNode) updateCDeferred(oldC1, oldC2 *Point) error {
 	// We have three potential cases here:
 	// 1. We have touched C1 and C2: we Fr-batch old1, old2 and newC1, newC2. (4x gain ratio)
 	// 2. We have touched only one CX: we Fr-batch oldX and newCX. (2x gain ratio)
@@ -1313,6 +3064,68 @@ func (n *LeafNode) updateMultipleLeaves(values [][]byte) error { // skipcq: GO-R
 	return nil
 }
 
+// DeleteMultiple deletes the values at the given suffixes, batching the
+// update of the leaf commitment. The result is the same as calling Delete
+// for each suffix. If no value is left, the leaf is emptied and its
+// commitment isn't updated, as it is meant to be removed from its parent.
+func (n *LeafNode) DeleteMultiple(suffixes []byte) error {
+	if n.isPOAStub {
+		return errIsPOAStub
+	}
+
+	var deleted [NodeWidth]bool
+	for _, suffix := range suffixes {
+		deleted[suffix] = true
+	}
+	isCempty := true
+	for i, v := range n.values {
+		if v != nil && !deleted[i] {
+			isCempty = false
+			break
+		}
+	}
+	if isCempty {
+		for _, suffix := range suffixes {
+			n.values[suffix] = nil
+		}
+		n.resetProofCache()
+		return nil
+	}
+
+	var oldC1, oldC2 *Point
+	for i := range deleted {
+		if deleted[i] && n.values[i] != nil {
+			if err := n.updateCnDeferred(byte(i), nil, &oldC1, &oldC2); err != nil {
+				return err
+			}
+		}
+	}
+	if err := n.updateCDeferred(oldC1, oldC2); err != nil {
+		return err
+	}
+
+	// Like Delete, clear the commitment of a Cn subtree that
+	// has become empty. Its contribution to C is already zero.
+	if oldC1 != nil && n.isCnEmpty(0) {
+		n.c1 = nil
+	}
+	if oldC2 != nil && n.isCnEmpty(1) {
+		n.c2 = nil
+	}
+	return nil
+}
+
+// isCnEmpty returns true if the C1 (cn = 0) or C2 (cn = 1) subtree of the
+// leaf holds no value.
+func (n *LeafNode) isCnEmpty(cn int) bool {
+	for _, v := range n.values[cn*NodeWidth/2 : (cn+1)*NodeWidth/2] {
+		if len(v) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // Delete deletes a value from the leaf, return `true` as a second
 // return value, if the parent should entirely delete the child.
 func (n *LeafNode) Delete(k []byte, _ NodeResolverFn) (bool, error) {
@@ -1321,9 +3134,14 @@ func (n *LeafNode) Delete(k []byte, _ NodeResolverFn) (bool, error) {
 		return false, nil
 	}
 
+	if n.isPOAStub {
+		return false, errIsPOAStub
+	}
+
 	// Erase the value it used to contain
 	original := n.values[k[StemSize]] // save original value
 	n.values[k[StemSize]] = nil
+	n.resetProofCache()
 
 	// Check if a Cn subtree is entirely empty, or if
 	// the entire subtree is empty.
@@ -1431,11 +3249,24 @@ func (n *LeafNode) Hash() *Fr {
 	return &hash
 }
 
+// Commitment returns the commitment of the leaf, and panics if it hasn't
+// been computed. See TryCommitment for a version returning an error.
 func (n *LeafNode) Commitment() *Point {
+	comm, err := n.TryCommitment()
+	if err != nil {
+		panic(err)
+	}
+	return comm
+}
+
+// TryCommitment returns the commitment of the leaf, or an error if it
+// hasn't been computed, e.g. for a leaf created by NewLeafNodeWithNoComms
+// whose commitments were never set.
+func (n *LeafNode) TryCommitment() (*Point, error) {
 	if n.commitment == nil {
-		panic("nil commitment")
+		return nil, errCommitmentNotComputed
 	}
-	return n.commitment
+	return n.commitment, nil
 }
 
 func (n *LeafNode) Commit() *Point {
@@ -1460,6 +3291,58 @@ func fillSuffixTreePoly(poly []Fr, values [][]byte) (int, error) {
 	return count, nil
 }
 
+// verifyLeafMarkers recomputes C1 and C2 from the leaf values and
+// compares them with the cached commitments. Proof of absence stubs
+// carry no values, and are skipped.
+func (n *LeafNode) verifyLeafMarkers() error {
+	if n.isPOAStub {
+		return nil
+	}
+
+	for i, cn := range []*Point{n.c1, n.c2} {
+		var poly [NodeWidth]Fr
+		if _, err := fillSuffixTreePoly(poly[:], n.values[i*NodeWidth/2:(i+1)*NodeWidth/2]); err != nil {
+			return fmt.Errorf("filling suffix tree poly: %w", err)
+		}
+		expected := cfg.CommitToPoly(poly[:], 0)
+		if cn == nil {
+			cn = new(Point).SetIdentity()
+		}
+		if !expected.Equal(cn) {
+			return fmt.Errorf("stem %x, C%d: %w", n.stem, i+1, errInvalidLeafMarker)
+		}
+	}
+	return nil
+}
+
+// verifyCommitments recomputes the commitments of the leaf from its
+// values, and checks them against the cached ones. POA stubs don't hold
+// their values, and their commitment is taken as is.
+func (n *LeafNode) verifyCommitments(path []byte) (*Point, error) {
+	if n.isPOAStub {
+		return n.commitment, nil
+	}
+
+	var c1poly, c2poly, poly [NodeWidth]Fr
+	commitment, c1, c2, err := leafCommitments(n.stem, n.values, &c1poly, &c2poly, &poly)
+	if err != nil {
+		return nil, err
+	}
+	for i, cn := range [][2]*Point{{n.c1, c1}, {n.c2, c2}} {
+		cached, expected := cn[0], cn[1]
+		if cached == nil {
+			cached = new(Point).SetIdentity()
+		}
+		if !expected.Equal(cached) {
+			return nil, fmt.Errorf("leaf node at path %x, C%d: %w", path, i+1, errStaleCommitment)
+		}
+	}
+	if n.commitment == nil || !commitment.Equal(n.commitment) {
+		return nil, fmt.Errorf("leaf node at path %x: %w", path, errStaleCommitment)
+	}
+	return commitment, nil
+}
+
 // leafToComms turns a leaf into two commitments of the suffix
 // and extension tree.
 func leafToComms(poly []Fr, val []byte) error {
@@ -1490,7 +3373,30 @@ func leafToComms(poly []Fr, val []byte) error {
 	return nil
 }
 
+// LeafProofItems returns the proof elements that open this leaf for the
+// given suffixes, i.e. the openings of the leaf commitment and of its
+// suffix commitments, but not those of the internal nodes above it.
+func (n *LeafNode) LeafProofItems(suffixes []byte) (*ProofElements, error) {
+	if n.isPOAStub {
+		return nil, errIsPOAStub
+	}
+
+	keys := make(keylist, len(suffixes))
+	for i, suffix := range suffixes {
+		keys[i] = make([]byte, KeySize)
+		copy(keys[i], n.stem)
+		keys[i][StemSize] = suffix
+	}
+	sort.Sort(keys)
+	pe, _, _, err := n.GetProofItems(keys, nil)
+	return pe, err
+}
+
 func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements, []byte, []Stem, error) { // skipcq: GO-R1005
+	if len(keys) == 0 {
+		return &ProofElements{ByPath: map[string]*Point{}}, nil, nil, nil
+	}
+
 	var (
 		poly [NodeWidth]Fr // top-level polynomial
 		pe                 = &ProofElements{
@@ -1506,10 +3412,19 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 		poass []Stem       // list of proof-of-absence stems
 	)
 
+	if n.proofCache != nil {
+		n.proofCache.lock.Lock()
+		defer n.proofCache.lock.Unlock()
+	}
+
 	// Initialize the top-level polynomial with 1 + stem + C1 + C2
-	poly[0].SetUint64(1)
-	if err := StemFromLEBytes(&poly[1], n.stem); err != nil {
-		return nil, nil, nil, fmt.Errorf("error serializing stem '%x': %w", n.stem, err)
+	if n.proofCache != nil && n.proofCache.valid {
+		copy(poly[:], n.proofCache.top[:])
+	} else {
+		poly[0].SetUint64(1)
+		if err := StemFromLEBytes(&poly[1], n.stem); err != nil {
+			return nil, nil, nil, fmt.Errorf("error serializing stem '%x': %w", n.stem, err)
+		}
 	}
 
 	// First pass: add top-level elements first
@@ -1530,8 +3445,10 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 	// If this tree is a full tree (i.e: not a stateless tree), we know we have c1 and c2 values.
 	// Also, we _need_ them independently of hasC1 or hasC2 since the prover needs `Fis`.
 	if !n.isPOAStub {
-		if err := banderwagon.BatchMapToScalarField([]*Fr{&poly[2], &poly[3]}, []*Point{n.c1, n.c2}); err != nil {
-			return nil, nil, nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+		if n.proofCache == nil || !n.proofCache.valid {
+			if err := banderwagon.BatchMapToScalarField([]*Fr{&poly[2], &poly[3]}, []*Point{n.c1, n.c2}); err != nil {
+				return nil, nil, nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+			}
 		}
 	} else if hasC1 || hasC2 || n.c1 != nil || n.c2 != nil {
 		// This LeafNode is a proof of absence stub. It must be true that
@@ -1541,6 +3458,11 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 		return nil, nil, nil, fmt.Errorf("invalid proof of absence stub")
 	}
 
+	if n.proofCache != nil && !n.proofCache.valid {
+		copy(n.proofCache.top[:], poly[:4])
+		n.proofCache.valid = true
+	}
+
 	if hasC1 {
 		pe.Cis = append(pe.Cis, n.commitment)
 		pe.Zis = append(pe.Zis, 2)
@@ -1559,6 +3481,7 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 	// Second pass: add the cn-level elements
 	for _, key := range keys {
 		pe.ByPath[string(key[:n.depth])] = n.commitment
+		pe.naiveCs++
 
 		// Proof of absence: case of a differing stem.
 		if !equalPaths(n.stem, key) {
@@ -1592,19 +3515,25 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 
 		var (
 			suffix   = key[StemSize]
-			suffPoly [NodeWidth]Fr // suffix-level polynomial
-			err      error
+			suffPoly *[NodeWidth]Fr // suffix-level polynomial
 			scomm    *Point
 		)
-		if suffix >= 128 {
-			if _, err = fillSuffixTreePoly(suffPoly[:], n.values[128:]); err != nil {
+		cn := suffix / 128
+		if n.proofCache != nil {
+			suffPoly = n.proofCache.suffPolys[cn]
+		}
+		if suffPoly == nil {
+			suffPoly = new([NodeWidth]Fr)
+			if _, err := fillSuffixTreePoly(suffPoly[:], n.values[int(cn)*128:int(cn+1)*128]); err != nil {
 				return nil, nil, nil, fmt.Errorf("filling suffix tree poly: %w", err)
 			}
+			if n.proofCache != nil {
+				n.proofCache.suffPolys[cn] = suffPoly
+			}
+		}
+		if cn == 1 {
 			scomm = n.c2
 		} else {
-			if _, err = fillSuffixTreePoly(suffPoly[:], n.values[:128]); err != nil {
-				return nil, nil, nil, fmt.Errorf("filling suffix tree poly: %w", err)
-			}
 			scomm = n.c1
 		}
 
@@ -1636,6 +3565,7 @@ func (n *LeafNode) GetProofItems(keys keylist, _ NodeResolverFn) (*ProofElements
 
 		slotPath := string(key[:n.depth]) + string([]byte{2 + suffix/128})
 		pe.ByPath[slotPath] = scomm
+		pe.naiveCs++
 	}
 
 	return pe, esses, poass, nil
@@ -1648,6 +3578,74 @@ func (n *LeafNode) Serialize() ([]byte, error) {
 	return n.serializeLeafWithUncompressedCommitments(cBytes[0], cBytes[1], cBytes[2]), nil
 }
 
+// SerializeCollapsingZeros serializes the leaf like Serialize, except that
+// the values made of zero bytes, i.e. explicit writes of a zero value, aren't
+// written out. Instead, a second bitlist marks them, at the cost of
+// bitlistSize bytes, so this encoding is only used if at least two values
+// are zero. Note that a zero value isn't equivalent to a missing one: it is
+// committed to with the leaf marker, unlike a value that was never written.
+// This is why zero values are restored as such when parsing, so that the
+// leaf commitment is preserved.
+func (n *LeafNode) SerializeCollapsingZeros() ([]byte, error) {
+	var (
+		bitlist, zerolist [bitlistSize]byte
+		zeros             int
+		children          = make([]byte, 0, NodeWidth*LeafValueSize)
+		emptyValue        [LeafValueSize]byte
+	)
+	for i, v := range n.values {
+		if v == nil {
+			continue
+		}
+		setBit(bitlist[:], i)
+		if bytes.Equal(v, emptyValue[:len(v)]) {
+			setBit(zerolist[:], i)
+			zeros++
+			continue
+		}
+		children = append(children, v...)
+		children = append(children, emptyValue[:LeafValueSize-len(v)]...)
+	}
+	if zeros < 2 {
+		return n.Serialize()
+	}
+
+	cBytes := banderwagon.BatchToBytesUncompressed(n.commitment, n.c1, n.c2)
+	result := make([]byte, leafZeroCollapsedChildrenOffset+len(children))
+	result[0] = leafZeroCollapsedType
+	copy(result[leafStemOffset:], n.stem[:StemSize])
+	copy(result[leafBitlistOffset:], bitlist[:])
+	copy(result[leafZeroCollapsedZerolistOffset:], zerolist[:])
+	copy(result[leafZeroCollapsedCommitmentOffset:], cBytes[0][:])
+	copy(result[leafZeroCollapsedCommitmentOffset+banderwagon.UncompressedSize:], cBytes[1][:])
+	copy(result[leafZeroCollapsedCommitmentOffset+2*banderwagon.UncompressedSize:], cBytes[2][:])
+	copy(result[leafZeroCollapsedChildrenOffset:], children)
+	return result, nil
+}
+
+// EnableProofCache makes the leaf keep the polynomials that GetProofItems
+// computes, so that they don't have to be computed again when proving the
+// same leaf several times, as long as it isn't written to in-between. This
+// trades memory, up to two polynomials per leaf, for proving time. The
+// polynomials are shared by the ProofElements returned by GetProofItems,
+// which must not modify them.
+func (n *LeafNode) EnableProofCache() {
+	if n.proofCache == nil {
+		n.proofCache = &leafProofCache{}
+	}
+}
+
+// resetProofCache invalidates the polynomials cached for the proofs of the
+// leaf, it must be called each time the leaf is written to.
+func (n *LeafNode) resetProofCache() {
+	if n.proofCache != nil {
+		n.proofCache.lock.Lock()
+		n.proofCache.valid = false
+		n.proofCache.suffPolys = [2]*[NodeWidth]Fr{}
+		n.proofCache.lock.Unlock()
+	}
+}
+
 func (n *LeafNode) Copy() VerkleNode {
 	l := &LeafNode{}
 	l.stem = make([]byte, len(n.stem))
@@ -1692,7 +3690,10 @@ func (n *LeafNode) Value(i int) []byte {
 func (n *LeafNode) toDot(parent, path string) string {
 	var hash Fr
 	n.Commitment().MapToScalarField(&hash)
-	ret := fmt.Sprintf("leaf%s [label=\"L: %x\nC: %x\nStem: %x\nC₁: %x\nC₂:%x\"]\n%s -> leaf%s\n", path, hash.Bytes(), n.commitment.Bytes(), n.stem, n.c1.Bytes(), n.c2.Bytes(), parent, path)
+	ret := fmt.Sprintf("leaf%s [label=\"L: %x\nC: %x\nStem: %x\nC₁: %x\nC₂:%x\"]\n", path, hash.Bytes(), n.commitment.Bytes(), n.stem, n.c1.Bytes(), n.c2.Bytes())
+	if len(parent) > 0 {
+		ret = fmt.Sprintf("%s%s -> leaf%s\n", ret, parent, path)
+	}
 	for i, v := range n.values {
 		if len(v) != 0 {
 			ret = fmt.Sprintf("%sval%s%02x [label=\"%x\"]\nleaf%s -> val%s%02x\n", ret, path, i, v, path, path, i)
@@ -1705,10 +3706,123 @@ func (n *LeafNode) setDepth(d byte) {
 	n.depth = d
 }
 
+func (n *LeafNode) Size() int {
+	size := int(unsafe.Sizeof(*n)) + len(n.stem) + len(n.values)*int(unsafe.Sizeof(n.values[0]))
+	for _, v := range n.values {
+		size += len(v)
+	}
+	for _, c := range []*Point{n.commitment, n.c1, n.c2} {
+		if c != nil {
+			size += pointSize
+		}
+	}
+	if n.proofCache != nil {
+		size += int(unsafe.Sizeof(*n.proofCache))
+		for _, p := range n.proofCache.suffPolys {
+			if p != nil {
+				size += int(unsafe.Sizeof(*p))
+			}
+		}
+	}
+	return size
+}
+
 func (n *LeafNode) Values() [][]byte {
 	return n.values
 }
 
+// HasValue reports whether the leaf holds a value at suffix. Proof of
+// absence stubs hold no values.
+func (n *LeafNode) HasValue(suffix byte) bool {
+	return n.values != nil && n.values[suffix] != nil
+}
+
+// PresentSuffixes returns the suffixes that hold a value, in ascending
+// order. Deleted values are excluded, be they removed from the leaf or
+// cleared by writing zero bytes, as PostStateTreeFromStateDiff does.
+func (n *LeafNode) PresentSuffixes() []byte {
+	var suffixes []byte
+	for i, v := range n.values {
+		if len(bytes.TrimLeft(v, "\x00")) > 0 {
+			suffixes = append(suffixes, byte(i))
+		}
+	}
+	return suffixes
+}
+
+// ValuesInto copies the values of the leaf into dst, which must hold at least
+// NodeWidth entries. Unlike Values, the caller owns dst and can modify it,
+// and can reuse it across leaves to avoid allocating a slice for each one.
+// The values themselves are shared with the leaf and must not be modified.
+func (n *LeafNode) ValuesInto(dst [][]byte) {
+	if n.values == nil {
+		// proof of absence stubs have no values
+		clear(dst[:NodeWidth])
+		return
+	}
+	copy(dst[:NodeWidth], n.values)
+}
+
+// Export returns the stem, values and depth of the leaf, which can be fed
+// back to ImportLeafNode. The stem and the values slice are copies, but the
+// values themselves are shared with the leaf and must not be modified. Proof
+// of absence stubs hold no values, which are returned as nil.
+func (n *LeafNode) Export() (stem []byte, values [][]byte, depth byte) {
+	stem = bytes.Clone(n.stem)
+	if n.values != nil {
+		values = make([][]byte, NodeWidth)
+		copy(values, n.values)
+	}
+	return stem, values, n.depth
+}
+
+// WithStem returns a new leaf holding the same values as n, at stem newStem.
+// C1 and C2 only depend on the values, so they are reused as is, and only
+// the commitment to [1, stem, C1, C2] is recomputed. Like for NewLeafNode,
+// the depth of the new leaf is 0, and is set when it is inserted in a tree.
+func (n *LeafNode) WithStem(newStem []byte) (*LeafNode, error) {
+	if len(newStem) != StemSize {
+		return nil, fmt.Errorf("invalid stem length %d, expected %d", len(newStem), StemSize)
+	}
+	if n.isPOAStub {
+		return nil, errIsPOAStub
+	}
+	if n.commitment == nil {
+		return nil, errCommitmentNotComputed
+	}
+
+	// A nil C1 or C2 is left by deletions that empty half of the leaf,
+	// and stands for the identity.
+	var c1, c2 Point
+	c1.SetIdentity()
+	c2.SetIdentity()
+	if n.c1 != nil {
+		c1.Set(n.c1)
+	}
+	if n.c2 != nil {
+		c2.Set(n.c2)
+	}
+
+	var poly [NodeWidth]Fr
+	poly[0].SetUint64(1)
+	if err := StemFromLEBytes(&poly[1], newStem); err != nil {
+		return nil, err
+	}
+	if err := banderwagon.BatchMapToScalarField([]*Fr{&poly[2], &poly[3]}, []*Point{&c1, &c2}); err != nil {
+		return nil, fmt.Errorf("batch mapping to scalar fields: %s", err)
+	}
+
+	values := make([][]byte, NodeWidth)
+	copy(values, n.values)
+	return &LeafNode{
+		stem:       bytes.Clone(newStem),
+		values:     values,
+		commitment: GetConfig().CommitToPoly(poly[:], NodeWidth-4),
+		c1:         &c1,
+		c2:         &c2,
+	}, nil
+}
+
 func setBit(bitlist []byte, index int) {
 	bitlist[index/8] |= mask[index%8]
 }
@@ -1718,6 +3832,29 @@ func ToDot(root VerkleNode) string {
 	return fmt.Sprintf("digraph D {\n%s}", root.toDot("", ""))
 }
 
+// ToDotAtPath is like ToDot, but only renders the subtree rooted at the
+// node reached by following path from root. If a leaf is found before the
+// path is exhausted, that leaf is rendered. Hashed nodes aren't resolved,
+// and are rendered as a placeholder.
+func ToDotAtPath(root VerkleNode, path []byte) string {
+	root.Commit()
+	node := root
+	var depth int
+walk:
+	for ; depth < len(path); depth++ {
+		switch n := node.(type) {
+		case *InternalNode:
+			node = n.children[path[depth]]
+		default:
+			break walk
+		}
+	}
+	if _, ok := node.(Empty); ok {
+		return "digraph D {\n}"
+	}
+	return fmt.Sprintf("digraph D {\n%s}", node.toDot("", fmt.Sprintf("%x", path[:depth])))
+}
+
 // SerializedNode contains a serialization of a tree node.
 // It provides everything that the client needs to save the node to the database.
 // For example, CommitmentBytes is usually use as key and SerializedBytes as value.
@@ -1740,6 +3877,54 @@ func (n *InternalNode) BatchSerialize() ([]SerializedNode, error) {
 	paths := make([][]byte, 0, 1024)
 	nodes, paths = n.collectNonHashedNodes(nodes, paths, nil)
 
+	return batchSerializeNodes(nodes, paths)
+}
+
+// BatchSerializeDirty is like BatchSerialize, except that it only serializes
+// the nodes that were modified since the last commit, i.e. the nodes along
+// the modified paths, so that only these get written to the database. The
+// modifications are tracked until the tree gets committed, so this method
+// commits the tree itself, and must be called instead of Commit. Deleted
+// nodes aren't reported.
+func (n *InternalNode) BatchSerializeDirty() ([]SerializedNode, error) {
+	// Collect the nodes before the commit clears the modification flags.
+	var (
+		nodes []VerkleNode
+		paths [][]byte
+	)
+	if n.IsDirty() {
+		nodes, paths = n.collectDirtyNodes(nodes, paths, nil)
+	}
+	n.Commit()
+
+	return batchSerializeNodes(nodes, paths)
+}
+
+func (n *InternalNode) collectDirtyNodes(list []VerkleNode, paths [][]byte, path []byte) ([]VerkleNode, [][]byte) {
+	list = append(list, n)
+	paths = append(paths, path)
+	for i := range n.children {
+		// The modified children of a node whose commitment has been
+		// dropped aren't tracked, so any of them could have changed.
+		if _, ok := n.cow[byte(i)]; !ok && n.commitment != nil {
+			continue
+		}
+		switch child := n.children[i].(type) {
+		case *LeafNode:
+			list = append(list, child)
+			paths = append(paths, childPath(path, byte(i)))
+		case *InternalNode:
+			if child.IsDirty() {
+				list, paths = child.collectDirtyNodes(list, paths, childPath(path, byte(i)))
+			}
+		}
+	}
+	return list, paths
+}
+
+// batchSerializeNodes serializes a list of committed nodes, whose paths are
+// given in the same order.
+func batchSerializeNodes(nodes []VerkleNode, paths [][]byte) ([]SerializedNode, error) {
 	// We collect all the *Point, so we can batch all projective->affine transformations.
 	pointsToCompress := make([]*Point, 0, 3*len(nodes))
 	// Contains a map between VerkleNode and the index in the serializedPoints containing the commitment below.
@@ -318,3 +318,46 @@ func TestPaddingInFromLEBytes(t *testing.T) {
 		t.Fatal("byte alignment")
 	}
 }
+
+func TestCommitToPolynomial(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	values[200] = fourtyKeyTest
+	leaf, err := NewLeafNode(KeyToStem(ffx32KeyTest), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild the extension polynomial of the leaf.
+	poly := make([]Fr, 4)
+	poly[0].SetOne()
+	if err := StemFromLEBytes(&poly[1], leaf.stem); err != nil {
+		t.Fatal(err)
+	}
+	leaf.c1.MapToScalarField(&poly[2])
+	leaf.c2.MapToScalarField(&poly[3])
+
+	comm, err := CommitToPolynomial(poly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comm.Equal(leaf.Commitment()) {
+		t.Fatalf("invalid commitment, got %x, expected %x", comm.Bytes(), leaf.Commitment().Bytes())
+	}
+
+	for z := 0; z < NodeWidth; z++ {
+		var expected Fr
+		if z < len(poly) {
+			expected = poly[z]
+		}
+		if eval := EvaluatePolynomialAt(poly, byte(z)); !eval.Equal(&expected) {
+			t.Fatalf("invalid evaluation at %d, got %x, expected %x", z, eval.Bytes(), expected.Bytes())
+		}
+	}
+
+	if _, err := CommitToPolynomial(make([]Fr, NodeWidth+1)); err == nil {
+		t.Fatal("expected an error when committing to a polynomial that is too long")
+	}
+}
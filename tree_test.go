@@ -37,12 +37,14 @@ import (
 	mRand "math/rand/v2"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
 	"testing/quick"
 	"time"
 
+	"github.com/crate-crypto/go-ipa/banderwagon"
 	"github.com/davecgh/go-spew/spew"
 )
 
@@ -793,7 +795,7 @@ func TestNodeSerde(t *testing.T) {
 	resRoot.children[0] = resLeaf0
 	resRoot.children[64] = resLeaf64
 
-	if !isInternalEqual(root, resRoot) {
+	if !NodesEqual(root, resRoot) {
 		t.Fatalf("parsed node not equal, %x != %x", root.commitment.BytesUncompressedTrusted(), resRoot.commitment.BytesUncompressedTrusted())
 	}
 
@@ -802,54 +804,6 @@ func TestNodeSerde(t *testing.T) {
 	}
 }
 
-func isInternalEqual(a, b *InternalNode) bool {
-	for i := 0; i < NodeWidth; i++ {
-		c := a.children[i]
-		switch c.(type) {
-		case Empty:
-			if _, ok := b.children[i].(Empty); !ok {
-				return false
-			}
-		case HashedNode:
-			if _, ok := b.children[i].(HashedNode); !ok {
-				return false
-			}
-		case *LeafNode:
-			ln, ok := b.children[i].(*LeafNode)
-			if !ok {
-				return false
-			}
-			if !isLeafEqual(c.(*LeafNode), ln) {
-				return false
-			}
-		case *InternalNode:
-			in, ok := b.children[i].(*InternalNode)
-			if !ok {
-				return false
-			}
-			if !isInternalEqual(c.(*InternalNode), in) {
-				return false
-			}
-		}
-	}
-
-	return true
-}
-
-func isLeafEqual(a, b *LeafNode) bool {
-	if !bytes.Equal(a.stem, b.stem) {
-		return false
-	}
-
-	for i, v := range a.values {
-		if !bytes.Equal(v, b.values[i]) {
-			return false
-		}
-	}
-
-	return true
-}
-
 func TestGetResolveFromHash(t *testing.T) {
 	//TODO: fix this test when we take a final decision about FlushAtDepth API.
 	t.SkipNow()
@@ -1017,6 +971,52 @@ func TestToDot(t *testing.T) {
 	}
 }
 
+func TestToDotAtPath(t *testing.T) {
+	t.Parallel()
+
+	fourtytwoKeyTest, _ := hex.DecodeString("4020000000000000000000000000000000000000000000000000000000000000")
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, fourtyKeyTest, fourtytwoKeyTest} {
+		if err := root.Insert(key, zeroKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dot := ToDotAtPath(root, []byte{0x40})
+	for _, node := range []string{"internal40 ", "leaf4000 ", "leaf4020 "} {
+		if !strings.Contains(dot, node) {
+			t.Errorf("output is missing node %s: %s", node, dot)
+		}
+	}
+	for _, node := range []string{"internal ", "leaf00 "} {
+		if strings.Contains(dot, node) {
+			t.Errorf("output contains node %s outside of the subtree: %s", node, dot)
+		}
+	}
+
+	// The path goes through the leaf.
+	dot = ToDotAtPath(root, fourtytwoKeyTest[:StemSize])
+	if !strings.Contains(dot, "leaf4020 ") || strings.Contains(dot, "leaf4000 ") || strings.Contains(dot, "-> leaf") {
+		t.Errorf("invalid output for a path into a leaf: %s", dot)
+	}
+
+	if dot = ToDotAtPath(root, []byte{0x80}); dot != "digraph D {\n}" {
+		t.Errorf("invalid output for an empty subtree: %s", dot)
+	}
+
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dot = ToDotAtPath(view, []byte{0x40, 0x20}); !strings.Contains(dot, "hash40 ") || strings.Contains(dot, "-> hash") {
+		t.Errorf("invalid output for a path through a hashed node: %s", dot)
+	}
+}
+
 func TestEmptyCommitment(t *testing.T) {
 	t.Parallel()
 
@@ -1880,3 +1880,2583 @@ func TestRandomExtracted(t *testing.T) {
 		t.Fatalf("got %x, expected %x", val, val_k1490_0)
 	}
 }
+
+func TestVerifyCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	keys := randomKeys(t, 1000)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}
+	root.Commit()
+	// Go through the diff-update path as well.
+	for _, key := range keys[:100] {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}
+	for _, key := range keys[100:200] {
+		if _, err := root.Delete(key, nil); err != nil {
+			t.Fatalf("error deleting: %v", err)
+		}
+	}
+	if err := root.VerifyCommitments(); err == nil {
+		t.Fatal("expected an error verifying an uncommitted tree")
+	}
+	root.Commit()
+	if err := root.VerifyCommitments(); err != nil {
+		t.Fatalf("unexpected error verifying commitments: %v", err)
+	}
+
+	var (
+		internal *InternalNode
+		index    int
+	)
+	for i, child := range root.children {
+		if c, ok := child.(*InternalNode); ok {
+			internal, index = c, i
+			break
+		}
+	}
+	if internal == nil {
+		t.Fatal("no internal node found at depth 1")
+	}
+	var leaf *LeafNode
+	for _, child := range internal.children {
+		if c, ok := child.(*LeafNode); ok {
+			leaf = c
+			break
+		}
+	}
+	if leaf == nil {
+		t.Fatal("no leaf found at depth 2")
+	}
+
+	// Corrupt the cached commitment of the leaf.
+	saved := leaf.commitment
+	leaf.commitment = new(Point).Add(saved, saved)
+	err := root.VerifyCommitments()
+	if !errors.Is(err, errStaleCommitment) {
+		t.Fatalf("expected error %v, got %v", errStaleCommitment, err)
+	}
+	if expected := fmt.Sprintf("leaf node at path %x:", leaf.stem[:2]); !strings.Contains(err.Error(), expected) {
+		t.Fatalf("error %q doesn't name the corrupted leaf", err)
+	}
+	leaf.commitment = saved
+
+	// Corrupt the cached commitment of the internal node.
+	saved = internal.commitment
+	internal.commitment = new(Point).Add(saved, saved)
+	err = root.VerifyCommitments()
+	if !errors.Is(err, errStaleCommitment) {
+		t.Fatalf("expected error %v, got %v", errStaleCommitment, err)
+	}
+	if expected := fmt.Sprintf("internal node at path %x:", []byte{byte(index)}); !strings.Contains(err.Error(), expected) {
+		t.Fatalf("error %q doesn't name the corrupted node", err)
+	}
+	internal.commitment = saved
+
+	if err := root.VerifyCommitments(); err != nil {
+		t.Fatalf("unexpected error verifying commitments: %v", err)
+	}
+}
+
+func TestVerifyLeafMarkers(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}
+	root.Commit()
+	if err := root.(*InternalNode).VerifyLeafMarkers(nil); err != nil {
+		t.Fatalf("unexpected error verifying leaf markers: %v", err)
+	}
+
+	// Build a leaf whose C1 only carries the leaf marker for zero
+	// values, as another implementation could have done.
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	values[1] = zero32[:]
+	ln, err := NewLeafNode(fourtyKeyTest[:StemSize], values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c1poly [NodeWidth]Fr
+	if _, err := fillSuffixTreePoly(c1poly[:], values[:NodeWidth/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := FromLEBytes(&c1poly[0], testValue[:16]); err != nil {
+		t.Fatal(err)
+	}
+	ln.c1 = GetConfig().CommitToPoly(c1poly[:], 0)
+	ln.setDepth(1)
+	if err := root.(*InternalNode).SetChild(int(fourtyKeyTest[0]), ln); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.(*InternalNode).VerifyLeafMarkers(nil); !errors.Is(err, errInvalidLeafMarker) {
+		t.Fatalf("expected error %v, got %v", errInvalidLeafMarker, err)
+	}
+}
+
+func TestLeafBuilder(t *testing.T) {
+	t.Parallel()
+
+	var lb LeafBuilder
+	for i := 0; i < 10; i++ {
+		stem := make([]byte, StemSize)
+		if _, err := rand.Read(stem); err != nil {
+			t.Fatal(err)
+		}
+		values := make([][]byte, NodeWidth)
+		for j := 0; j <= i; j++ {
+			values[(j*37)%NodeWidth] = testValue
+		}
+		if i%2 == 0 {
+			values[CodeHashVectorPosition] = EmptyCodeHash
+		}
+
+		expected, err := NewLeafNode(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := lb.Build(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.commitment.Equal(expected.commitment) || !got.c1.Equal(expected.c1) || !got.c2.Equal(expected.c2) {
+			t.Fatalf("leaf %d: commitments differ between the builder and NewLeafNode", i)
+		}
+	}
+}
+
+func BenchmarkLeafBuilder(b *testing.B) {
+	stem := make([]byte, StemSize)
+	values := make([][]byte, NodeWidth)
+	values[0] = zero32[:]
+	values[1] = testValue
+	values[NodeWidth-1] = testValue
+
+	b.Run("NewLeafNode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := NewLeafNode(stem, values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("LeafBuilder", func(b *testing.B) {
+		b.ReportAllocs()
+		var lb LeafBuilder
+		for i := 0; i < b.N; i++ {
+			if _, err := lb.Build(stem, values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// flushToResolver flushes the tree, and returns a resolver that serves
+// the flushed nodes.
+func flushToResolver(t *testing.T, root *InternalNode) NodeResolverFn {
+	t.Helper()
+
+	nodes := map[string][]byte{}
+	root.Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			t.Fatalf("error serializing node at path %x: %v", path, err)
+		}
+		nodes[string(path)] = serialized
+	})
+	return func(path []byte) ([]byte, error) {
+		serialized, ok := nodes[string(path)]
+		if !ok {
+			return nil, fmt.Errorf("node not found at path %x", path)
+		}
+		return serialized, nil
+	}
+}
+
+func TestTopLevelLeafCounts(t *testing.T) {
+	t.Parallel()
+
+	expected := map[byte]int{0x00: 50, 0x80: 10, 0xff: 1}
+	root := New()
+	for prefix, count := range expected {
+		for i := 0; i < count; i++ {
+			key := make([]byte, KeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+			key[0] = prefix
+			if err := root.Insert(key, testValue, nil); err != nil {
+				t.Fatalf("error inserting: %v", err)
+			}
+		}
+	}
+	resolver := flushToResolver(t, root.(*InternalNode))
+
+	counts, err := root.(*InternalNode).TopLevelLeafCounts(resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, count := range counts {
+		if count != expected[byte(i)] {
+			t.Fatalf("invalid leaf count for child %02x: got %d, expected %d", i, count, expected[byte(i)])
+		}
+	}
+}
+
+func TestContainsMany(t *testing.T) {
+	t.Parallel()
+
+	root := New()
+	keys := randomKeys(t, 200)
+	for _, key := range keys[:100] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}
+	// Add a few absent keys sharing their stem with present ones.
+	for _, key := range keys[:10] {
+		sibling := append([]byte{}, key...)
+		sibling[StemSize]++
+		keys = append(keys, sibling)
+	}
+
+	expected := make([]bool, len(keys))
+	for i, key := range keys {
+		value, err := root.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = value != nil
+	}
+
+	resolver := flushToResolver(t, root.(*InternalNode))
+	resolved := map[string]int{}
+	countingResolver := func(path []byte) ([]byte, error) {
+		resolved[string(path)]++
+		return resolver(path)
+	}
+	present, err := root.(*InternalNode).ContainsMany(keys, countingResolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if present[i] != expected[i] {
+			t.Fatalf("key %x: got presence %v, expected %v", keys[i], present[i], expected[i])
+		}
+	}
+	for path, count := range resolved {
+		if count != 1 {
+			t.Fatalf("node at path %x resolved %d times", path, count)
+		}
+	}
+}
+
+func BenchmarkContainsMany(b *testing.B) {
+	root := New()
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = make([]byte, KeySize)
+		if _, err := rand.Read(keys[i]); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(keys[i], testValue, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Start each iteration from a fully flushed tree, so that the
+	// cost of resolving the nodes is accounted for.
+	nodes := map[string][]byte{}
+	root.(*InternalNode).Flush(func(path []byte, node VerkleNode) {
+		serialized, err := node.Serialize()
+		if err != nil {
+			b.Fatal(err)
+		}
+		nodes[string(path)] = serialized
+	})
+	resolver := func(path []byte) ([]byte, error) {
+		return nodes[string(path)], nil
+	}
+	flushedRoot := func() *InternalNode {
+		root, err := ParseNode(nodes[""], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return root.(*InternalNode)
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root := flushedRoot()
+			for _, key := range keys {
+				if _, err := root.Get(key, resolver); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("ContainsMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := flushedRoot().ContainsMany(keys, resolver); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestPendingChangesAfterDropCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	internal := root.children[0].(*InternalNode)
+	oldComm := new(Point).Set(internal.commitment)
+
+	root.DropCommitments(0)
+	if err := root.Insert(oneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	changes := root.PendingChanges()
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 pending changes, got %d", len(changes))
+	}
+	change := changes[string([]byte{0})]
+	if change[0] == nil || !change[0].Equal(oldComm) || change[1] != nil {
+		t.Fatalf("invalid change for the dropped node: %v", change)
+	}
+	for _, index := range []byte{0, 1} {
+		change, ok := changes[string([]byte{0, index})]
+		if !ok {
+			t.Fatalf("missing pending change for path %x", []byte{0, index})
+		}
+		if change[0] != nil || !change[1].Equal(internal.children[index].Commitment()) {
+			t.Fatalf("invalid change for the child of a dropped node: %v", change)
+		}
+	}
+
+	root.Commit()
+	if changes := root.PendingChanges(); len(changes) != 0 {
+		t.Fatalf("expected no pending changes after commit, got %d", len(changes))
+	}
+}
+
+func TestPendingChanges(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if changes := root.PendingChanges(); len(changes) != 0 {
+		t.Fatalf("expected no pending changes in an empty tree, got %d", len(changes))
+	}
+
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	changes := root.PendingChanges()
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 pending change, got %d", len(changes))
+	}
+	change, ok := changes[string([]byte{zeroKeyTest[0]})]
+	if !ok {
+		t.Fatalf("missing pending change for child %x", zeroKeyTest[0])
+	}
+	if !change[0].Equal(&banderwagon.Identity) {
+		t.Fatalf("invalid old commitment, got %x, expected identity", change[0].Bytes())
+	}
+	if !change[1].Equal(root.children[zeroKeyTest[0]].Commitment()) {
+		t.Fatalf("invalid new commitment, got %x, expected %x", change[1].Bytes(), root.children[zeroKeyTest[0]].Commitment().Bytes())
+	}
+
+	root.Commit()
+	if changes := root.PendingChanges(); len(changes) != 0 {
+		t.Fatalf("expected no pending changes after commit, got %d", len(changes))
+	}
+
+	// Inserting a key that forks the leaf at the next level should
+	// report both the root's child and the new internal node's children.
+	if err := root.Insert(forkOneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	changes = root.PendingChanges()
+	for _, path := range [][]byte{{0}, {0, 0}, {0, 1}} {
+		if _, ok := changes[string(path)]; !ok {
+			t.Fatalf("missing pending change for path %x", path)
+		}
+	}
+}
+
+func TestInsertResolving(t *testing.T) {
+	t.Parallel()
+
+	// Build a tree in which the keys share their first 4 bytes, so
+	// that their leaves are deep in the tree.
+	keys := make([][]byte, 3)
+	for i := range keys {
+		keys[i] = make([]byte, KeySize)
+		copy(keys[i], []byte{1, 2, 3, 4, byte(i)})
+	}
+	root := New().(*InternalNode)
+	for _, key := range keys[:2] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	// Start from a fully flushed tree.
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	batchResolver := func(paths [][]byte) ([][]byte, error) {
+		calls++
+		ret := make([][]byte, len(paths))
+		for i, path := range paths {
+			ret[i], _ = resolver(path)
+		}
+		return ret, nil
+	}
+	if err := flushed.(*InternalNode).InsertResolving(keys[2], testValue, batchResolver); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call to the batch resolver, got %d", calls)
+	}
+
+	expected := New()
+	for _, key := range keys {
+		if err := expected.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !flushed.Commit().Equal(expected.Commit()) {
+		t.Fatalf("invalid root commitment after insert, got %x, expected %x", flushed.Commitment().Bytes(), expected.Commitment().Bytes())
+	}
+
+	// Inserting into an already-resolved leaf shouldn't call the resolver.
+	if err := flushed.(*InternalNode).InsertResolving(keys[2], fourtyKeyTest, batchResolver); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected no additional call to the batch resolver, got %d", calls-1)
+	}
+}
+
+func TestStructuralChecksum(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root1, root2 := New().(*InternalNode), New().(*InternalNode)
+	for _, key := range keys {
+		if err := root1.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Insert the keys in reverse order in the second tree.
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := root2.Insert(keys[i], testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if root1.StructuralChecksum() != root2.StructuralChecksum() {
+		t.Fatalf("equal trees have different checksums: %x != %x", root1.StructuralChecksum(), root2.StructuralChecksum())
+	}
+
+	// The checksum doesn't depend on the tree being committed.
+	checksum := root1.StructuralChecksum()
+	root1.Commit()
+	if root1.StructuralChecksum() != checksum {
+		t.Fatalf("checksum changed after commit: %x != %x", root1.StructuralChecksum(), checksum)
+	}
+
+	if err := root2.Insert(keys[42], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if root1.StructuralChecksum() == root2.StructuralChecksum() {
+		t.Fatal("trees differing by one value have the same checksum")
+	}
+}
+
+func TestAllCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// The tree contains the root, an internal node at path 00 and
+	// four leaves.
+	expected := map[string]VerkleNode{
+		"":         root,
+		"\x00":     root.children[0],
+		"\x00\x00": root.children[0].(*InternalNode).children[0],
+		"\x00\x01": root.children[0].(*InternalNode).children[1],
+		"\x40":     root.children[0x40],
+		"\xff":     root.children[0xff],
+	}
+	comms := root.AllCommitments()
+	if len(comms) != len(expected) {
+		t.Fatalf("invalid number of commitments, got %d, expected %d", len(comms), len(expected))
+	}
+	for path, node := range expected {
+		comm, ok := comms[path]
+		if !ok {
+			t.Fatalf("missing commitment for path %x", path)
+		}
+		if comm != node.Commitment().Bytes() {
+			t.Fatalf("invalid commitment for path %x, got %x, expected %x", path, comm, node.Commitment().Bytes())
+		}
+	}
+}
+
+func TestSplitJoinKey(t *testing.T) {
+	t.Parallel()
+
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, fourtyKeyTest, ffx32KeyTest} {
+		stem, suffix, err := SplitKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stem, KeyToStem(key)) || suffix != key[StemSize] {
+			t.Fatalf("invalid split of key %x: stem %x, suffix %x", key, stem, suffix)
+		}
+		joined, err := JoinKey(stem, suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(joined, key) {
+			t.Fatalf("invalid joined key, got %x, expected %x", joined, key)
+		}
+	}
+
+	if _, _, err := SplitKey(make([]byte, KeySize+1)); err == nil {
+		t.Fatal("expected an error when splitting a 33-byte key")
+	}
+	if _, err := JoinKey(make([]byte, KeySize), 0); err == nil {
+		t.Fatal("expected an error when joining a 32-byte stem")
+	}
+}
+
+func TestDeepestCommonPrefix(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]byte{
+		append([]byte{1, 2, 3, 4}, make([]byte, KeySize-4)...),
+		append([]byte{1, 2, 3, 5}, make([]byte, KeySize-4)...),
+		append([]byte{1, 2, 3, 6}, make([]byte, KeySize-4)...),
+	}
+	if prefix := DeepestCommonPrefix(keys); !bytes.Equal(prefix, []byte{1, 2, 3}) {
+		t.Fatalf("invalid prefix, got %x, expected 010203", prefix)
+	}
+	if prefix := DeepestCommonPrefix([][]byte{zeroKeyTest, fourtyKeyTest, ffx32KeyTest}); len(prefix) != 0 {
+		t.Fatalf("invalid prefix, got %x, expected an empty prefix", prefix)
+	}
+	// Keys of the same stem share the whole stem.
+	if prefix := DeepestCommonPrefix([][]byte{zeroKeyTest, oneKeyTest}); !bytes.Equal(prefix, KeyToStem(zeroKeyTest)) {
+		t.Fatalf("invalid prefix, got %x, expected %x", prefix, KeyToStem(zeroKeyTest))
+	}
+}
+
+func TestCommitAndSnapshotRoot(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 20)
+	root := New().(*InternalNode)
+	for _, key := range keys[:10] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block1Root, undo := root.CommitAndSnapshotRoot()
+
+	for _, key := range keys[10:] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Also update a value inserted in the first block.
+	if err := root.Insert(keys[0], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if block2Root := root.Commit(); block2Root.Equal(block1Root) {
+		t.Fatal("root didn't change after inserting the second block")
+	}
+
+	undo()
+	if !root.Commitment().Equal(block1Root) {
+		t.Fatalf("invalid root after undo, got %x, expected %x", root.Commitment().Bytes(), block1Root.Bytes())
+	}
+	if val, err := root.Get(keys[0], nil); err != nil || !bytes.Equal(val, testValue) {
+		t.Fatalf("invalid value after undo, got %x, expected %x (err=%v)", val, testValue, err)
+	}
+	if val, err := root.Get(keys[15], nil); err != nil || val != nil {
+		t.Fatalf("found a value inserted after the snapshot: %x (err=%v)", val, err)
+	}
+
+	// The tree must remain usable after the undo.
+	if err := root.Insert(keys[15], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := New()
+	for _, key := range append(keys[:10:10], keys[15]) {
+		if err := expected.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatalf("invalid root after undo and insert, got %x, expected %x", root.Commitment().Bytes(), expected.Commitment().Bytes())
+	}
+}
+
+func TestCommitAndSnapshotRootJournal(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 1_000)
+	root := New().(*InternalNode)
+	for _, key := range keys[:900] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block1Root, undo1 := root.CommitAndSnapshotRoot()
+	block1 := root.Copy()
+
+	// Only the nodes along the modified paths are saved.
+	if err := root.Insert(keys[0], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if journal := root.journal; len(journal.internals) > 4 || len(journal.leaves) != 1 {
+		t.Fatalf("too many saved nodes: %d internal nodes and %d leaves", len(journal.internals), len(journal.leaves))
+	}
+	for _, key := range keys[900:950] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Delete(keys[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	root.DropCommitments(0)
+	block2Root, undo2 := root.CommitAndSnapshotRoot()
+	block2 := root.Copy()
+
+	for _, key := range keys[950:] {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Delete(keys[2], nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+
+	check := func(expectedRoot *Point, expected VerkleNode) {
+		t.Helper()
+		if !root.Commit().Equal(expectedRoot) {
+			t.Fatalf("invalid root after undo, got %x, expected %x", root.Commitment().Bytes(), expectedRoot.Bytes())
+		}
+		if !NodesEqual(root, expected) {
+			t.Fatal("tree differs from the snapshot after undo")
+		}
+		if err := root.VerifyCommitments(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	undo2()
+	check(block2Root, block2)
+	// Reverting to the same snapshot again undoes the changes made
+	// since the last revert.
+	if err := root.Insert(keys[3], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	undo2()
+	check(block2Root, block2)
+
+	// Reverting to an older snapshot reverts the later ones, whose
+	// revert function becomes a no-op.
+	if err := root.Insert(keys[4], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	undo1()
+	check(block1Root, block1)
+	undo2()
+	check(block1Root, block1)
+}
+
+func TestErroringResolver(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if err := root.Insert(fourtyKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	root.Flush(func([]byte, VerkleNode) {})
+
+	_, err := root.Get(fourtyKeyTest, ErroringResolver("reading account"))
+	if err == nil {
+		t.Fatal("expected an error when resolving a hashed node")
+	}
+	if !strings.Contains(err.Error(), "reading account") || !strings.Contains(err.Error(), hex.EncodeToString(fourtyKeyTest[:1])) {
+		t.Fatalf("error lacks context: %v", err)
+	}
+}
+
+func TestRecordingResolver(t *testing.T) {
+	t.Parallel()
+
+	deepKey := append([]byte{0, 0, 1}, make([]byte, KeySize-3)...)
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, deepKey, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver, recorded := RecordingResolver(flushToResolver(t, root))
+
+	value, err := root.Get(zeroKeyTest, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, testValue) {
+		t.Fatalf("invalid value, got %x, expected %x", value, testValue)
+	}
+	paths := recorded()
+	expected := [][]byte{{0}, {0, 0}, {0, 0, 0}}
+	if len(paths) != len(expected) {
+		t.Fatalf("invalid number of resolutions, got %d, expected %d", len(paths), len(expected))
+	}
+	for i := range paths {
+		if !bytes.Equal(paths[i], expected[i]) {
+			t.Fatalf("invalid resolution #%d, got %x, expected %x", i, paths[i], expected[i])
+		}
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing, recorded := RecordingResolver(flushToResolver(t, root))
+	cache := NewResolverCache(backing)
+
+	for i := 0; i < 3; i++ {
+		// Use a fresh hashed view of the tree each time, so that the
+		// nodes have to be resolved again.
+		view, err := ParseNode(serialized, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+			value, err := view.Get(key, cache.Resolve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, testValue) {
+				t.Fatalf("invalid value, got %x, expected %x", value, testValue)
+			}
+		}
+	}
+
+	paths := recorded()
+	seen := make(map[string]struct{})
+	for _, path := range paths {
+		if _, ok := seen[string(path)]; ok {
+			t.Fatalf("path %x resolved more than once", path)
+		}
+		seen[string(path)] = struct{}{}
+	}
+	hits, misses := cache.Stats()
+	if misses != len(paths) {
+		t.Fatalf("invalid miss count, got %d, expected %d", misses, len(paths))
+	}
+	if hits != 2*misses {
+		t.Fatalf("invalid hit count, got %d, expected %d", hits, 2*misses)
+	}
+
+	failing := CachingResolver(func([]byte) ([]byte, error) { return nil, errors.New("boom") })
+	if _, err := failing([]byte{0}); err == nil {
+		t.Fatal("expected the backing resolver error")
+	}
+}
+
+func TestInsertIdenticalValue(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comm := new(Point).Set(root.Commit())
+
+	value := append([]byte{}, testValue...)
+	if err := root.Insert(forkOneKeyTest, value, nil); err != nil {
+		t.Fatal(err)
+	}
+	if root.IsDirty() {
+		t.Fatal("re-inserting an identical value made the tree dirty")
+	}
+	if !root.Commit().Equal(comm) {
+		t.Fatal("re-inserting an identical value changed the commitment")
+	}
+
+	if err := root.Insert(forkOneKeyTest, fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.IsDirty() {
+		t.Fatal("inserting a different value didn't make the tree dirty")
+	}
+}
+
+func BenchmarkInsertIdenticalValue(b *testing.B) {
+	root := New().(*InternalNode)
+	keys := make([][]byte, 1_000)
+	for i := range keys {
+		keys[i] = make([]byte, KeySize)
+		if _, err := rand.Read(keys[i]); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(keys[i], testValue, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			if err := root.Insert(key, testValue, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		root.Commit()
+	}
+}
+
+func TestLeafPresentSuffixes(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	stem := KeyToStem(zeroKeyTest)
+	for _, suffix := range []byte{200, 3, 130, 0, 77} {
+		key, _ := JoinKey(stem, suffix)
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, _ := JoinKey(stem, 130)
+	if _, err := root.Delete(deleted, nil); err != nil {
+		t.Fatal(err)
+	}
+	cleared, _ := JoinKey(stem, 3)
+	if err := root.Insert(cleared, zero32[:], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := root.children[0].(*LeafNode)
+	if suffixes := leaf.PresentSuffixes(); !bytes.Equal(suffixes, []byte{0, 77, 200}) {
+		t.Fatalf("invalid present suffixes, got %v, expected [0 77 200]", suffixes)
+	}
+	for _, suffix := range []byte{0, 3, 77, 200} {
+		if !leaf.HasValue(suffix) {
+			t.Fatalf("expected a value at suffix %d", suffix)
+		}
+	}
+	for _, suffix := range []byte{1, 130, 255} {
+		if leaf.HasValue(suffix) {
+			t.Fatalf("unexpected value at suffix %d", suffix)
+		}
+	}
+}
+
+func TestLeafValuesInto(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0], values[130] = testValue, fourtyKeyTest
+	leaf, err := NewLeafNode(KeyToStem(zeroKeyTest), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := make([][]byte, NodeWidth)
+	dst[5] = ffx32KeyTest // stale value from a previous leaf
+	leaf.ValuesInto(dst)
+	for i, v := range leaf.Values() {
+		if !bytes.Equal(dst[i], v) || (dst[i] == nil) != (v == nil) {
+			t.Fatalf("invalid value #%d, got %x, expected %x", i, dst[i], v)
+		}
+	}
+
+	// Modifying dst doesn't affect the leaf.
+	dst[0] = nil
+	if !bytes.Equal(leaf.Values()[0], testValue) {
+		t.Fatal("modifying the destination slice modified the leaf")
+	}
+}
+
+func TestLeafWithStem(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	values[3] = fourtyKeyTest
+	values[200] = ffx32KeyTest
+	leaf, err := NewLeafNode(KeyToStem(zeroKeyTest), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf.setDepth(3)
+	oldComm := new(Point).Set(leaf.commitment)
+
+	newStem := KeyToStem(fourtyKeyTest)
+	rekeyed, err := leaf.WithStem(newStem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := NewLeafNode(newStem, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rekeyed.stem, newStem) || rekeyed.depth != 0 {
+		t.Fatalf("invalid stem or depth: %x, %d", rekeyed.stem, rekeyed.depth)
+	}
+	if !rekeyed.commitment.Equal(expected.commitment) || !rekeyed.c1.Equal(expected.c1) || !rekeyed.c2.Equal(expected.c2) {
+		t.Fatal("rekeyed leaf commitments differ from those of a new leaf")
+	}
+	if !NodesEqual(rekeyed, expected) {
+		t.Fatal("rekeyed leaf differs from a new leaf")
+	}
+	if !bytes.Equal(leaf.stem, KeyToStem(zeroKeyTest)) || !leaf.commitment.Equal(oldComm) {
+		t.Fatal("original leaf was modified")
+	}
+
+	if _, err := leaf.WithStem(newStem[:10]); err == nil {
+		t.Fatal("expected an error for a short stem")
+	}
+	if _, err := NewLeafNodeWithNoComms(KeyToStem(zeroKeyTest), values).WithStem(newStem); !errors.Is(err, errCommitmentNotComputed) {
+		t.Fatalf("expected error %v, got %v", errCommitmentNotComputed, err)
+	}
+	// Deleting all the values of one half of a leaf clears its C1 or C2.
+	root := New().(*InternalNode)
+	for _, suffix := range []byte{5, 200} {
+		key, _ := JoinKey(KeyToStem(zeroKeyTest), suffix)
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	key, _ := JoinKey(KeyToStem(zeroKeyTest), 5)
+	if _, err := root.Delete(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+	leaf = root.children[zeroKeyTest[0]].(*LeafNode)
+	if leaf.c1 != nil {
+		t.Fatal("expected C1 to be cleared by the deletion")
+	}
+	rekeyed, err = leaf.WithStem(newStem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values = make([][]byte, NodeWidth)
+	values[200] = testValue
+	if expected, err = NewLeafNode(newStem, values); err != nil {
+		t.Fatal(err)
+	}
+	if !rekeyed.commitment.Equal(expected.commitment) {
+		t.Fatal("rekeyed leaf commitment differs from that of a new leaf")
+	}
+}
+
+func TestTryCommitment(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	leaf := NewLeafNodeWithNoComms(zeroKeyTest[:StemSize], values)
+	if _, err := leaf.TryCommitment(); !errors.Is(err, errCommitmentNotComputed) {
+		t.Fatalf("expected error %v, got %v", errCommitmentNotComputed, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Commitment didn't panic on a leaf without commitment")
+			}
+		}()
+		leaf.Commitment()
+	}()
+
+	leaf, err := NewLeafNode(zeroKeyTest[:StemSize], values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comm, err := leaf.TryCommitment(); err != nil || comm != leaf.Commitment() {
+		t.Fatalf("unexpected result for a leaf with a commitment: %v, %v", comm, err)
+	}
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	internal := root.children[0].(*InternalNode)
+	if comm, err := internal.TryCommitment(); err != nil || !comm.Equal(internal.Commitment()) {
+		t.Fatalf("unexpected result for a committed node: %v, %v", comm, err)
+	}
+	root.DropCommitments(0)
+	if _, err := internal.TryCommitment(); !errors.Is(err, errCommitmentNotComputed) {
+		t.Fatalf("expected error %v, got %v", errCommitmentNotComputed, err)
+	}
+}
+
+func TestLeafExportImport(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest} {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	leaf := root.children[0].(*InternalNode).children[0].(*LeafNode)
+	stem, values, depth := leaf.Export()
+	if depth != 2 {
+		t.Fatalf("invalid depth, got %d, expected 2", depth)
+	}
+	imported, err := ImportLeafNode(stem, values, depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NodesEqual(leaf, imported) {
+		t.Fatal("imported leaf differs from the exported one")
+	}
+	if !imported.Commitment().Equal(leaf.Commitment()) {
+		t.Fatal("imported leaf has a different commitment")
+	}
+
+	// The exported stem and values are copies, and so are the imported ones.
+	stem[0] = 0xff
+	values[0] = nil
+	if leaf.stem[0] != 0 || leaf.values[0] == nil {
+		t.Fatal("modifying the export altered the leaf")
+	}
+	if imported.stem[0] != 0 || imported.values[0] == nil {
+		t.Fatal("modifying the export altered the imported leaf")
+	}
+
+	// Proof of absence stubs can't be imported back.
+	stub := &LeafNode{stem: KeyToStem(fourtyKeyTest), commitment: leaf.commitment, isPOAStub: true}
+	stubStem, stubValues, stubDepth := stub.Export()
+	if stubValues != nil {
+		t.Fatal("a proof of absence stub exported values")
+	}
+	if _, err := ImportLeafNode(stubStem, stubValues, stubDepth); err == nil {
+		t.Fatal("expected an error when importing a proof of absence stub")
+	}
+
+	if _, err := ImportLeafNode(stem[:10], values, depth); err == nil {
+		t.Fatal("expected an error for a short stem")
+	}
+	if _, err := ImportLeafNode(stem, values[:10], depth); err == nil {
+		t.Fatal("expected an error for missing values")
+	}
+	if _, err := ImportLeafNode(stem, values, StemSize+1); err == nil {
+		t.Fatal("expected an error for an invalid depth")
+	}
+}
+
+// valuesSink keeps the compiler from optimizing away the benchmarked copies.
+var valuesSink [][]byte
+
+func BenchmarkLeafValuesInto(b *testing.B) {
+	leaves := make([]*LeafNode, 1_000)
+	for i := range leaves {
+		values := make([][]byte, NodeWidth)
+		values[i%NodeWidth] = testValue
+		stem := make([]byte, StemSize)
+		binary.BigEndian.PutUint32(stem, uint32(i))
+		leaves[i] = NewLeafNodeWithNoComms(stem, values)
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, leaf := range leaves {
+				values := make([][]byte, NodeWidth)
+				copy(values, leaf.Values())
+				valuesSink = values
+			}
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		b.ReportAllocs()
+		values := make([][]byte, NodeWidth)
+		for i := 0; i < b.N; i++ {
+			for _, leaf := range leaves {
+				leaf.ValuesInto(values)
+				valuesSink = values
+			}
+		}
+	})
+}
+
+func TestLeafProofItems(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	// Prove two slots of the leaf at zeroKeyTest: one in C1 and
+	// one in C2.
+	key200 := make([]byte, KeySize)
+	copy(key200, zeroKeyTest)
+	key200[StemSize] = 200
+	keys := keylist{zeroKeyTest, key200}
+	expected, _, _, err := root.GetProofItems(keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the same elements in two phases: first the openings of
+	// the internal nodes on the path to the leaf, then the openings
+	// of the leaf itself.
+	pe, node, err := getPathProofItems(root, KeyToStem(zeroKeyTest), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, ok := node.(*LeafNode)
+	if !ok {
+		t.Fatalf("expected a leaf node, got %T", node)
+	}
+	leafPe, err := leaf.LeafProofItems([]byte{200, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe.Merge(leafPe)
+
+	if len(pe.Cis) != len(expected.Cis) {
+		t.Fatalf("invalid number of openings, got %d, expected %d", len(pe.Cis), len(expected.Cis))
+	}
+	for i := range expected.Cis {
+		if !pe.Cis[i].Equal(expected.Cis[i]) || pe.Zis[i] != expected.Zis[i] || !pe.Yis[i].Equal(expected.Yis[i]) {
+			t.Fatalf("opening #%d differs", i)
+		}
+	}
+	if len(pe.ByPath) != len(expected.ByPath) {
+		t.Fatalf("invalid number of commitments by path, got %d, expected %d", len(pe.ByPath), len(expected.ByPath))
+	}
+	for path, c := range expected.ByPath {
+		if !pe.ByPath[path].Equal(c) {
+			t.Fatalf("invalid commitment at path %x", path)
+		}
+	}
+}
+
+func TestTouchedInternalNodes(t *testing.T) {
+	t.Parallel()
+
+	// Build a tree with two deep subtrees: keys starting with
+	// 01 02 03 and keys starting with 0a 0b 0c.
+	keyWithPrefix := func(prefix ...byte) []byte {
+		key := make([]byte, KeySize)
+		copy(key, prefix)
+		return key
+	}
+	root := New().(*InternalNode)
+	var shared, disjoint [][]byte
+	for i := 0; i < 3; i++ {
+		shared = append(shared, keyWithPrefix(1, 2, 3, byte(i)))
+		disjoint = append(disjoint, keyWithPrefix(byte(0x10*i+0xa), 0xb, 0xc, 0))
+	}
+	for _, key := range append(shared, disjoint...) {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make sure that disjoint keys each have their own subtree.
+	for _, key := range disjoint {
+		if err := root.Insert(keyWithPrefix(key[0], key[1], key[2], 1), testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	for _, tc := range []struct {
+		name     string
+		keys     [][]byte
+		expected int
+	}{
+		{"none", nil, 0},
+		// root + 01 + 0102 + 010203
+		{"shared", shared, 4},
+		// root + 3 * (xx + xx0b + xx0b0c)
+		{"disjoint", disjoint, 10},
+		// keys in an empty subtree only touch the root
+		{"absent", [][]byte{keyWithPrefix(0xff)}, 1},
+	} {
+		count, err := root.TouchedInternalNodes(tc.keys, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.expected {
+			t.Fatalf("%s: invalid number of touched internal nodes, got %d, expected %d", tc.name, count, tc.expected)
+		}
+	}
+}
+
+func TestCommitmentsEqualLazy(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 50)
+	tree := New().(*InternalNode)
+	for _, key := range keys {
+		if err := tree.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Commit()
+	copied := tree.Copy().(*InternalNode)
+	if tree.IsDirty() || copied.IsDirty() {
+		t.Fatal("committed trees are reported dirty")
+	}
+	if !CommitmentsEqualLazy(tree, copied) {
+		t.Fatal("committed copies have different commitments")
+	}
+
+	// Make the copy dirty, with a different content.
+	if err := copied.Insert(keys[0], fourtyKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !copied.IsDirty() {
+		t.Fatal("modified tree isn't reported dirty")
+	}
+	if CommitmentsEqualLazy(tree, copied) {
+		t.Fatal("trees with different contents have the same commitment")
+	}
+	if copied.IsDirty() {
+		t.Fatal("dirty tree wasn't committed")
+	}
+	if tree.Commit().Equal(copied.Commit()) {
+		t.Fatal("explicit commitment comparison disagrees")
+	}
+
+	// Make the copy dirty again, back to the original content.
+	if err := copied.Insert(keys[0], testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !CommitmentsEqualLazy(copied, tree) {
+		t.Fatal("trees with the same contents have different commitments")
+	}
+	if !tree.Commit().Equal(copied.Commit()) {
+		t.Fatal("explicit commitment comparison disagrees")
+	}
+}
+
+func genSortedStemValues(rand *mRandV1.Rand, count int) ([][]byte, [][][]byte) {
+	stems := make([][]byte, count)
+	for i := range stems {
+		stems[i] = make([]byte, StemSize)
+		rand.Read(stems[i])
+	}
+	sort.Slice(stems, func(i, j int) bool { return bytes.Compare(stems[i], stems[j]) < 0 })
+	valueSets := make([][][]byte, count)
+	for i := range valueSets {
+		valueSets[i] = make([][]byte, NodeWidth)
+		value := make([]byte, LeafValueSize)
+		rand.Read(value)
+		valueSets[i][rand.Intn(NodeWidth)] = value
+	}
+	return stems, valueSets
+}
+
+func TestBuildParallelFromSorted(t *testing.T) {
+	t.Parallel()
+
+	rand := mRandV1.New(mRandV1.NewSource(42)) //skipcq: GSC-G404
+	stems, valueSets := genSortedStemValues(rand, 1_000)
+
+	expected := New()
+	for i := range stems {
+		if err := expected.(*InternalNode).InsertValuesAtStem(stems[i], valueSets[i], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected.Commit()
+
+	for _, workers := range []int{0, 1, 4} {
+		root, err := BuildParallelFromSorted(stems, valueSets, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !root.Commitment().Equal(expected.Commitment()) {
+			t.Fatalf("invalid root commitment with %d workers, got %x, expected %x", workers, root.Commitment().Bytes(), expected.Commitment().Bytes())
+		}
+	}
+
+	stems[1], stems[2] = stems[2], stems[1]
+	if _, err := BuildParallelFromSorted(stems, valueSets, 4); err == nil {
+		t.Fatal("unsorted stems should be rejected")
+	}
+}
+
+func TestGroupKeyValuesByStem(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 300)
+	for i := 0; i < 100; i += 10 {
+		for _, suffix := range []byte{0, 7, 255} {
+			key, _ := JoinKey(KeyToStem(keys[i]), suffix)
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	keys = slices.CompactFunc(keys, bytes.Equal)
+
+	expected := New()
+	for _, key := range keys {
+		if err := expected.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodesValues, err := GroupKeyValuesByStem(keys, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for i, data := range nodesValues {
+		if i > 0 && bytes.Compare(nodesValues[i-1].Stem, data.Stem) >= 0 {
+			t.Fatalf("stems aren't grouped in order: %x comes before %x", nodesValues[i-1].Stem, data.Stem)
+		}
+		count += len(data.Values)
+	}
+	if count != len(keys) {
+		t.Fatalf("invalid number of grouped values, got %d, expected %d", count, len(keys))
+	}
+
+	leaves, err := BatchNewLeafNode(nodesValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := New().(*InternalNode)
+	if err := root.InsertMigratedLeaves(leaves, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", root.Commitment().Bytes(), expected.Commitment().Bytes())
+	}
+
+	if _, err := GroupKeyValuesByStem(keys, keys[1:]); err == nil {
+		t.Fatal("a different number of keys and values should be rejected")
+	}
+	if _, err := GroupKeyValuesByStem([][]byte{keys[1], keys[0]}, [][]byte{keys[1], keys[0]}); err == nil {
+		t.Fatal("unsorted keys should be rejected")
+	}
+	if _, err := GroupKeyValuesByStem([][]byte{keys[0][:StemSize]}, [][]byte{testValue}); err == nil {
+		t.Fatal("keys of invalid length should be rejected")
+	}
+}
+
+func TestBuildTreeFromSortedKVs(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 500)
+	// Add a few more suffixes to some of the stems, so that leaves hold
+	// more than one value.
+	for i := 0; i < 100; i += 10 {
+		for _, suffix := range []byte{0, 7, 255} {
+			key, _ := JoinKey(KeyToStem(keys[i]), suffix)
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	keys = slices.CompactFunc(keys, bytes.Equal)
+
+	expected := New()
+	kvs := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		kvs[i] = KeyValue{Key: key, Value: key}
+		if err := expected.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := BuildTreeFromSortedKVs(kvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", root.Commitment().Bytes(), expected.Commitment().Bytes())
+	}
+
+	if root, err = BuildTreeFromSortedKVs(nil); err != nil || !root.Commit().Equal(New().Commit()) {
+		t.Fatalf("expected an empty tree, got %v", err)
+	}
+
+	kvs[1], kvs[2] = kvs[2], kvs[1]
+	if _, err := BuildTreeFromSortedKVs(kvs); err == nil {
+		t.Fatal("unsorted keys should be rejected")
+	}
+	kvs[1], kvs[2] = kvs[2], kvs[1]
+	kvs[3].Key = append(kvs[3].Key, make([]byte, KeySize)...)
+	if _, err := BuildTreeFromSortedKVs(kvs); err == nil {
+		t.Fatal("keys of invalid length should be rejected")
+	}
+}
+
+func BenchmarkBuildParallelFromSorted(b *testing.B) {
+	_ = GetConfig()
+	rand := mRandV1.New(mRandV1.NewSource(42)) //skipcq: GSC-G404
+	stems, valueSets := genSortedStemValues(rand, 100_000)
+
+	b.Run("sequential", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			root := New()
+			for i := range stems {
+				if err := root.(*InternalNode).InsertValuesAtStem(stems[i], valueSets[i], nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			root.Commit()
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := BuildParallelFromSorted(stems, valueSets, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestHashedNodePaths(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest, ffx32KeyTest}
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	paths := root.HashedNodePaths()
+	expected := [][]byte{{0}, {0x40}, {0xff}}
+	if len(paths) != len(expected) {
+		t.Fatalf("invalid number of hashed nodes, got %d, expected %d", len(paths), len(expected))
+	}
+	for i := range paths {
+		if !bytes.Equal(paths[i], expected[i]) {
+			t.Fatalf("invalid path #%d, got %x, expected %x", i, paths[i], expected[i])
+		}
+	}
+
+	// Resolving the internal node at 00 leaves its children hashed.
+	if _, err := root.Get(zeroKeyTest, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if paths := root.HashedNodePaths(); len(paths) != 3 || !bytes.Equal(paths[0], []byte{0, 1}) {
+		t.Fatalf("invalid hashed nodes after partial resolution: %x", paths)
+	}
+
+	for _, key := range keys {
+		if _, err := root.Get(key, resolver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if paths := root.HashedNodePaths(); len(paths) != 0 {
+		t.Fatalf("fully-resolved tree has hashed nodes at %x", paths)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+
+	treeA, treeB := New().(*InternalNode), New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest, fourtyKeyTest} {
+		if err := treeA.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := treeB.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fingerprint := treeA.Fingerprint()
+	if len(fingerprint) != 16 {
+		t.Fatalf("invalid fingerprint length, got %d, expected 16", len(fingerprint))
+	}
+	if treeB.Fingerprint() != fingerprint {
+		t.Fatalf("identical trees have different fingerprints: %s != %s", treeB.Fingerprint(), fingerprint)
+	}
+
+	if err := treeB.Insert(ffx32KeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if treeB.Fingerprint() == fingerprint {
+		t.Fatal("fingerprint didn't change after a mutation")
+	}
+}
+
+func TestFold(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 100)
+	root := New().(*InternalNode)
+	var expected uint64
+	for i, key := range keys {
+		value := make([]byte, LeafValueSize)
+		binary.LittleEndian.PutUint64(value, uint64(i))
+		expected += uint64(i)
+		if err := root.Insert(key, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	var (
+		count   int
+		lastKey []byte
+	)
+	sum, err := root.Fold(uint64(0), func(acc interface{}, key, value []byte) interface{} {
+		if bytes.Compare(lastKey, key) >= 0 {
+			t.Errorf("keys aren't visited in order: %x >= %x", lastKey, key)
+		}
+		lastKey = key
+		count++
+		return acc.(uint64) + binary.LittleEndian.Uint64(value)
+	}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(keys) {
+		t.Fatalf("invalid number of visited values, got %d, expected %d", count, len(keys))
+	}
+	if sum.(uint64) != expected {
+		t.Fatalf("invalid sum, got %d, expected %d", sum, expected)
+	}
+}
+
+func TestRootFromLeafCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range randomKeys(t, 200) {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range [][]byte{zeroKeyTest, forkOneKeyTest} { // force a deeper internal node
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+
+	comms := map[string]*Point{}
+	root.Flush(func(_ []byte, node VerkleNode) {
+		if leaf, ok := node.(*LeafNode); ok {
+			comms[string(leaf.stem)] = leaf.commitment
+		}
+	})
+
+	rootC, err := RootFromLeafCommitments(comms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootC.Equal(root.Commitment()) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", rootC.Bytes(), root.Commitment().Bytes())
+	}
+
+	rootC, err = RootFromLeafCommitments(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootC.Equal(New().Commit()) {
+		t.Fatalf("invalid root commitment of an empty tree, got %x", rootC.Bytes())
+	}
+}
+
+func TestParentOf(t *testing.T) {
+	t.Parallel()
+
+	deepKey := append([]byte{0, 0, 1}, make([]byte, KeySize-3)...)
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, deepKey, forkOneKeyTest, fourtyKeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	for _, tc := range []struct {
+		key   []byte
+		depth byte
+		index byte
+	}{
+		{zeroKeyTest, 3, 0},
+		{deepKey, 3, 1},
+		{forkOneKeyTest, 2, 1},
+		{fourtyKeyTest, 1, 0x40},
+	} {
+		parent, index, err := root.ParentOf(KeyToStem(tc.key), resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent.depth != tc.depth-1 || index != tc.index {
+			t.Fatalf("invalid parent for key %x, got depth %d and index %d, expected %d and %d", tc.key, parent.depth, index, tc.depth-1, tc.index)
+		}
+		leaf, ok := parent.children[index].(*LeafNode)
+		if !ok || !bytes.Equal(leaf.stem, KeyToStem(tc.key)) {
+			t.Fatalf("invalid child of the parent of key %x: %v", tc.key, parent.children[index])
+		}
+	}
+
+	if _, _, err := root.ParentOf(KeyToStem(ffx32KeyTest), resolver); err == nil {
+		t.Fatal("expected an error for a missing stem")
+	}
+	if _, _, err := root.ParentOf(oneKeyTest[:1], resolver); err == nil {
+		t.Fatal("expected an error for a short stem")
+	}
+}
+
+func TestBatchSerializeDirtyAfterDropCommitments(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	keys := randomKeys(t, 1_000)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	before, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root.DropCommitments(0)
+	for _, key := range keys[:10] {
+		if err := root.Insert(key, fourtyKeyTest, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirty, err := root.BatchSerializeDirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirtyNodes := map[string][]byte{}
+	for _, sn := range dirty {
+		dirtyNodes[string(sn.Path)] = sn.SerializedBytes
+	}
+
+	// Every node that changed must be part of the dirty nodes, with
+	// its new serialization.
+	after, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeNodes := map[string][]byte{}
+	for _, sn := range before {
+		beforeNodes[string(sn.Path)] = sn.SerializedBytes
+	}
+	for _, sn := range after {
+		if bytes.Equal(beforeNodes[string(sn.Path)], sn.SerializedBytes) {
+			continue
+		}
+		serialized, ok := dirtyNodes[string(sn.Path)]
+		if !ok {
+			t.Fatalf("modified node at path %x isn't reported as dirty", sn.Path)
+		}
+		if !bytes.Equal(serialized, sn.SerializedBytes) {
+			t.Fatalf("invalid serialization for the node at path %x", sn.Path)
+		}
+	}
+}
+
+func TestBatchSerializeDirty(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range randomKeys(t, 1_000) {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := map[string][]byte{}
+	for _, sn := range before {
+		serialized[string(sn.Path)] = sn.SerializedBytes
+	}
+
+	newKeys := randomKeys(t, 2)
+	for _, key := range newKeys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirty, err := root.BatchSerializeDirty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.IsDirty() {
+		t.Fatal("tree wasn't committed")
+	}
+	// Each new key touches the root, a couple of internal nodes and its
+	// leaf, plus a leaf that gets moved down if its stem was split.
+	if len(dirty) == 0 || len(dirty) > 10 {
+		t.Fatalf("invalid number of dirty nodes: %d", len(dirty))
+	}
+	dirtyPaths := map[string]struct{}{}
+	for _, sn := range dirty {
+		dirtyPaths[string(sn.Path)] = struct{}{}
+	}
+	for _, key := range newKeys {
+		parent, _, err := root.ParentOf(KeyToStem(key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for depth := 0; depth <= int(parent.depth)+1; depth++ {
+			if _, ok := dirtyPaths[string(key[:depth])]; !ok {
+				t.Fatalf("node at path %x on the path of key %x isn't reported", key[:depth], key)
+			}
+		}
+	}
+
+	// All the nodes whose serialization changed are reported.
+	after, err := root.BatchSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterSerialized := map[string][]byte{}
+	for _, sn := range after {
+		afterSerialized[string(sn.Path)] = sn.SerializedBytes
+		if bytes.Equal(serialized[string(sn.Path)], sn.SerializedBytes) {
+			continue
+		}
+		if _, ok := dirtyPaths[string(sn.Path)]; !ok {
+			t.Fatalf("modified node at path %x isn't reported", sn.Path)
+		}
+	}
+	for _, sn := range dirty {
+		if !bytes.Equal(sn.SerializedBytes, afterSerialized[string(sn.Path)]) {
+			t.Fatalf("invalid serialization of dirty node at path %x", sn.Path)
+		}
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	keys := randomKeys(t, 200)
+	for i, key := range keys[:100] {
+		if err := root.Insert(key, keys[i+100], nil); err != nil {
+			t.Fatalf("error inserting: %v", err)
+		}
+	}
+	// Read several slots of the same leaves, and a key twice.
+	for _, key := range keys[:10] {
+		sibling := append([]byte{}, key...)
+		sibling[StemSize]++
+		keys = append(keys, sibling)
+	}
+	keys = append(keys, keys[0])
+
+	expected := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := root.Get(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = value
+	}
+
+	resolver, recorded := RecordingResolver(flushToResolver(t, root))
+	values, err := root.BatchGet(keys, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if !bytes.Equal(values[i], expected[i]) || (values[i] == nil) != (expected[i] == nil) {
+			t.Fatalf("key %x: got value %x, expected %x", keys[i], values[i], expected[i])
+		}
+	}
+
+	resolved := map[string]int{}
+	for _, path := range recorded() {
+		resolved[string(path)]++
+		if resolved[string(path)] > 1 {
+			t.Fatalf("node at path %x resolved more than once", path)
+		}
+	}
+	if len(resolved) == 0 {
+		t.Fatal("no node was resolved")
+	}
+}
+
+func TestIterateLeaves(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 1_000)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	if err := root.IterateLeaves(func(*LeafNode) error { return nil }, nil); err == nil {
+		t.Fatal("expected an error when iterating over hashed nodes without a resolver")
+	}
+
+	var stems [][]byte
+	err := root.IterateLeaves(func(leaf *LeafNode) error {
+		stems = append(stems, leaf.stem)
+		return nil
+	}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stems) != len(keys) {
+		t.Fatalf("invalid number of leaves, got %d, expected %d", len(stems), len(keys))
+	}
+	for i := 1; i < len(stems); i++ {
+		if bytes.Compare(stems[i-1], stems[i]) >= 0 {
+			t.Fatalf("stems aren't sorted: %x >= %x", stems[i-1], stems[i])
+		}
+	}
+
+	// The iteration stops at the first error.
+	errStop := errors.New("stop")
+	var count int
+	err = root.IterateLeaves(func(*LeafNode) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	}, resolver)
+	if err != errStop || count != 10 {
+		t.Fatalf("iteration didn't stop at the first error: %v after %d leaves", err, count)
+	}
+}
+
+func TestIterateStemPrefix(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 1_000)
+	root := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	resolver := flushToResolver(t, root)
+
+	collect := func(prefix []byte) [][]byte {
+		t.Helper()
+		var stems [][]byte
+		err := root.IterateStemPrefix(prefix, func(leaf *LeafNode) error {
+			stems = append(stems, leaf.stem)
+			return nil
+		}, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stems
+	}
+
+	if stems := collect(nil); len(stems) != len(keys) {
+		t.Fatalf("invalid number of leaves with an empty prefix, got %d, expected %d", len(stems), len(keys))
+	}
+
+	// A one-byte prefix yields exactly the stems that start with it.
+	prefix := []byte{keys[0][0]}
+	var expected int
+	for _, key := range keys {
+		if key[0] == prefix[0] {
+			expected++
+		}
+	}
+	stems := collect(prefix)
+	if len(stems) != expected {
+		t.Fatalf("invalid number of leaves for prefix %x, got %d, expected %d", prefix, len(stems), expected)
+	}
+	for _, stem := range stems {
+		if !bytes.HasPrefix(stem, prefix) {
+			t.Fatalf("stem %x doesn't start with %x", stem, prefix)
+		}
+	}
+
+	// A prefix that ends inside a leaf yields that leaf once.
+	if stems := collect(keys[1][:10]); len(stems) != 1 || !bytes.Equal(stems[0], keys[1][:StemSize]) {
+		t.Fatalf("invalid leaves for a prefix ending inside a leaf: %x", stems)
+	}
+	// A prefix that matches the leaf's path but not its stem yields nothing.
+	diverging := append([]byte{}, keys[1][:10]...)
+	diverging[9] ^= 0xff
+	if stems := collect(diverging); len(stems) != 0 {
+		t.Fatalf("expected no leaves for a diverging prefix, got %x", stems)
+	}
+
+	if err := root.IterateStemPrefix(make([]byte, StemSize+1), func(*LeafNode) error { return nil }, resolver); err == nil {
+		t.Fatal("expected an error with a prefix longer than a stem")
+	}
+}
+
+func TestDeleteMultiple(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 10)
+	keyAt := func(i int, suffix byte) []byte {
+		key, _ := JoinKey(KeyToStem(keys[i]), suffix)
+		return key
+	}
+	build := func() *InternalNode {
+		root := New().(*InternalNode)
+		for i := range keys {
+			for _, suffix := range []byte{0, 1, 2, 3, 127, 128, 200, 255} {
+				if err := root.Insert(keyAt(i, suffix), testValue, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		root.Commit()
+		return root
+	}
+
+	var toDelete [][]byte
+	// Delete a few values in both halves of the first leaf,
+	toDelete = append(toDelete, keyAt(0, 1), keyAt(0, 3), keyAt(0, 200))
+	// empty the C2 subtree of the second leaf,
+	for _, suffix := range []byte{128, 200, 255} {
+		toDelete = append(toDelete, keyAt(1, suffix))
+	}
+	// empty the third leaf entirely,
+	for _, suffix := range []byte{0, 1, 2, 3, 127, 128, 200, 255} {
+		toDelete = append(toDelete, keyAt(2, suffix))
+	}
+	// and delete a missing value and a missing stem.
+	toDelete = append(toDelete, keyAt(3, 50), ffx32KeyTest)
+
+	expected := build()
+	for _, key := range toDelete {
+		if _, err := expected.Delete(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedComm := expected.Commit()
+
+	root := build()
+	resolver := flushToResolver(t, root)
+	if err := root.DeleteMultiple(toDelete, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if comm := root.Commit(); !comm.Equal(expectedComm) {
+		t.Fatalf("invalid root commitment, got %x, expected %x", comm.Bytes(), expectedComm.Bytes())
+	}
+
+	if val, err := root.Get(keyAt(1, 0), nil); err != nil || !bytes.Equal(val, testValue) {
+		t.Fatalf("value outside of the deleted range is missing: %x %v", val, err)
+	}
+	if val, err := root.Get(keyAt(2, 0), nil); err != nil || val != nil {
+		t.Fatalf("value of an emptied leaf is still present: %x %v", val, err)
+	}
+}
+
+func TestInsertWithOld(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	old, err := root.InsertWithOld(zeroKeyTest, testValue, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != nil {
+		t.Fatalf("expected a nil previous value for a new key, got %x", old)
+	}
+
+	// A new suffix in an existing leaf has no previous value either.
+	if old, err = root.InsertWithOld(oneKeyTest, testValue, nil); err != nil || old != nil {
+		t.Fatalf("expected a nil previous value for a new suffix, got %x %v", old, err)
+	}
+
+	newValue := bytes.Repeat([]byte{0x42}, 32)
+	root.Commit()
+	resolver := flushToResolver(t, root)
+	if old, err = root.InsertWithOld(zeroKeyTest, newValue, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, testValue) {
+		t.Fatalf("invalid previous value, got %x, expected %x", old, testValue)
+	}
+	if val, err := root.Get(zeroKeyTest, resolver); err != nil || !bytes.Equal(val, newValue) {
+		t.Fatalf("invalid value after the insertion, got %x %v", val, err)
+	}
+
+	// Overwriting a value with itself returns it as the previous value.
+	if old, err = root.InsertWithOld(zeroKeyTest, newValue, resolver); err != nil || !bytes.Equal(old, newValue) {
+		t.Fatalf("invalid previous value for a no-op overwrite, got %x %v", old, err)
+	}
+
+	leaf, err := NewLeafNode(KeyToStem(ffx32KeyTest), make([][]byte, NodeWidth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, err = leaf.InsertWithOld(ffx32KeyTest, testValue, nil); err != nil || old != nil {
+		t.Fatalf("expected a nil previous value in the leaf, got %x %v", old, err)
+	}
+	if old, err = leaf.InsertWithOld(ffx32KeyTest, newValue, nil); err != nil || !bytes.Equal(old, testValue) {
+		t.Fatalf("invalid previous value in the leaf, got %x %v", old, err)
+	}
+}
+
+func TestGetValuesAtStem(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest} {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := flushToResolver(t, root)
+	view, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := GetValuesAtStem(view, KeyToStem(zeroKeyTest), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != NodeWidth {
+		t.Fatalf("invalid number of values, got %d, expected %d", len(values), NodeWidth)
+	}
+	for i, v := range values {
+		var expected []byte
+		switch byte(i) {
+		case zeroKeyTest[StemSize]:
+			expected = zeroKeyTest
+		case oneKeyTest[StemSize]:
+			expected = oneKeyTest
+		}
+		if !bytes.Equal(v, expected) || (v == nil) != (expected == nil) {
+			t.Fatalf("invalid value at suffix %d, got %x, expected %x", i, v, expected)
+		}
+	}
+
+	// Absent stems, next to a leaf and under an empty slot.
+	otherStem := bytes.Clone(KeyToStem(zeroKeyTest))
+	otherStem[StemSize-1] = 1
+	for _, stem := range [][]byte{otherStem, KeyToStem(ffx32KeyTest)} {
+		if values, err := GetValuesAtStem(view, stem, resolver); err != nil || values != nil {
+			t.Fatalf("expected no values for the absent stem %x, got %v %v", stem, values, err)
+		}
+	}
+
+	if _, err := GetValuesAtStem(view, zeroKeyTest, resolver); err == nil {
+		t.Fatal("expected an error for a key passed as a stem")
+	}
+}
+
+func TestLargeValue(t *testing.T) {
+	t.Parallel()
+
+	value := make([]byte, 100)
+	for i := range value {
+		value[i] = byte(i + 1)
+	}
+	// The chunks straddle the C1/C2 boundary.
+	key, _ := JoinKey(KeyToStem(fourtyKeyTest), 126)
+
+	root := New()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	numChunks, err := InsertLargeValue(root, key, value, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numChunks != 4 {
+		t.Fatalf("invalid number of chunks, got %d, expected 4", numChunks)
+	}
+
+	// The tree is the same as if the chunks had been inserted one by one.
+	expected := New()
+	if err := expected.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < numChunks; i++ {
+		chunk := make([]byte, LeafValueSize)
+		copy(chunk, value[i*LeafValueSize:])
+		chunkKey, _ := JoinKey(KeyToStem(key), 126+byte(i))
+		if err := expected.Insert(chunkKey, chunk, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatal("invalid commitment after inserting a large value")
+	}
+
+	read, err := GetLargeValue(root, key, len(value), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, value) {
+		t.Fatalf("invalid value, got %x, expected %x", read, value)
+	}
+
+	if _, err := GetLargeValue(root, key, len(value)+LeafValueSize, nil); err == nil {
+		t.Fatal("expected an error when reading a missing chunk")
+	}
+	tooHigh, _ := JoinKey(KeyToStem(key), 254)
+	if _, err := InsertLargeValue(root, tooHigh, value, nil); err == nil {
+		t.Fatal("expected an error for a value that doesn't fit in the stem")
+	}
+	if _, err := GetLargeValue(root, tooHigh, len(value), nil); err == nil {
+		t.Fatal("expected an error when reading past the last suffix")
+	}
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if inserted, err := root.InsertIfAbsent(zeroKeyTest, testValue, nil); err != nil || !inserted {
+		t.Fatalf("expected the value to be inserted, got %v %v", inserted, err)
+	}
+	if err := root.Insert(fourtyKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.Commit()
+
+	// Work on a view in which the leaves are hashed, so that presence
+	// can only be determined by resolving them.
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := flushToResolver(t, root)
+	newValue := bytes.Repeat([]byte{0x42}, 32)
+	inserted, err := view.(*InternalNode).InsertIfAbsent(zeroKeyTest, newValue, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted {
+		t.Fatal("expected the existing value to be kept")
+	}
+	if val, err := view.Get(zeroKeyTest, resolver); err != nil || !bytes.Equal(val, testValue) {
+		t.Fatalf("invalid value after a rejected insertion, got %x %v", val, err)
+	}
+	if !view.Commit().Equal(root.Commitment()) {
+		t.Fatal("rejected insertion modified the tree")
+	}
+
+	// A missing suffix in an existing leaf is inserted.
+	if inserted, err = view.(*InternalNode).InsertIfAbsent(oneKeyTest, newValue, resolver); err != nil || !inserted {
+		t.Fatalf("expected the value to be inserted, got %v %v", inserted, err)
+	}
+	if val, err := view.Get(oneKeyTest, resolver); err != nil || !bytes.Equal(val, newValue) {
+		t.Fatalf("invalid value after the insertion, got %x %v", val, err)
+	}
+}
+
+func TestNodeSize(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	emptySize := root.Size()
+	if err := root.Insert(zeroKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	withValue := root.Size()
+	if withValue <= emptySize {
+		t.Fatalf("size didn't grow after an insertion: %d <= %d", withValue, emptySize)
+	}
+	if err := root.Insert(oneKeyTest, testValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	if size := root.Size(); size != withValue+len(testValue) {
+		t.Fatalf("invalid size after a second value in the same leaf, got %d, expected %d", size, withValue+len(testValue))
+	}
+
+	for _, key := range randomKeys(t, 1_000) {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Commit()
+	full := root.Size()
+	root.FlushAtDepth(1, func([]byte, VerkleNode) {})
+	if flushed := root.Size(); flushed >= full {
+		t.Fatalf("size didn't shrink after a flush: %d >= %d", flushed, full)
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	root := New().(*InternalNode)
+	if stats := root.Stats(); stats != (TreeStats{NumInternal: 1}) {
+		t.Fatalf("invalid stats for an empty tree: %+v", stats)
+	}
+
+	// zeroKeyTest and oneKeyTest share a leaf, which forkOneKeyTest
+	// splits from at depth 2, and ffx32KeyTest lives at depth 1.
+	for _, key := range [][]byte{zeroKeyTest, oneKeyTest, forkOneKeyTest, ffx32KeyTest} {
+		if err := root.Insert(key, testValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := TreeStats{NumLeaves: 3, NumInternal: 2, NumValues: 4, MaxDepth: 2}
+	if stats := root.Stats(); stats != expected {
+		t.Fatalf("invalid stats, got %+v, expected %+v", stats, expected)
+	}
+
+	// Hashed nodes are counted, but not resolved.
+	root.Commit()
+	flushToResolver(t, root)
+	expected = TreeStats{NumInternal: 1, NumHashed: 2, MaxDepth: 1}
+	if stats := root.Stats(); stats != expected {
+		t.Fatalf("invalid stats after a flush, got %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestDropCommitments(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 1_000)
+	root := New().(*InternalNode)
+	expected := New().(*InternalNode)
+	for _, key := range keys {
+		if err := root.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := expected.Insert(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	committed := new(Point).Set(root.Commit())
+
+	for _, depth := range []uint8{0, 1} {
+		root.DropCommitments(depth)
+		if !root.IsDirty() {
+			t.Fatalf("tree isn't dirty after dropping commitments below depth %d", depth)
+		}
+		if !root.Commit().Equal(committed) {
+			t.Fatalf("invalid commitment after dropping commitments below depth %d", depth)
+		}
+	}
+	// There are no internal nodes that deep.
+	root.DropCommitments(10)
+	if root.IsDirty() {
+		t.Fatal("dropping commitments below the deepest node altered the tree")
+	}
+
+	// Mutate the tree while its commitments are dropped.
+	root.DropCommitments(0)
+	newValue := bytes.Repeat([]byte{0x42}, 32)
+	for _, key := range [][]byte{keys[0], keys[500], zeroKeyTest} {
+		if err := root.Insert(key, newValue, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := expected.Insert(key, newValue, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Delete(keys[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expected.Delete(keys[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if !root.Commit().Equal(expected.Commit()) {
+		t.Fatal("invalid commitment after mutating a tree with dropped commitments")
+	}
+
+	// Nodes with hashed children keep their commitment.
+	serialized, err := root.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := flushToResolver(t, root)
+	view, err := ParseNode(serialized, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := view.Insert(keys[2], newValue, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if err := expected.Insert(keys[2], newValue, nil); err != nil {
+		t.Fatal(err)
+	}
+	view.(*InternalNode).DropCommitments(0)
+	if !view.Commit().Equal(expected.Commit()) {
+		t.Fatal("invalid commitment after dropping commitments in a partially resolved tree")
+	}
+}
+
+func TestCommitParallel(t *testing.T) {
+	t.Parallel()
+
+	keys := randomKeys(t, 5_000)
+	build := func() *InternalNode {
+		root := New().(*InternalNode)
+		for _, key := range keys {
+			if err := root.Insert(key, testValue, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	expected := build().Commit()
+
+	for _, workers := range []int{0, 1, 2, runtime.NumCPU(), 64} {
+		if comm := build().CommitParallel(workers); !comm.Equal(expected) {
+			t.Fatalf("invalid root commitment with %d workers, got %x, expected %x", workers, comm.Bytes(), expected.Bytes())
+		}
+	}
+}
+
+func BenchmarkCommitParallel(b *testing.B) {
+	rand := mRandV1.New(mRandV1.NewSource(42)) //skipcq: GSC-G404
+	stems, valueSets := genSortedStemValues(rand, 100_000)
+	leaves := make([]LeafNode, len(stems))
+	for i := range stems {
+		leaf, err := NewLeafNode(stems[i], valueSets[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		leaves[i] = *leaf
+	}
+
+	workerCounts := []int{1}
+	if runtime.NumCPU() > 1 {
+		workerCounts = append(workerCounts, runtime.NumCPU())
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers/%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				root := New().(*InternalNode)
+				if err := root.InsertMigratedLeaves(leaves, nil); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				root.CommitParallel(workers)
+			}
+		})
+	}
+}
+
+func TestStemOperationsOnInterface(t *testing.T) {
+	t.Parallel()
+
+	values := make([][]byte, NodeWidth)
+	values[0] = testValue
+	values[200] = testValue
+
+	for _, node := range []VerkleNode{New(), mustNewLeafNode(t, KeyToStem(zeroKeyTest))} {
+		if err := node.InsertValuesAtStem(KeyToStem(zeroKeyTest), values, nil); err != nil {
+			t.Fatalf("%T: %v", node, err)
+		}
+		for _, suffix := range []int{0, 200} {
+			key := append(append([]byte{}, KeyToStem(zeroKeyTest)...), byte(suffix))
+			if val, err := node.Get(key, nil); err != nil || !bytes.Equal(val, testValue) {
+				t.Fatalf("%T: invalid value at suffix %d, got %x %v", node, suffix, val, err)
+			}
+		}
+		if _, err := node.DeleteAtStem(ffx32KeyTest, nil); err != errDeleteMissing {
+			t.Fatalf("%T: got %v, want %v", node, err, errDeleteMissing)
+		}
+		if del, err := node.DeleteAtStem(zeroKeyTest, nil); err != nil || !del {
+			t.Fatalf("%T: stem wasn't deleted: %v %v", node, del, err)
+		}
+	}
+
+	leaf := mustNewLeafNode(t, KeyToStem(zeroKeyTest))
+	if err := leaf.InsertValuesAtStem(KeyToStem(ffx32KeyTest), values, nil); err != errInsertIntoOtherStem {
+		t.Fatalf("got %v, want %v", err, errInsertIntoOtherStem)
+	}
+}
+
+func mustNewLeafNode(t *testing.T, stem []byte) *LeafNode {
+	t.Helper()
+	leaf, err := NewLeafNode(stem, make([][]byte, NodeWidth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestStemCommitment(t *testing.T) {
+	t.Parallel()
+
+	stem := KeyToStem(ffx32KeyTest)
+	withCodeHash := make([][]byte, NodeWidth)
+	withCodeHash[0] = testValue
+	withCodeHash[CodeHashVectorPosition] = EmptyCodeHash
+	withCodeHash[200] = testValue
+	for _, values := range [][][]byte{make([][]byte, NodeWidth), withCodeHash} {
+		leaf, err := NewLeafNode(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		comm, err := StemCommitment(stem, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !comm.Equal(leaf.Commitment()) {
+			t.Fatalf("invalid stem commitment, got %x, expected %x", comm.Bytes(), leaf.Commitment().Bytes())
+		}
+	}
+
+	if _, err := StemCommitment(stem[:10], withCodeHash); err == nil {
+		t.Fatal("expected an error with a short stem")
+	}
+	if _, err := StemCommitment(stem, withCodeHash[:10]); err == nil {
+		t.Fatal("expected an error with too few values")
+	}
+}
+
+func TestNodesEqual(t *testing.T) {
+	t.Parallel()
+
+	build := func(keys [][]byte, values [][]byte) *InternalNode {
+		root := New().(*InternalNode)
+		for i, key := range keys {
+			if err := root.Insert(key, values[i], nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root.Commit()
+		return root
+	}
+	keys := [][]byte{zeroKeyTest, oneKeyTest, ffx32KeyTest}
+	values := [][]byte{testValue, testValue, testValue}
+
+	a, b := build(keys, values), build(keys, values)
+	if !NodesEqual(a, b) || !NodesEqual(a, a.Copy()) {
+		t.Fatal("equal trees are reported as different")
+	}
+
+	if NodesEqual(a, build(keys, [][]byte{testValue, fourtyKeyTest, testValue})) {
+		t.Fatal("trees with different values are reported as equal")
+	}
+	// A zero value differs from a missing one.
+	if NodesEqual(a, build(append(keys, fourtyKeyTest), append(values, make([]byte, LeafValueSize)))) {
+		t.Fatal("trees with different keys are reported as equal")
+	}
+
+	// forkOneKeyTest splits the leaf of zeroKeyTest and oneKeyTest
+	// in two levels, even after it is deleted.
+	split := build(append(keys, forkOneKeyTest), append(values, testValue))
+	if _, err := split.Delete(forkOneKeyTest, nil); err != nil {
+		t.Fatal(err)
+	}
+	split.Commit()
+	if NodesEqual(a, split) {
+		t.Fatal("trees with different structures are reported as equal")
+	}
+
+	// Hashed nodes are only equal if their parents' commitments are.
+	flushToResolver(t, a)
+	flushToResolver(t, b)
+	if !NodesEqual(a, b) {
+		t.Fatal("flushed equal trees are reported as different")
+	}
+	other := build(keys, [][]byte{testValue, testValue, fourtyKeyTest})
+	flushToResolver(t, other)
+	if NodesEqual(a, other) {
+		t.Fatal("flushed different trees are reported as equal")
+	}
+	// A missing commitment can't be compared.
+	comm := a.commitment
+	a.commitment = nil
+	if NodesEqual(a, b) || NodesEqual(b, a) {
+		t.Fatal("a tree with hashed nodes and no commitment is reported as equal")
+	}
+	a.commitment = comm
+	if !NodesEqual(Empty{}, Empty{}) || NodesEqual(Empty{}, HashedNode{}) || NodesEqual(UnknownNode{}, Empty{}) {
+		t.Fatal("invalid comparison of empty, hashed and unknown nodes")
+	}
+}
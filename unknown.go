@@ -37,6 +37,14 @@ func (UnknownNode) Delete([]byte, NodeResolverFn) (bool, error) {
 	return false, errors.New("cant delete in a subtree missing form a stateless view")
 }
 
+func (UnknownNode) InsertValuesAtStem(Stem, [][]byte, NodeResolverFn) error {
+	return errMissingNodeInStateless
+}
+
+func (UnknownNode) DeleteAtStem([]byte, NodeResolverFn) (bool, error) {
+	return false, errDeleteUnknown
+}
+
 func (UnknownNode) Get([]byte, NodeResolverFn) ([]byte, error) {
 	return nil, nil
 }
@@ -71,6 +79,10 @@ func (UnknownNode) setDepth(_ byte) {
 	panic("should not be try to set the depth of an UnknownNode node")
 }
 
+func (UnknownNode) Size() int {
+	return 0
+}
+
 func (UnknownNode) Hash() *Fr {
 	return &FrZero
 }
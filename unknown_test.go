@@ -13,6 +13,12 @@ func TestUnknownFuncs(t *testing.T) {
 	if _, err := un.Delete(nil, nil); err == nil {
 		t.Errorf("got nil error when deleting from a hashed node")
 	}
+	if err := un.InsertValuesAtStem(nil, nil, nil); err != errMissingNodeInStateless {
+		t.Errorf("got %v, want %v", err, errMissingNodeInStateless)
+	}
+	if _, err := un.DeleteAtStem(nil, nil); err != errDeleteUnknown {
+		t.Errorf("got %v, want %v", err, errDeleteUnknown)
+	}
 	if _, err := un.Get(nil, nil); err != nil {
 		t.Errorf("got %v, want nil", err)
 	}
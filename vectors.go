@@ -0,0 +1,90 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// For more information, please refer to <https://unlicense.org>
+
+package verkle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// referenceVector is a set of key/values, and the root commitment of the
+// tree that holds them.
+type referenceVector struct {
+	Name   string   `json:"name"`
+	Keys   []string `json:"keys"`
+	Values []string `json:"values"`
+	Root   string   `json:"root"`
+}
+
+// RunReferenceVectors reads a JSON file of reference vectors, each one made
+// of a list of keys, a list of values and a root commitment, all hex-encoded.
+// It inserts the keys and values of each vector into an empty tree, and
+// returns an error for the first vector whose root commitment differs from
+// the expected one. It protects against accidental changes to the
+// commitment scheme.
+func RunReferenceVectors(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading reference vectors: %w", err)
+	}
+	var vectors []referenceVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		return fmt.Errorf("decoding reference vectors: %w", err)
+	}
+
+	for _, vector := range vectors {
+		if len(vector.Keys) != len(vector.Values) {
+			return fmt.Errorf("vector %s: %d keys and %d values", vector.Name, len(vector.Keys), len(vector.Values))
+		}
+		root := New()
+		for i := range vector.Keys {
+			key, err := PrefixedHexStringToBytes(vector.Keys[i])
+			if err != nil {
+				return fmt.Errorf("vector %s: decoding key #%d: %w", vector.Name, i, err)
+			}
+			value, err := PrefixedHexStringToBytes(vector.Values[i])
+			if err != nil {
+				return fmt.Errorf("vector %s: decoding value #%d: %w", vector.Name, i, err)
+			}
+			if len(key) != KeySize {
+				return fmt.Errorf("vector %s: invalid length %d for key #%d", vector.Name, len(key), i)
+			}
+			if err := root.Insert(key, value, nil); err != nil {
+				return fmt.Errorf("vector %s: inserting key %x: %w", vector.Name, key, err)
+			}
+		}
+		expected, err := PrefixedHexStringToBytes(vector.Root)
+		if err != nil {
+			return fmt.Errorf("vector %s: decoding root: %w", vector.Name, err)
+		}
+		if got := root.Commit().Bytes(); !bytes.Equal(got[:], expected) {
+			return fmt.Errorf("vector %s: root mismatch, got %x, expected %x", vector.Name, got, expected)
+		}
+	}
+	return nil
+}